@@ -930,6 +930,46 @@ func GetTag(c appengine.Context, kind, name string) (*Tag, error) {
 	return t, nil
 }
 
+// A DeletedBranch records that a branch of a package was deleted
+// upstream, as reported by the commit watcher. The branch's commits
+// are kept, as its archived timeline.
+type DeletedBranch struct {
+	PackagePath string // (empty for main repo)
+	Branch      string
+	Time        time.Time // when the deletion was reported
+}
+
+func (b *DeletedBranch) Key(c appengine.Context) *datastore.Key {
+	p := Package{Path: b.PackagePath}
+	return datastore.NewKey(c, "DeletedBranch", b.Branch, 0, p.Key(c))
+}
+
+// A Heartbeat records when the commit watcher last reported that it
+// is watching a package, so that a package with no new commits can
+// be told from one whose watcher has died.
+type Heartbeat struct {
+	PackagePath string    // (empty for main repo)
+	Time        time.Time // when the watcher sent it
+}
+
+func (h *Heartbeat) Key(c appengine.Context) *datastore.Key {
+	p := Package{Path: h.PackagePath}
+	return datastore.NewKey(c, "Heartbeat", "watcher", 0, p.Key(c))
+}
+
+// A Watcher records the repos a commit watcher reports on, as of its
+// last registration, so that repos no watcher is responsible for can
+// be found.
+type Watcher struct {
+	Host  string    // hostname of the watcher
+	Repos []string  // repo names, e.g. "go" and "net"
+	Time  time.Time // when it registered
+}
+
+func (w *Watcher) Key(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Watcher", w.Host, 0, nil)
+}
+
 // Packages returns packages of the specified kind.
 // Kind must be one of "external" or "subrepo".
 func Packages(c appengine.Context, kind string) ([]*Package, error) {
@@ -126,6 +126,218 @@ func commitHandler(r *http.Request) (interface{}, error) {
 
 var needsBenchmarkingBytes = []byte(`"NeedsBenchmarking"`)
 
+// maxCommitsSeenBatch is the most hashes commitsSeenHandler
+// will look up in one request.
+const maxCommitsSeenBatch = 100
+
+// commitsSeenHandler reports which of a set of commits are known.
+//
+// It reads a JSON-encoded object with PackagePath and Hashes fields
+// from the POST body and returns a map whose keys are the hashes
+// of the commits in the datastore.
+//
+// This handler is used by the commit watcher, to find the last
+// commit it posted on a branch in fewer round trips than with
+// one GET to commitHandler per commit.
+func commitsSeenHandler(r *http.Request) (interface{}, error) {
+	if r.Method != "POST" {
+		return nil, errBadMethod(r.Method)
+	}
+	c := contextForRequest(r)
+	var req struct {
+		PackagePath string
+		Hashes      []string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("decoding Body: %v", err)
+	}
+	if len(req.Hashes) > maxCommitsSeenBatch {
+		return nil, fmt.Errorf("too many hashes: %d > %d", len(req.Hashes), maxCommitsSeenBatch)
+	}
+	keys := make([]*datastore.Key, len(req.Hashes))
+	for i, hash := range req.Hashes {
+		if !validHash(hash) {
+			return nil, fmt.Errorf("invalid hash %q", hash)
+		}
+		keys[i] = (&Commit{PackagePath: req.PackagePath, Hash: hash}).Key(c)
+	}
+	coms := make([]Commit, len(keys))
+	err := datastore.GetMulti(c, keys, coms)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, fmt.Errorf("getting Commits: %v", err)
+	}
+	seen := make(map[string]bool)
+	for i, hash := range req.Hashes {
+		if merr != nil && merr[i] != nil {
+			if merr[i] != datastore.ErrNoSuchEntity {
+				return nil, fmt.Errorf("getting Commit %v: %v", hash, merr[i])
+			}
+			continue
+		}
+		if coms[i].Num == 0 && coms[i].Desc == "" {
+			// Incomplete Commit written by the perf builder;
+			// see commitHandler.
+			continue
+		}
+		seen[hash] = true
+	}
+	return seen, nil
+}
+
+// maxCommitsBatch is the most commits commitsHandler
+// will add in one request.
+const maxCommitsBatch = 100
+
+// commitResult is commitsHandler's response for one commit.
+type commitResult struct {
+	Hash  string
+	Error string // empty if the commit was added
+}
+
+// commitsHandler records a batch of new commits.
+//
+// It reads a JSON-encoded array of Commit values from the POST body
+// and adds them in order, as commitHandler does, stopping at the
+// first that fails (whose successors most likely depend on it). It
+// returns a commitResult for each commit it tried.
+//
+// This handler is used by the commit watcher, to post many commits
+// (such as after an outage) in fewer round trips than with one POST
+// to commitHandler per commit.
+func commitsHandler(r *http.Request) (interface{}, error) {
+	if r.Method != "POST" {
+		return nil, errBadMethod(r.Method)
+	}
+	c := contextForRequest(r)
+	if !isMasterKey(c, r.FormValue("key")) {
+		return nil, errors.New("can only POST commits with master key")
+	}
+	// As in commitHandler, the commit watcher doesn't support gccgo.
+	if dashboardForRequest(r) != gccgoDash {
+		v, _ := strconv.Atoi(r.FormValue("version"))
+		if v != watcherVersion {
+			return nil, fmt.Errorf("rejecting POST from commit watcher; need version %v instead of %v",
+				watcherVersion, v)
+		}
+	}
+	var coms []*Commit
+	if err := json.NewDecoder(r.Body).Decode(&coms); err != nil {
+		return nil, fmt.Errorf("decoding Body: %v", err)
+	}
+	if len(coms) > maxCommitsBatch {
+		return nil, fmt.Errorf("too many commits: %d > %d", len(coms), maxCommitsBatch)
+	}
+	defer cache.Tick(c)
+	var res []commitResult
+	for _, com := range coms {
+		com.Desc = limitStringLength(com.Desc, maxDatastoreStringLen)
+		err := com.Valid()
+		if err != nil {
+			err = fmt.Errorf("validating Commit: %v", err)
+		} else {
+			err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+				return addCommit(c, com)
+			}, nil)
+		}
+		if err != nil {
+			res = append(res, commitResult{Hash: com.Hash, Error: err.Error()})
+			break
+		}
+		res = append(res, commitResult{Hash: com.Hash})
+	}
+	return res, nil
+}
+
+// branchDeletedHandler records that a branch was deleted upstream.
+//
+// It reads a JSON-encoded object with PackagePath and Branch fields
+// from the POST body and stores a DeletedBranch for them.
+//
+// This handler is used by the commit watcher, once for each deleted
+// branch whose commits it had posted.
+func branchDeletedHandler(r *http.Request) (interface{}, error) {
+	if r.Method != "POST" {
+		return nil, errBadMethod(r.Method)
+	}
+	c := contextForRequest(r)
+	if !isMasterKey(c, r.FormValue("key")) {
+		return nil, errors.New("can only POST branch deletions with master key")
+	}
+	b := new(DeletedBranch)
+	if err := json.NewDecoder(r.Body).Decode(b); err != nil {
+		return nil, fmt.Errorf("decoding Body: %v", err)
+	}
+	if b.Branch == "" {
+		return nil, errors.New("missing Branch")
+	}
+	if _, err := GetPackage(c, b.PackagePath); err != nil {
+		return nil, err
+	}
+	b.Time = time.Now()
+	_, err := datastore.Put(c, b.Key(c), b)
+	return nil, err
+}
+
+// heartbeatHandler records that the commit watcher is watching a
+// package.
+//
+// It reads a JSON-encoded object with PackagePath and Time fields
+// from the POST body and stores it as the package's Heartbeat,
+// replacing the previous one.
+//
+// This handler is used by the commit watcher, periodically for each
+// package, whether or not it has new commits.
+func heartbeatHandler(r *http.Request) (interface{}, error) {
+	if r.Method != "POST" {
+		return nil, errBadMethod(r.Method)
+	}
+	c := contextForRequest(r)
+	if !isMasterKey(c, r.FormValue("key")) {
+		return nil, errors.New("can only POST heartbeats with master key")
+	}
+	h := new(Heartbeat)
+	if err := json.NewDecoder(r.Body).Decode(h); err != nil {
+		return nil, fmt.Errorf("decoding Body: %v", err)
+	}
+	if h.Time.IsZero() {
+		return nil, errors.New("missing Time")
+	}
+	if _, err := GetPackage(c, h.PackagePath); err != nil {
+		return nil, err
+	}
+	_, err := datastore.Put(c, h.Key(c), h)
+	return nil, err
+}
+
+// watcherRegisterHandler records the repos a commit watcher reports on.
+//
+// It reads a JSON-encoded object with Host and Repos fields from the
+// POST body and stores it as the Watcher for that host, replacing
+// any earlier registration.
+//
+// This handler is used by the commit watcher at startup, and again
+// whenever its set of repos changes.
+func watcherRegisterHandler(r *http.Request) (interface{}, error) {
+	if r.Method != "POST" {
+		return nil, errBadMethod(r.Method)
+	}
+	c := contextForRequest(r)
+	if !isMasterKey(c, r.FormValue("key")) {
+		return nil, errors.New("can only register watchers with master key")
+	}
+	w := new(Watcher)
+	if err := json.NewDecoder(r.Body).Decode(w); err != nil {
+		return nil, fmt.Errorf("decoding Body: %v", err)
+	}
+	if w.Host == "" {
+		return nil, errors.New("missing Host")
+	}
+	w.Time = time.Now()
+	_, err := datastore.Put(c, w.Key(c), w)
+	return nil, err
+}
+
 // addCommit adds the Commit entity to the datastore and updates the tip Tag.
 // It must be run inside a datastore transaction.
 func addCommit(c appengine.Context, com *Commit) error {
@@ -983,14 +1195,19 @@ func init() {
 	handleFunc("/key", keyHandler)
 
 	// authenticated handlers
+	handleFunc("/branch-deleted", AuthHandler(branchDeletedHandler))
 	handleFunc("/building", AuthHandler(buildingHandler))
 	handleFunc("/clear-results", AuthHandler(clearResultsHandler))
 	handleFunc("/commit", AuthHandler(commitHandler))
+	handleFunc("/commits", AuthHandler(commitsHandler))
+	handleFunc("/commits-seen", AuthHandler(commitsSeenHandler))
+	handleFunc("/heartbeat", AuthHandler(heartbeatHandler))
 	handleFunc("/packages", AuthHandler(packagesHandler))
 	handleFunc("/perf-result", AuthHandler(perfResultHandler))
 	handleFunc("/result", AuthHandler(resultHandler))
 	handleFunc("/tag", AuthHandler(tagHandler))
 	handleFunc("/todo", AuthHandler(todoHandler))
+	handleFunc("/watcher-register", AuthHandler(watcherRegisterHandler))
 
 	// public handlers
 	handleFunc("/log/", logHandler)
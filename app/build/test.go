@@ -39,6 +39,9 @@ var testEntityKinds = []string{
 	"PerfConfig",
 	"PerfTodo",
 	"Log",
+	"DeletedBranch",
+	"Heartbeat",
+	"Watcher",
 }
 
 const testPkg = "golang.org/x/test"
@@ -65,6 +68,10 @@ func tCommit(hash, parentHash, path string, bench bool) *Commit {
 	}
 }
 
+// errorResponse is the expected result of a request that should fail,
+// part of the error it should be answered with.
+type errorResponse string
+
 var testRequests = []struct {
 	path string
 	vals url.Values
@@ -212,6 +219,30 @@ var testRequests = []struct {
 	{"/todo", url.Values{"kind": {"build-go-commit", "benchmark-go-commit"}, "builder": {"linux-386"}}, nil, &Todo{Kind: "benchmark-go-commit", Data: &Commit{Hash: "0003"}}},
 	{"/perf-result", nil, &PerfRequest{Builder: "linux-386", Benchmark: "meta-done", Hash: "0003", OK: true}, nil},
 	{"/todo", url.Values{"kind": {"build-go-commit", "benchmark-go-commit"}, "builder": {"linux-386"}}, nil, nil},
+
+	// batches of commits
+	{"/commits", nil, []*Commit{tCommit("0008", "0007", "", false), tCommit("0009", "0008", "", false)}, []commitResult{{Hash: "0008"}, {Hash: "0009"}}},
+	{"/todo", url.Values{"kind": {"build-go-commit"}, "builder": {"linux-386"}}, nil, &Todo{Kind: "build-go-commit", Data: &Commit{Hash: "0009"}}},
+	{"/commits", url.Values{"version": {"1"}}, []*Commit{tCommit("0010", "0009", "", false)}, errorResponse("need version 3 instead of 1")},
+	// the commit watcher doesn't support gccgo, so its version isn't checked
+	{"/gccgo/commits", url.Values{"version": {"1"}}, []*Commit{}, nil},
+
+	// branches deleted upstream
+	{"/branch-deleted", nil, &DeletedBranch{PackagePath: testPkg, Branch: "dev.test"}, nil},
+	{"/branch-deleted", nil, &DeletedBranch{PackagePath: "golang.org/x/nope", Branch: "dev.test"}, errorResponse(`package "golang.org/x/nope" not found`)},
+	{"/branch-deleted", nil, &DeletedBranch{PackagePath: testPkg}, errorResponse("missing Branch")},
+
+	// watcher heartbeats
+	{"/heartbeat", nil, &Heartbeat{PackagePath: "", Time: time.Now()}, nil},
+	{"/heartbeat", nil, &Heartbeat{PackagePath: testPkg, Time: time.Now()}, nil},
+	{"/heartbeat", nil, &Heartbeat{PackagePath: testPkg, Time: time.Now()}, nil},
+	{"/heartbeat", nil, &Heartbeat{PackagePath: "golang.org/x/nope", Time: time.Now()}, errorResponse(`package "golang.org/x/nope" not found`)},
+	{"/heartbeat", nil, &Heartbeat{PackagePath: testPkg}, errorResponse("missing Time")},
+
+	// watcher registrations
+	{"/watcher-register", nil, &Watcher{Host: "watcher-1", Repos: []string{"go", "test"}}, nil},
+	{"/watcher-register", nil, &Watcher{Host: "watcher-1", Repos: []string{"go"}}, nil},
+	{"/watcher-register", nil, &Watcher{Repos: []string{"go"}}, errorResponse("missing Host")},
 }
 
 func testHandler(w http.ResponseWriter, r *http.Request) {
@@ -288,6 +319,10 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 		if t.path == "/todo" {
 			resp.Response = &Todo{Data: &Commit{}}
 		}
+		// Likewise for a batch of commit results.
+		if _, ok := t.res.([]commitResult); ok {
+			resp.Response = &[]commitResult{}
+		}
 
 		if strings.HasPrefix(t.path, "/log/") {
 			resp.Response = rec.Body.String()
@@ -298,6 +333,17 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+		if e, ok := t.res.(errorResponse); ok {
+			if !strings.Contains(resp.Error, string(e)) {
+				errorf("got error %q, want one containing %q", resp.Error, e)
+				return
+			}
+			continue
+		}
+		if resp.Error != "" {
+			errorf("error: %s", resp.Error)
+			return
+		}
 		if e, ok := t.res.(string); ok {
 			g, ok := resp.Response.(string)
 			if !ok {
@@ -309,6 +355,19 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+		if e, ok := t.res.([]commitResult); ok {
+			g := *resp.Response.(*[]commitResult)
+			if len(g) != len(e) {
+				errorf("got %d commit results, want %d: %+v", len(g), len(e), g)
+				return
+			}
+			for i := range g {
+				if g[i] != e[i] {
+					errorf("commit result %d: got %+v, want %+v", i, g[i], e[i])
+					return
+				}
+			}
+		}
 		if e, ok := t.res.(*Todo); ok {
 			g, ok := resp.Response.(*Todo)
 			if !ok {
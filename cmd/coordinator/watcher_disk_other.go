@@ -0,0 +1,14 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package main
+
+import "errors"
+
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.New("checking free disk space is not supported on this platform")
+}
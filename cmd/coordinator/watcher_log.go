@@ -0,0 +1,108 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// The watcher's logging, in the format chosen by -watcher.logformat:
+// plain text lines (the default) or one JSON object per line, for log
+// aggregation.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A watcherLogger writes the watcher's log messages.
+type watcherLogger interface {
+	// Log logs msg at level ("info", "warning" or "error") for the
+	// named repo, or for the watcher as a whole if repo is empty.
+	Log(level, repo, msg string)
+}
+
+// watcherLog is the logger used by logf and watcherLogf.
+// It is set from -watcher.logformat.
+var watcherLog watcherLogger = textLogger{}
+
+// newWatcherLogger returns the logger for the -watcher.logformat
+// format, writing JSON (if chosen) to w.
+func newWatcherLogger(format string, w io.Writer) (watcherLogger, error) {
+	switch format {
+	case "text":
+		return textLogger{}, nil
+	case "json":
+		return &jsonLogger{w: w}, nil
+	}
+	return nil, fmt.Errorf("invalid -watcher.logformat %q", format)
+}
+
+// textLogger logs through the log package, prefixing each message
+// with its repo's name, if any.
+type textLogger struct{}
+
+func (textLogger) Log(level, repo, msg string) {
+	if level == "warning" {
+		msg = "warning: " + msg
+	}
+	if repo != "" {
+		msg = repo + ": " + msg
+	}
+	log.Print(msg)
+}
+
+// jsonLogger writes each message to w as a JSON object on its own line.
+type jsonLogger struct {
+	mu sync.Mutex // serializes writes to w
+	w  io.Writer
+}
+
+// A jsonLogEntry is one line of jsonLogger's output.
+type jsonLogEntry struct {
+	TS    time.Time `json:"ts"`
+	Level string    `json:"level"`
+	Repo  string    `json:"repo,omitempty"`
+	Msg   string    `json:"msg"`
+}
+
+func (l *jsonLogger) Log(level, repo, msg string) {
+	j, err := json.Marshal(jsonLogEntry{TS: watcherNow().UTC(), Level: level, Repo: repo, Msg: msg})
+	if err != nil {
+		// Can't happen; all fields are strings or times.
+		log.Printf("marshaling log entry: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(j, '\n'))
+}
+
+// logLevel returns the level of msg and msg without any level prefix.
+// Messages starting with "warning: " are warnings; all others are info.
+func logLevel(msg string) (level, rest string) {
+	if strings.HasPrefix(msg, "warning: ") {
+		return "warning", strings.TrimPrefix(msg, "warning: ")
+	}
+	return "info", msg
+}
+
+// logf logs a message for r.
+func (r *Repo) logf(format string, args ...interface{}) {
+	level, msg := logLevel(fmt.Sprintf(format, args...))
+	watcherLog.Log(level, r.name(), msg)
+}
+
+// watcherLogf logs a message for the watcher as a whole.
+func watcherLogf(format string, args ...interface{}) {
+	level, msg := logLevel(fmt.Sprintf(format, args...))
+	watcherLog.Log(level, "", msg)
+}
+
+// watcherErrorf logs an error for the watcher as a whole.
+func watcherErrorf(format string, args ...interface{}) {
+	watcherLog.Log("error", "", fmt.Sprintf(format, args...))
+}
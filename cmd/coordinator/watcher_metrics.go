@@ -0,0 +1,223 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Metrics about the watcher and its repos, served at /metrics in the
+// Prometheus text exposition format. Metrics of the watcher as a
+// whole have an empty repo label.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// watcherMetricHelp holds the help text of each metric,
+// which also serves as the list of metrics to export.
+var watcherMetricHelp = map[string]string{
+	"watcher_fetch_attempts_total":   "Number of git fetch attempts.",
+	"watcher_fetch_failures_total":   "Number of failed git fetch attempts.",
+	"watcher_push_attempts_total":    "Number of attempts to push to the mirror.",
+	"watcher_push_failures_total":    "Number of failed attempts to push to the mirror.",
+	"watcher_commits_posted_total":   "Number of commits posted to the dashboard.",
+	"watcher_dashboard_errors_total": "Number of failed requests to the dashboard.",
+	"watcher_fetch_duration_seconds": "Duration of git fetches, including retries.",
+	"watcher_push_duration_seconds":  "Duration of pushes to the mirror, including retries.",
+	"watcher_post_duration_seconds":  "Duration of posting a commit to the dashboard.",
+	"watcher_post_lag_seconds":       "Time from a commit's date to its posting to the dashboard.",
+	"watcher_fetch_latency_seconds":  "Quantiles of the durations of recent successful git fetches, including retries.",
+
+	"watcher_gerrit_poll_attempts_total":       "Number of polls of Gerrit for branch heads.",
+	"watcher_gerrit_poll_failures_total":       "Number of failed polls of Gerrit for branch heads.",
+	"watcher_gerrit_poll_consecutive_failures": "Number of polls of Gerrit for branch heads that have failed since the last success.",
+}
+
+// watcherSummaries maps the names of summary metrics to the recent
+// samples of them each repo keeps. Their quantiles are computed from
+// the samples when the metrics are served.
+var watcherSummaries = map[string]func(r *Repo) *durationSamples{
+	"watcher_fetch_latency_seconds": func(r *Repo) *durationSamples { return &r.fetchLag },
+}
+
+// summaryQuantiles are the quantiles reported of each summary.
+var summaryQuantiles = []float64{0.5, 0.95, 0.99}
+
+// metricBuckets are the upper bounds, in seconds, of the
+// histogram buckets.
+var metricBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800}
+
+type metricKey struct {
+	name, repo string
+}
+
+// histogram is a cumulative histogram of durations.
+type histogram struct {
+	counts []uint64 // per bucket in metricBuckets, plus +Inf
+	sum    float64
+	n      uint64
+}
+
+var (
+	metricsMu  sync.Mutex
+	counters   = make(map[metricKey]uint64)
+	gauges     = make(map[metricKey]float64)
+	histograms = make(map[metricKey]*histogram)
+)
+
+// incMetric increments the named counter for repo.
+func incMetric(name, repo string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	counters[metricKey{name, repo}]++
+}
+
+// setMetric sets the named gauge for repo to v.
+func setMetric(name, repo string, v float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	gauges[metricKey{name, repo}] = v
+}
+
+// observeMetric records d in the named histogram for repo.
+func observeMetric(name, repo string, d time.Duration) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	k := metricKey{name, repo}
+	h := histograms[k]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricBuckets)+1)}
+		histograms[k] = h
+	}
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(metricBuckets, secs)
+	h.counts[i]++
+	h.sum += secs
+	h.n++
+}
+
+// countAttempts returns a function that calls fn, counting the call
+// and any failure in the watcher_<op>_attempts_total and
+// watcher_<op>_failures_total metrics for r.
+func (r *Repo) countAttempts(op string, fn func() error) func() error {
+	return func() error {
+		incMetric("watcher_"+op+"_attempts_total", r.name())
+		err := fn()
+		if err != nil {
+			incMetric("watcher_"+op+"_failures_total", r.name())
+		}
+		return err
+	}
+}
+
+// timeMetric records the time since start in the named
+// histogram for r.
+func (r *Repo) timeMetric(name string, start time.Time) {
+	observeMetric(name, r.name(), time.Since(start))
+}
+
+// recordPostLag records d, the time from a commit's date to its
+// posting to the dashboard, for the status page and the
+// watcher_post_lag_seconds histogram.
+func (r *Repo) recordPostLag(d time.Duration) {
+	r.postLag.add(d)
+	observeMetric("watcher_post_lag_seconds", r.name(), d)
+}
+
+// handleWatcherMetrics serves all repos' metrics.
+func handleWatcherMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	repos := allRepos()
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	var names []string
+	for name := range watcherMetricHelp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if samples, ok := watcherSummaries[name]; ok {
+			writeSummary(bw, name, repos, samples)
+			continue
+		}
+		var keys []metricKey
+		for k := range counters {
+			if k.name == name {
+				keys = append(keys, k)
+			}
+		}
+		for k := range gauges {
+			if k.name == name {
+				keys = append(keys, k)
+			}
+		}
+		for k := range histograms {
+			if k.name == name {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].repo < keys[j].repo })
+		typ := "counter"
+		if _, ok := histograms[keys[0]]; ok {
+			typ = "histogram"
+		} else if _, ok := gauges[keys[0]]; ok {
+			typ = "gauge"
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, watcherMetricHelp[name], name, typ)
+		for _, k := range keys {
+			repo := strconv.Quote(k.repo)
+			if v, ok := gauges[k]; ok {
+				fmt.Fprintf(bw, "%s{repo=%s} %g\n", name, repo, v)
+				continue
+			}
+			h, ok := histograms[k]
+			if !ok {
+				fmt.Fprintf(bw, "%s{repo=%s} %d\n", name, repo, counters[k])
+				continue
+			}
+			var cum uint64
+			for i, le := range metricBuckets {
+				cum += h.counts[i]
+				fmt.Fprintf(bw, "%s_bucket{repo=%s,le=\"%g\"} %d\n", name, repo, le, cum)
+			}
+			fmt.Fprintf(bw, "%s_bucket{repo=%s,le=\"+Inf\"} %d\n", name, repo, h.n)
+			fmt.Fprintf(bw, "%s_sum{repo=%s} %g\n", name, repo, h.sum)
+			fmt.Fprintf(bw, "%s_count{repo=%s} %d\n", name, repo, h.n)
+		}
+	}
+}
+
+// writeSummary writes the named summary of each of repos
+// that has samples of it.
+func writeSummary(w io.Writer, name string, repos []*Repo, samples func(*Repo) *durationSamples) {
+	header := false
+	for _, r := range repos {
+		s := samples(r)
+		n := s.count()
+		if n == 0 {
+			continue
+		}
+		if !header {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", name, watcherMetricHelp[name], name)
+			header = true
+		}
+		repo := strconv.Quote(r.name())
+		for _, q := range summaryQuantiles {
+			fmt.Fprintf(w, "%s{repo=%s,quantile=\"%g\"} %g\n", name, repo, q, s.percentile(q*100).Seconds())
+		}
+		fmt.Fprintf(w, "%s_sum{repo=%s} %g\n", name, repo, s.sum().Seconds())
+		fmt.Fprintf(w, "%s_count{repo=%s} %d\n", name, repo, n)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// shutdownSignals are the signals that make the watcher shut down.
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// Process groups aren't supported here; just the command
+// itself is signaled.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(cmd *exec.Cmd) { cmd.Process.Kill() }
+
+func killProcessGroup(cmd *exec.Cmd) { cmd.Process.Kill() }
@@ -10,72 +10,271 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"html"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
+
+	"golang.org/x/build/internal/lru"
+	"golang.org/x/build/internal/singleflight"
 )
 
 const (
-	goBase         = "https://go.googlesource.com/"
 	watcherVersion = 3        // must match dashboard/app/build/handler.go's watcherVersion
-	master         = "master" // name of the master branch
-	metaURL        = goBase + "?b=master&format=JSON"
+	master         = "master" // default branch name, if a repo's can't be determined
 )
 
 var (
-	repoURL      = flag.String("watcher.repo", goBase+"go", "Repository URL")
+	repoURL      = flag.String("watcher.repo", "", "Repository URL, or bundle://<file> to clone the repo from a git bundle file and re-fetch from it (once the file is replaced with a refreshed bundle) every -watcher.poll; if empty, the go repo under -watcher.gerritbase")
+	gerritBase   = flag.String("watcher.gerritbase", "https://go.googlesource.com/", "URL of the Gerrit host the subrepos (and by default the main repo) are cloned from, ending in /; a repo's URL is this followed by its name")
+	metaFlag     = flag.String("watcher.metaurl", "", "URL of the Gerrit JSON listing of all repos and their branch heads, with a query to which a b parameter per branch is added; if empty, -watcher.gerritbase followed by ?format=JSON")
+	subrepoBase  = flag.String("watcher.subrepoprefix", "golang.org/x/", "Import path prefix of the subrepos, ending in /; a subrepo's import path is this followed by its name")
 	dashFlag     = flag.String("watcher.dash", "https://build.golang.org/", "Dashboard URL (must end in /)")
 	keyFile      = flag.String("watcher.key", defaultKeyFile, "Build dashboard key file")
 	pollInterval = flag.Duration("watcher.poll", 10*time.Second, "Remote repo poll interval")
+	pollTimer    = flag.Duration("watcher.polltimer", 5*time.Minute, "How long each repo's watcher waits for a tickle (from the -watcher.poll polling of Gerrit) before fetching anyway, in case tickles stop arriving")
 	network      = flag.Bool("watcher.network", true, "Enable network calls (disable for testing)")
 	mirror       = flag.Bool("watcher.mirror", false, "whether to mirror to github")
+	mirrorRepos  = flag.String("watcher.mirror.repos", defaultMirrorRepos, "Comma-separated list of the names of repos to mirror to github (with -watcher.mirror)")
+	mirrorFile   = flag.String("watcher.mirror.reposFile", "", "If non-empty, a file listing more repos to mirror to github, one name per line (# starts a comment)")
+	mirrorTmpl   = flag.String("watcher.mirror.template", "git@github.com:golang/{{.Name}}.git", "Space-separated list of Go text/templates of the git URLs each repo is mirrored to (with -watcher.mirror); .Name is the repo name, e.g. \"net\"")
+	mirrorProbe  = flag.Bool("watcher.mirror.probe", false, "Also mirror repos not listed by -watcher.mirror.repos or -watcher.mirror.reposFile if https://golang.org/x/<name> (or the page of <name> under another -watcher.subrepoprefix) exists. If no repos are listed, this is always done.")
+	mirrorDry    = flag.Bool("watcher.mirror.dryrun", false, "Compare each mirror's refs with the local ones and log the refs (and hashes) that would be pushed, batch by batch, without pushing them")
+	mirrorGlobs  = flag.String("watcher.mirror.refglobs", "!refs/changes/*", "Comma-separated list of globs of the refs mirrored to github; a glob starting with ! excludes the refs it matches. A ref is mirrored if it matches an including glob (or there are none) and no excluding glob. A glob ending in /* matches every ref under that prefix, e.g. refs/changes/* matches refs/changes/34/1234/5; otherwise globs are matched as by path.Match. Refs already on the mirror are never deleted.")
 	filter       = flag.String("watcher.filter", "", "If non-empty, a comma-separated list of directories or files to watch for new commits (only works on main repo). If empty, watch all files in repo.")
 	branches     = flag.String("watcher.branches", "", "If non-empty, a comma-separated list of branches to watch. If empty, watch changes on every branch.")
+	subrepoPoll  = flag.Duration("watcher.subrepoPoll", 10*time.Minute, "How often to re-fetch the dashboard's list of subrepos, starting watches of added subrepos and stopping those of removed ones; if not positive, the list is only fetched at startup")
 	httpAddr     = flag.String("watcher.http", "", "If non-empty, the listen address to run an HTTP server on")
+	tlsCert      = flag.String("watcher.http.tlscert", "", "If non-empty, with -watcher.http.tlskey, the TLS certificate file with which -watcher.http serves HTTPS instead of HTTP")
+	tlsKey       = flag.String("watcher.http.tlskey", "", "If non-empty, with -watcher.http.tlscert, the TLS private key file with which -watcher.http serves HTTPS instead of HTTP")
+	httpToken    = flag.String("watcher.http.token", "", "If non-empty, the -watcher.http server requires an \"Authorization: Bearer <token>\" header with this token on every request except to /healthz, and responds 401 Unauthorized otherwise")
 	report       = flag.Bool("watcher.report", true, "Report updates to build dashboard (use false for development dry-run mode)")
+	logWorkers   = flag.Int("watcher.logWorkers", 4, "Maximum number of branches of a repo whose new commits are read (with git log) concurrently; if not positive, there is no limit")
+	retries      = flag.Int("watcher.retries", 3, "Number of times to attempt each git fetch and push before giving up")
+	backoff      = flag.Duration("watcher.backoff", 5*time.Second, "Delay before retrying a failed git clone, fetch or push; it doubles (plus jitter) with each further attempt, up to 5 minutes")
+	maxBootstrap = flag.Int("watcher.bootstrapDepth", 0, "If positive, when a branch has no commits on the dashboard yet, post only its last N commits instead of all commits since the initial commit (or, for other branches, since their fork from the default branch)")
+	heartbeat    = flag.Duration("watcher.heartbeat", 0, "If positive, how often to post a heartbeat for each dashboard repo, so the dashboard can tell a quiet repo from a dead watcher")
+	statusSize   = flag.Int("watcher.statusring", 50, "Number of recent status messages kept for each repo's /debug/watcher/ page")
+	cloneTries   = flag.Int("watcher.cloneAttempts", 3, "Number of times to attempt each repo's initial git clone before giving up")
+	maxRestarts  = flag.Int("watcher.restarts", 10, "Number of consecutive times a repo's failed watch is restarted, after a backoff starting at -watcher.backoff, before the watcher gives up on it and exits")
+	archiveRepos = flag.String("watcher.archiveRepos", "", "If non-empty, a comma-separated list of the names of the repos (e.g. \"go,net\") whose /<name>.tar.gz archive endpoint is served. If empty, archives of all repos are served.")
+	archiveRevs  = flag.String("watcher.archiveRevs", "", "If non-empty, a comma-separated list of the kinds of revs the archive endpoint serves: \"heads\" (branch names) and/or \"tags\" (tag names). Other revs, such as commit hashes and Gerrit change refs, are refused. If empty, any rev is served.")
+	archiveMax   = flag.Int("watcher.archivecache", 0, "If positive, the total size in MB of the archives of commit hashes (per format and compression level, across all repos) kept in memory to serve repeated requests without re-running git archive; bigger archives aren't cached")
+	archiveTTL   = flag.Duration("watcher.archivecachettl", time.Hour, "How long an archive is kept in the -watcher.archivecache cache after it is made; if not positive, archives are only evicted to make room for others")
+	useWorktree  = flag.Bool("watcher.worktree", false, "Keep a checked-out worktree of each repo's default branch and serve archives of its head from it, instead of running git archive")
+	pushBatch    = flag.Int("watcher.pushbatch", 200, "Maximum number of refs pushed to a mirror per git push; smaller batches lose less work when a push fails on a flaky link, larger ones need fewer git pushes for repos with many refs")
+	verifyPush   = flag.Bool("watcher.verifyPush", false, "After each mirror push, re-list the destination's refs and check that they match what was pushed; a mismatch is logged and fails the push attempt")
+	allowForce   = flag.Bool("watcher.allowForcePush", false, "Allow mirror pushes that rewrite history on the destination (non-fast-forward updates); if false, such refs are not pushed")
+	badDates     = flag.String("watcher.badDatePolicy", "skip", "What to do with a commit whose date can't be parsed: \"skip\" (log it and don't post it), \"zero\" (post it with the zero time) or \"now\" (post it with the current time)")
+	defBranch    = flag.String("watcher.defaultbranch", "", "If non-empty, the name of every repo's default branch (e.g. \"main\"), instead of the one determined from the repo's HEAD")
+	branchMode   = flag.String("watcher.branchmode", "all", "Which branches to watch when -watcher.branches is empty: \"all\", \"default-only\" (just the default branch) or \"default-plus-release\" (the default branch and release-branch.*)")
+	httpTimeout  = flag.Duration("watcher.http.timeout", 30*time.Second, "Maximum duration of a single HTTP request to the dashboard or Gerrit, including reading the response; if not positive, there is no limit")
+	gitTimeout   = flag.Duration("watcher.gittimeout", 30*time.Minute, "Maximum duration of a single git fetch or push; stuck git processes are killed after this long")
+	prune        = flag.Bool("watcher.prune", false, "Run git fetch with --prune, so branches deleted upstream are removed from the local mirror")
+	allowOrphans = flag.Bool("watcher.allowOrphans", false, "Tolerate commits whose parent is unknown (e.g. in shallow or filtered clones), logging a warning instead of failing")
+	minFreeMB    = flag.Int("watcher.minfreemb", 0, "If positive, the minimum free disk space (in MB) required in the git cache dir; clones and fetches pause until at least this much space is available")
+	postSpec     = flag.String("watcher.postfilter", "", "If non-empty, a space-separated list of conditions a commit must all meet to be posted to the dashboard: author:SUBSTRING (the author's name and email contain SUBSTRING) or desc:REGEXP (the commit message matches REGEXP; use \\s for spaces), each negated by a leading !. For example, !author:gopherbot@golang.org skips gopherbot's commits. Skipped commits are still mirrored, and their children are posted with the nearest posted ancestor as their parent.")
+	blockedFile  = flag.String("watcher.blockedCommits", "", "If non-empty, a file listing commit hashes (one per line; # starts a comment) that must never be posted to the dashboard or (best-effort) mirrored")
+	maxPosts     = flag.Int("watcher.maxConcurrentPosts", 0, "If positive, the maximum number of commits posted to the dashboard concurrently, across all repos")
+	maxFetches   = flag.Int("watcher.maxConcurrentFetches", 0, "If positive, the maximum number of git fetches run concurrently, across all repos")
+	pushState    = flag.Bool("watcher.pushstate", false, "Persist the refs pending a mirror push to a state file in the git cache dir, so a restarted watcher resumes an interrupted push without re-diffing all refs, and count watcher restarts")
+	headEvents   = flag.Bool("watcher.headevents", false, "Emit a structured (JSON) log line each time a known branch head advances")
+	largeChange  = flag.Int("watcher.largeChange", 0, "If positive, count the lines each commit inserts and deletes (with git log --numstat), and warn about and report to the dashboard as large any commit changing more than this many lines in total")
+	shallow      = flag.Int("watcher.shallow", 0, "If positive, clone subrepos that aren't mirrored (and aren't fetched from bundles) with only the last N commits of each branch (git clone --depth N), fetching more history as needed to reach the commits the dashboard has already seen")
+	verifySig    = flag.Bool("watcher.verifysig", false, "Only post commits to the dashboard whose signature git reports as good and valid (%G? of G); commits with bad or uncheckable signatures are logged and skipped, as are unsigned ones unless -watcher.unsigned=allow")
+	unsignedPol  = flag.String("watcher.unsigned", "skip", "With -watcher.verifysig, what to do with unsigned commits: \"skip\" (log them and don't post them) or \"allow\" (post them)")
+	logStyle     = flag.String("watcher.logformat", "text", "Format of the watcher's log output: \"text\" (lines prefixed with the repo name) or \"json\" (one object per line with ts, level, repo and msg fields, written to stderr)")
+	postFiles    = flag.Int("watcher.postFiles", 0, "If positive, include the names of up to this many of each commit's changed files in the commits posted to the dashboard; longer lists are truncated and marked as such")
+	releasePaths = flag.String("watcher.releasePaths", "doc/,api/", "Comma-separated list of path prefixes of release-relevant files (such as release notes and API files); commits touching them are reported to the dashboard as release-relevant")
+	shardIndex   = flag.Int("watcher.shardIndex", 0, "With -watcher.shardCount, which shard of the repos (from 0) this watcher handles")
+	shardCount   = flag.Int("watcher.shardCount", 1, "Number of watchers the repos (including the main repo, \"go\") are divided among by a hash of their names; each handles the shard given by -watcher.shardIndex")
+	benchRules   = flag.String("watcher.bench", "", "If non-empty, a semicolon-separated list of per-repo benchmarking rules of the form name=prefix,prefix[:ext,ext[:exclude,exclude]] (e.g. \"tools=cmd/,go/:.go\"). Commits touching files under one of the prefixes (and, if given, with one of the extensions) that no exclude pattern matches need benchmarking. Exclude patterns are matched (as by path.Match) against each element of a file's path, and default to *_test.go,testdata. The main repo's default rule is include,src, excluding files ending in _test.go or with testdata anywhere in their path; subrepos without a rule are never benchmarked.")
 )
 
 var (
 	defaultKeyFile = filepath.Join(homeDir(), ".gobuildkey")
 	dashboardKey   = ""
-	networkSeen    = make(map[string]bool) // testing mode only (-watcher.network=false); known hashes
+	networkSeen    = make(map[string]bool)     // testing mode only (-watcher.network=false); known hashes
+	benchConfigs   = map[string]*benchConfig{} // keyed by repo name; populated from -watcher.bench
+	releasePrefix  = []string{"doc/", "api/"}  // see -watcher.releasePaths
+	postSem        semaphore                   // limits concurrent dashboard posts; see -watcher.maxConcurrentPosts
+	fetchSem       semaphore                   // limits concurrent git fetches; see -watcher.maxConcurrentFetches
+	blockedCommits = map[string]bool{}         // hashes never to post or mirror; see -watcher.blockedCommits
+	archiveCache   *archiveLRU                 // nil if disabled; see -watcher.archivecache
+	archiveGroup   singleflight.Group          // git archive runs in flight, keyed by archiveKey.String()
 )
 
+// watcherClient is the HTTP client used for all requests to the
+// dashboard and Gerrit, so that a hung server can't block a repo
+// forever. Its timeout is set from -watcher.http.timeout.
+var watcherClient = &http.Client{Timeout: 30 * time.Second}
+
 func watcherMain() {
-	log.Printf("Running watcher role.")
+	watcherLogf("Running watcher role.")
+	watcherClient.Timeout = *httpTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, shutdownSignals...)
+	go func() {
+		sig := <-sigc
+		watcherLogf("Watcher got %v; shutting down after in-progress work.", sig)
+		cancel()
+	}()
 	go pollGerritAndTickle()
-	err := runWatcher()
-	log.Printf("Watcher exiting after failure: %v", err)
+	err := runWatcher(ctx)
+	if err == nil {
+		watcherLogf("Watcher shut down.")
+		os.Exit(0)
+	}
+	watcherErrorf("Watcher exiting after failure: %v", err)
 	os.Exit(1)
 }
 
 // runWatcher is a little wrapper so we can use defer and return to signal
-// errors. It should only return a non-nil error.
-func runWatcher() error {
+// errors. It returns nil only once ctx is done and all repos' watchers
+// have stopped.
+func runWatcher(ctx context.Context) error {
 	if !strings.HasSuffix(*dashFlag, "/") {
 		return errors.New("dashboard URL (-dashboard) must end in /")
 	}
 
+	switch *branchMode {
+	case "all", "default-only", "default-plus-release":
+	default:
+		return fmt.Errorf("invalid -watcher.branchmode %q", *branchMode)
+	}
+
+	if l, err := newWatcherLogger(*logStyle, os.Stderr); err != nil {
+		return err
+	} else {
+		watcherLog = l
+	}
+
+	switch *badDates {
+	case "skip", "zero", "now":
+	default:
+		return fmt.Errorf("invalid -watcher.badDatePolicy %q", *badDates)
+	}
+
+	switch *unsignedPol {
+	case "skip", "allow":
+	default:
+		return fmt.Errorf("invalid -watcher.unsigned %q", *unsignedPol)
+	}
+
+	if bc, err := parseBenchRules(*benchRules); err != nil {
+		return err
+	} else {
+		benchConfigs = bc
+	}
+
+	releasePrefix = splitList(*releasePaths)
+
+	if kinds, err := parseArchiveRevs(*archiveRevs); err != nil {
+		return err
+	} else {
+		archiveRevKinds = kinds
+	}
+
+	if *shardCount < 1 || *shardIndex < 0 || *shardIndex >= *shardCount {
+		return fmt.Errorf("invalid -watcher.shardIndex %d for -watcher.shardCount %d", *shardIndex, *shardCount)
+	}
+
+	if *statusSize < 1 {
+		return fmt.Errorf("invalid -watcher.statusring %d; must be positive", *statusSize)
+	}
+
+	if *pollTimer <= 0 {
+		return fmt.Errorf("invalid -watcher.polltimer %v; must be positive", *pollTimer)
+	}
+
+	if *pushBatch < 1 {
+		return fmt.Errorf("invalid -watcher.pushbatch %d; must be positive", *pushBatch)
+	}
+	if !strings.HasSuffix(*gerritBase, "/") {
+		return fmt.Errorf("invalid -watcher.gerritbase %q; must end in /", *gerritBase)
+	}
+	if !strings.HasSuffix(*subrepoBase, "/") {
+		return fmt.Errorf("invalid -watcher.subrepoprefix %q; must end in /", *subrepoBase)
+	}
+	if *metaFlag != "" && !strings.Contains(*metaFlag, "?") {
+		return fmt.Errorf("invalid -watcher.metaurl %q; must have a query, such as ?format=JSON", *metaFlag)
+	}
+	if *maxRestarts < 0 {
+		return fmt.Errorf("invalid -watcher.restarts %d; must not be negative", *maxRestarts)
+	}
+
+	postSem = newSemaphore(*maxPosts)
+	fetchSem = newSemaphore(*maxFetches)
+	if *archiveMax > 0 {
+		archiveCache = newArchiveLRU(int64(*archiveMax) << 20)
+	}
+
+	if tmpls, err := parseMirrorTemplates(*mirrorTmpl); err != nil {
+		return err
+	} else if *mirror && len(tmpls) == 0 {
+		return errors.New("-watcher.mirror requires a -watcher.mirror.template")
+	} else {
+		mirrorTemplates = tmpls
+	}
+
+	if f, err := parseRefGlobs(*mirrorGlobs); err != nil {
+		return err
+	} else {
+		mirrorRefs = f
+	}
+
+	if f, err := parseCommitFilter(*postSpec); err != nil {
+		return err
+	} else {
+		postFilter = f
+	}
+
+	if mc, err := loadMirrorConfig(*mirrorRepos, *mirrorFile, *mirrorProbe); err != nil {
+		return err
+	} else {
+		mirrorCfg = mc
+	}
+
+	if *blockedFile != "" {
+		m, err := readBlockedCommits(*blockedFile)
+		if err != nil {
+			return err
+		}
+		blockedCommits = m
+		watcherLogf("loaded %d blocked commits from %s", len(m), *blockedFile)
+	}
+
 	if *report {
 		if k, err := readKey(); err != nil {
 			return err
@@ -96,936 +295,4442 @@ func runWatcher() error {
 		defer os.RemoveAll(dir)
 	}
 
+	if *pushState {
+		if n, err := recordWatcherStart(dir); err != nil {
+			watcherErrorf("recording watcher start: %v", err)
+		} else {
+			watcherRestarts = &n
+		}
+	}
+
+	http.HandleFunc("/debug/watcher/", handleWatcherIndex)
+	http.HandleFunc("/debug/watcher/all", handleWatcherAll)
+	http.HandleFunc("/debug/watcher/version", handleWatcherVersion)
+	http.HandleFunc("/metrics", handleWatcherMetrics)
+	http.HandleFunc("/healthz", handleHealthz)
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("-watcher.http.tlscert and -watcher.http.tlskey must be set together")
+	}
 	if *httpAddr != "" {
 		ln, err := net.Listen("tcp", *httpAddr)
 		if err != nil {
 			return err
 		}
-		go http.Serve(ln, nil)
-	}
-
-	errc := make(chan error)
-
-	go func() {
-		dst := ""
-		if *mirror {
-			name := (*repoURL)[strings.LastIndex(*repoURL, "/")+1:]
-			dst = "git@github.com:golang/" + name + ".git"
+		var h http.Handler = http.DefaultServeMux
+		if *httpToken != "" {
+			h = requireToken(*httpToken, h)
 		}
-		name := strings.TrimPrefix(*repoURL, goBase)
-		r, err := NewRepo(dir, *repoURL, dst, "", true)
-		if err != nil {
-			errc <- err
-			return
+		if *tlsCert != "" {
+			go http.ServeTLS(ln, h, *tlsCert, *tlsKey)
+		} else {
+			go http.Serve(ln, h)
 		}
-		http.Handle("/"+name+".tar.gz", r)
-		errc <- r.Watch()
-	}()
+	}
 
 	subrepos, err := subrepoList()
 	if err != nil {
 		return err
 	}
-
-	start := func(name, path string, dash bool) {
-		log.Printf("Starting watch of repo %s", name)
-		url := goBase + name
-		var dst string
-		if *mirror {
-			if shouldMirror(name) {
-				log.Printf("Starting mirror of subrepo %s", name)
-				dst = "git@github.com:golang/" + name + ".git"
-			} else {
-				log.Printf("Not mirroring repo %s", name)
+	seen := map[string]bool{"go": true}
+	for _, path := range subrepos {
+		seen[subrepoName(path)] = true
+	}
+	// Repos that are mirrored but not on the dashboard.
+	var mirrorOnly []string
+	if *mirror {
+		meta, err := gerritMetaMap()
+		if err != nil {
+			watcherErrorf("Listing Gerrit's repos; not mirroring those not on the dashboard: %v", err)
+		}
+		for name := range meta {
+			if !seen[name] {
+				mirrorOnly = append(mirrorOnly, name)
 			}
 		}
-		r, err := NewRepo(dir, url, dst, path, dash)
-		if err != nil {
-			errc <- err
-			return
+	}
+
+	// Keep only the repos in this watcher's shard.
+	watchMain := inShard("go")
+	subrepos = shardPaths(subrepos)
+	var names []string
+	for _, name := range mirrorOnly {
+		if inShard(name) {
+			names = append(names, name)
 		}
-		http.Handle("/"+name+".tar.gz", r)
-		errc <- r.Watch()
+	}
+	mirrorOnly = names
+	if *shardCount > 1 {
+		watcherLogf("Watching %d subrepos and %d mirror-only repos in shard %d of %d (main repo: %v)",
+			len(subrepos), len(mirrorOnly), *shardIndex, *shardCount, watchMain)
+	}
+	n := len(subrepos) + len(mirrorOnly)
+	if watchMain {
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no repos in shard %d of %d", *shardIndex, *shardCount)
 	}
 
-	seen := map[string]bool{"go": true}
+	var importPaths []string
+	if watchMain {
+		importPaths = append(importPaths, "")
+	}
+	importPaths = append(importPaths, subrepos...)
+	for _, name := range mirrorOnly {
+		importPaths = append(importPaths, subrepoPath(name))
+	}
+	if err := checkRepoRoots(dir, importPaths); err != nil {
+		return err
+	}
+	if err := registerWatcher(watchMain, subrepos); err != nil {
+		// Older dashboards lack the endpoint; carry on regardless.
+		watcherErrorf("Registering repos with the dashboard: %v", err)
+	}
+
+	// Each repo is watched by a goroutine of its own, under a context
+	// of its own, so that the watch can be stopped if the repo is
+	// removed from the dashboard's subrepo list. A supervisor restarts
+	// the watch if it fails, so a result with a non-nil error means
+	// the repo failed too many times in a row.
+	type result struct {
+		path string // import path; "" for the main repo
+		err  error
+	}
+	results := make(chan result)
+	running := make(map[string]context.CancelFunc) // keyed by import path
+	removed := make(map[string]bool)               // stopping since removed from the subrepo list
+	start := func(path string, run func(ctx context.Context) error) {
+		rctx, cancel := context.WithCancel(ctx)
+		running[path] = cancel
+		s := newSupervisor(path, run)
+		go func() { results <- result{path, s.supervise(rctx)} }()
+	}
+
+	if watchMain {
+		start("", func(ctx context.Context) error {
+			var dsts []string
+			if *mirror {
+				u := mainRepoURL()
+				name := u[strings.LastIndex(u, "/")+1:]
+				var err error
+				if dsts, err = mirrorURLs(name); err != nil {
+					return err
+				}
+			}
+			return watchRepo(ctx, dir, mainRepoURL(), dsts, "", true)
+		})
+	}
+	startSubrepo := func(name, path string, dash bool) {
+		start(path, func(ctx context.Context) error {
+			watcherLogf("Starting watch of repo %s", name)
+			var dsts []string
+			if *mirror {
+				if shouldMirror(name) {
+					watcherLogf("Starting mirror of subrepo %s", name)
+					var err error
+					if dsts, err = mirrorURLs(name); err != nil {
+						return err
+					}
+				} else {
+					watcherLogf("Not mirroring repo %s", name)
+				}
+			}
+			return watchRepo(ctx, dir, *gerritBase+name, dsts, path, dash)
+		})
+	}
 	for _, path := range subrepos {
-		name := strings.TrimPrefix(path, "golang.org/x/")
-		seen[name] = true
-		go start(name, path, true)
+		startSubrepo(subrepoName(path), path, true)
 	}
-	if *mirror {
-		for name := range gerritMetaMap() {
-			if seen[name] {
-				// Repo already picked up by dashboard list.
+	for _, name := range mirrorOnly {
+		startSubrepo(name, subrepoPath(name), false)
+	}
+	dashRepos := make(map[string]bool) // import paths of the watched subrepos
+	for _, path := range subrepos {
+		dashRepos[path] = true
+	}
+
+	var refresh <-chan time.Time
+	if *subrepoPoll > 0 && *network {
+		t := time.NewTicker(*subrepoPoll)
+		defer t.Stop()
+		refresh = t.C
+	}
+	for len(running) > 0 {
+		select {
+		case res := <-results:
+			delete(running, res.path)
+			if removed[res.path] {
+				delete(removed, res.path)
+				if res.err != nil {
+					watcherLogf("Watch of removed repo %s ended with error: %v", res.path, res.err)
+				} else {
+					watcherLogf("Stopped watch of removed repo %s", res.path)
+				}
+				continue
+			}
+			if res.err != nil {
+				return res.err
+			}
+		case <-refresh:
+			if ctx.Err() != nil {
+				continue
+			}
+			list, err := subrepoList()
+			if err != nil {
+				watcherErrorf("Refreshing subrepo list: %v", err)
+				continue
+			}
+			added, gone := diffSubrepos(dashRepos, shardPaths(list))
+			if len(added) == 0 && len(gone) == 0 {
 				continue
 			}
-			go start(name, "golang.org/x/"+name, false)
+			for _, path := range gone {
+				watcherLogf("Repo %s removed from the dashboard's subrepo list; stopping its watch", path)
+				delete(dashRepos, path)
+				if cancel, ok := running[path]; ok {
+					removed[path] = true
+					cancel()
+				}
+			}
+			for _, path := range added {
+				if _, ok := running[path]; ok {
+					// Still stopping, or watched as mirror-only.
+					continue
+				}
+				var paths []string
+				for p := range running {
+					paths = append(paths, p)
+				}
+				if err := checkRepoRoots(dir, append(paths, path)); err != nil {
+					watcherErrorf("Not watching new subrepo %s: %v", path, err)
+					continue
+				}
+				dashRepos[path] = true
+				startSubrepo(subrepoName(path), path, true)
+			}
+			var paths []string
+			for p := range dashRepos {
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			if err := registerWatcher(watchMain, paths); err != nil {
+				watcherErrorf("Registering repos with the dashboard: %v", err)
+			}
 		}
 	}
-
-	// Must be non-nil.
-	return <-errc
+	return nil
 }
 
-// shouldReport reports whether the named repo should be mirrored from
-// Gerrit to Github.
-func shouldMirror(name string) bool {
-	switch name {
-	case
-		"arch",
-		"benchmarks",
-		"blog",
-		"build",
-		"crypto",
-		"debug",
-		"example",
-		"exp",
-		"gddo",
-		"go",
-		"gofrontend",
-		"image",
-		"mobile",
-		"net",
-		"oauth2",
-		"playground",
-		"proposal",
-		"review",
-		"sync",
-		"sys",
-		"talks",
-		"term",
-		"text",
-		"time",
-		"tools",
-		"tour":
-		return true
-	}
-	// Else, see if it appears to be a subrepo:
-	r, err := http.Get("https://golang.org/x/" + name)
+// watchRepo creates the repo with the given NewRepo arguments
+// and watches it until ctx is done, when it returns nil, or
+// until it fails. The repo stops being served over HTTP when
+// watchRepo returns.
+func watchRepo(ctx context.Context, dir, srcURL string, dstURLs []string, importPath string, dash bool) error {
+	r, err := NewRepo(dir, srcURL, dstURLs, importPath, dash, repoOptions{})
 	if err != nil {
-		log.Printf("repo %v doesn't seem to exist: %v", name, err)
-		return false
+		return err
 	}
-	r.Body.Close()
-	return r.StatusCode/100 == 2
+	defer unregisterRepo(r)
+	return r.Watch(ctx)
 }
 
-// a statusEntry is a status string at a specific time.
-type statusEntry struct {
-	status string
-	t      time.Time
-}
+// supervisorReset is how long a repo's watch must run before failing
+// for its supervisor to consider it recovered from any earlier failures,
+// resetting the backoff and the count of consecutive failures.
+const supervisorReset = 30 * time.Minute
 
-// statusRing is a ring buffer of timestamped status messages.
-type statusRing struct {
-	mu   sync.Mutex      // guards rest
-	head int             // next position to fill
-	ent  [50]statusEntry // ring buffer of entries; zero time means unpopulated
-}
+// A supervisor runs a repo's watch, restarting it with exponential
+// backoff each time it fails, until its context is done or it has
+// failed more than -watcher.restarts times in a row.
+type supervisor struct {
+	path        string // import path; "" for the main repo
+	run         func(ctx context.Context) error
+	maxRestarts int
+	backoff     time.Duration // first delay; doubles with each failure, up to maxBackoff
 
-func (r *statusRing) add(status string) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	// after is time.After. It is a field for testing.
+	after func(time.Duration) <-chan time.Time
+}
 
-	r.ent[r.head] = statusEntry{status, time.Now()}
-	r.head++
-	if r.head == len(r.ent) {
-		r.head = 0
+func newSupervisor(path string, run func(ctx context.Context) error) *supervisor {
+	return &supervisor{
+		path:        path,
+		run:         run,
+		maxRestarts: *maxRestarts,
+		backoff:     *backoff,
+		after:       time.After,
 	}
 }
 
-func (r *statusRing) foreachDesc(fn func(statusEntry)) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	i := r.head
+// supervise runs s.run, restarting it after each failure. It returns
+// nil once ctx is done, or an error if s.run failed more than
+// s.maxRestarts consecutive times.
+func (s *supervisor) supervise(ctx context.Context) error {
+	name := s.path
+	if name == "" {
+		name = "main repo"
+	}
+	failures := 0
+	delay := s.backoff
 	for {
-		i--
-		if i < 0 {
-			i = len(r.ent) - 1
+		start := watcherNow()
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			if err != nil {
+				watcherErrorf("Watcher error for %s during shutdown: %v", name, err)
+			}
+			return nil
 		}
-		if i == r.head || r.ent[i].t.IsZero() {
-			return
+		if err == nil {
+			// Watch only returns nil once its context is done.
+			err = errors.New("watch stopped")
+		}
+		if watcherNow().Sub(start) >= supervisorReset {
+			failures, delay = 0, s.backoff
+		}
+		failures++
+		if failures > s.maxRestarts {
+			return fmt.Errorf("%s: giving up after %d consecutive failures: %v", name, failures, err)
+		}
+		watcherErrorf("Watch of %s failed (%d of %d consecutive failures allowed); restarting in %v: %v", name, failures, s.maxRestarts, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.after(delay):
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
 		}
-		fn(r.ent[i])
 	}
 }
 
-// Repo represents a repository to be watched.
-type Repo struct {
-	root     string             // on-disk location of the git repo
-	path     string             // base import path for repo (blank for main repo)
-	commits  map[string]*Commit // keyed by full commit hash (40 lowercase hex digits)
-	branches map[string]*Branch // keyed by branch name, eg "release-branch.go1.3" (or empty for default)
-	dash     bool               // push new commits to the dashboard
-	mirror   bool               // push new commits to 'dest' remote
-	status   statusRing
-}
-
-// NewRepo checks out a new instance of the Mercurial repository
-// specified by srcURL to a new directory inside dir.
-// If dstURL is not empty, changes from the source repository will
-// be mirrored to the specified destination repository.
-// The importPath argument is the base import path of the repository,
-// and should be empty for the main Go repo.
-// The dash argument should be set true if commits to this
-// repo should be reported to the build dashboard.
-func NewRepo(dir, srcURL, dstURL, importPath string, dash bool) (*Repo, error) {
-	var root string
-	if importPath == "" {
-		root = filepath.Join(dir, "go")
-	} else {
-		root = filepath.Join(dir, path.Base(importPath))
-	}
-	r := &Repo{
-		path:     importPath,
-		root:     root,
-		commits:  make(map[string]*Commit),
-		branches: make(map[string]*Branch),
-		mirror:   dstURL != "",
-		dash:     dash,
-	}
-
-	http.Handle("/debug/watcher/"+r.name(), r)
-
-	needClone := true
-	if r.shouldTryReuseGitDir(dstURL) {
-		r.setStatus("reusing git dir; running git fetch")
-		cmd := exec.Command("git", "fetch", "origin")
-		cmd.Dir = r.root
-		r.logf("running git fetch")
-		t0 := time.Now()
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			r.logf("git fetch failed; proceeding to wipe + clone instead; err: %v, stderr: %s", err, stderr.Bytes())
-		} else {
-			needClone = false
-			r.logf("ran git fetch in %v", time.Since(t0))
+// diffSubrepos compares the import paths of the watched subrepos
+// with a newly fetched subrepo list, returning the paths of the
+// subrepos added to the list and of those removed from it.
+func diffSubrepos(watched map[string]bool, list []string) (added, removed []string) {
+	inList := make(map[string]bool)
+	for _, path := range list {
+		inList[path] = true
+		if !watched[path] {
+			added = append(added, path)
 		}
 	}
-	if needClone {
-		r.setStatus("need clone; removing cache root")
-		os.RemoveAll(r.root)
-		t0 := time.Now()
-		r.setStatus("running fresh git clone --mirror")
-		r.logf("cloning %v", srcURL)
-		cmd := exec.Command("git", "clone", "--mirror", srcURL, r.root)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return nil, fmt.Errorf("cloning %s: %v\n\n%s", srcURL, err, out)
+	for path := range watched {
+		if !inList[path] {
+			removed = append(removed, path)
 		}
-		r.setStatus("cloned")
-		r.logf("cloned in %v", time.Since(t0))
 	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
 
-	if r.mirror {
-		r.setStatus("adding dest remote")
-		if err := r.addRemote("dest", dstURL); err != nil {
-			r.setStatus("failed to add dest")
-			return nil, fmt.Errorf("adding remote: %v", err)
-		}
-		r.setStatus("added dest remote")
-		r.logf("starting initial push to %v", dstURL)
-		if err := r.push(); err != nil {
-			return nil, err
-		}
-		r.logf("did initial push to %v", dstURL)
+// inShard reports whether the named repo belongs to this watcher's
+// shard, per -watcher.shardIndex and -watcher.shardCount.
+func inShard(name string) bool {
+	if *shardCount <= 1 {
+		return true
 	}
+	h := fnv.New32a()
+	io.WriteString(h, name)
+	return int(h.Sum32()%uint32(*shardCount)) == *shardIndex
+}
 
-	if r.dash {
-		r.logf("loading commit log")
-		if err := r.update(false); err != nil {
-			return nil, err
+// shardPaths returns the subrepo import paths (e.g. "golang.org/x/net")
+// from paths whose repos belong to this watcher's shard.
+func shardPaths(paths []string) []string {
+	var ps []string
+	for _, path := range paths {
+		if inShard(subrepoName(path)) {
+			ps = append(ps, path)
 		}
-		r.logf("found %v branches among %v commits\n", len(r.branches), len(r.commits))
 	}
+	return ps
+}
 
-	return r, nil
+// subrepoName returns the name (e.g. "net") of the subrepo with the
+// given import path, per -watcher.subrepoprefix.
+func subrepoName(path string) string {
+	return strings.TrimPrefix(path, *subrepoBase)
 }
 
-func (r *Repo) setStatus(status string) {
-	r.status.add(status)
+// subrepoPath returns the import path of the named subrepo,
+// per -watcher.subrepoprefix.
+func subrepoPath(name string) string {
+	return *subrepoBase + name
 }
 
-// shouldTryReuseGitDir reports whether we should try to reuse r.root as the git
-// directory. (The directory may be corrupt, though.)
-// dstURL is optional, and is the desired remote URL for a remote named "dest".
-func (r *Repo) shouldTryReuseGitDir(dstURL string) bool {
-	if _, err := os.Stat(filepath.Join(r.root, "FETCH_HEAD")); err != nil {
-		if os.IsNotExist(err) {
-			r.logf("not reusing git dir; no FETCH_HEAD at %s", r.root)
-		} else {
-			r.logf("not reusing git dir; %v", err)
-		}
-		return false
-	}
-	if dstURL == "" {
-		r.logf("not reusing git dir because dstURL is empty")
-		return true
+// mainRepoURL returns the URL the main repo is cloned from:
+// -watcher.repo, or the go repo under -watcher.gerritbase.
+func mainRepoURL() string {
+	if *repoURL != "" {
+		return *repoURL
 	}
+	return *gerritBase + "go"
+}
 
-	// Does the "dest" remote match? If not, we return false and nuke
-	// the world and re-clone out of laziness.
-	cmd := exec.Command("git", "remote", "-v")
-	cmd.Dir = r.root
-	out, err := cmd.Output()
-	if err != nil {
-		log.Printf("git remote -v: %v", err)
+// registerWatcher tells the dashboard, via its watcher-register
+// endpoint, the names of the repos this watcher reports on: the main
+// repo, if watchMain is set, and the subrepos with the given import
+// paths. This lets the dashboard detect repos no watcher is
+// responsible for.
+func registerWatcher(watchMain bool, subrepos []string) error {
+	if !*report || !*network {
+		return nil
 	}
-	foundWrong := false
-	for _, ln := range strings.Split(string(out), "\n") {
-		if !strings.HasPrefix(ln, "dest") {
-			continue
-		}
-		f := strings.Fields(ln)
-		if len(f) < 2 {
-			continue
-		}
-		if f[0] == "dest" {
-			if f[1] == dstURL {
-				return true
-			}
-			if !foundWrong {
-				foundWrong = true
-				r.logf("found dest of %q, which doesn't equal sought %q", f[1], dstURL)
-			}
-		}
+	var repos []string
+	if watchMain {
+		repos = append(repos, "go")
 	}
-	r.logf("not reusing old repo: remote \"dest\" URL doesn't match")
-	return false
-}
-
-func (r *Repo) addRemote(name, url string) error {
-	gitConfig := filepath.Join(r.root, "config")
-	f, err := os.OpenFile(gitConfig, os.O_WRONLY|os.O_APPEND, os.ModePerm)
-	if err != nil {
-		return err
+	for _, path := range subrepos {
+		repos = append(repos, subrepoName(path))
 	}
-	_, err = fmt.Fprintf(f, "\n[remote %q]\n\turl = %v\n", name, url)
+	host, _ := os.Hostname()
+	b, err := json.Marshal(struct {
+		Host  string   // hostname of the watcher, for the dashboard's information
+		Repos []string // repo names, e.g. "go" and "net"
+	}{host, repos})
 	if err != nil {
-		f.Close()
 		return err
 	}
-	return f.Close()
+	return dashRequest("POST", "watcher-register", b)
 }
 
-// Watch continuously runs "git fetch" in the repo, checks for
-// new commits, posts any new commits to the dashboard (if enabled),
-// and mirrors commits to a destination repo (if enabled).
-// It only returns a non-nil error.
-func (r *Repo) Watch() error {
-	tickler := repoTickler(r.name())
-	for {
-		if err := r.fetch(); err != nil {
-			return err
-		}
-		if r.mirror {
-			if err := r.push(); err != nil {
-				return err
-			}
-		}
-		if r.dash {
-			if err := r.updateDashboard(); err != nil {
-				return err
-			}
-		}
+// watcherBuildInfo describes the running watcher binary.
+type watcherBuildInfo struct {
+	WatcherVersion int    // protocol version sent to the dashboard
+	Version        string // coordinator version, set by the linker
+	Revision       string // VCS revision the binary was built from, if known
+	GoVersion      string
 
-		r.setStatus("waiting")
-		// We still run a timer but a very slow one, just
-		// in case the mechanism updating the repo tickler
-		// breaks for some reason.
-		timer := time.NewTimer(5 * time.Minute)
-		select {
-		case <-tickler:
-			r.setStatus("got update tickle")
-			timer.Stop()
-		case <-timer.C:
-			r.setStatus("poll timer fired")
+	StartTime time.Time
+	Uptime    string // rounded to the second
+	Restarts  *int   `json:",omitempty"` // previous starts on this git cache dir, if -watcher.pushstate is set
+}
+
+var (
+	// watcherNow returns the current time, for reporting uptime.
+	// It is a variable for testing.
+	watcherNow = time.Now
+
+	// watcherRestarts, if non-nil, is the number of times the
+	// watcher had previously started; see recordWatcherStart.
+	watcherRestarts *int
+)
+
+// recordWatcherStart increments the start count kept in a state file
+// in dir and returns the number of previous starts.
+func recordWatcherStart(dir string) (int, error) {
+	file := filepath.Join(dir, "watcher-starts")
+	n := 0
+	if b, err := ioutil.ReadFile(file); err == nil {
+		if n, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+			return 0, fmt.Errorf("parsing %s: %v", file, err)
 		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(n+1)+"\n"), 0644); err != nil {
+		return 0, err
 	}
+	return n, os.Rename(tmp, file)
 }
 
-func (r *Repo) updateDashboard() (err error) {
-	r.setStatus("updating dashboard")
-	defer func() {
-		if err == nil {
-			r.setStatus("updated dashboard")
+func getWatcherBuildInfo() watcherBuildInfo {
+	bi := watcherBuildInfo{
+		WatcherVersion: watcherVersion,
+		Version:        Version,
+		GoVersion:      runtime.Version(),
+		StartTime:      processStartTime,
+		Uptime:         watcherNow().Sub(processStartTime).Round(time.Second).String(),
+		Restarts:       watcherRestarts,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				bi.Revision = s.Value
+			}
 		}
-	}()
-	if err := r.update(true); err != nil {
-		return err
 	}
-	remotes, err := r.remotes()
+	return bi
+}
+
+// handleWatcherVersion serves /debug/watcher/version, reporting
+// which watcher build is running as JSON.
+func handleWatcherVersion(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	b, err := json.MarshalIndent(getWatcherBuildInfo(), "", "\t")
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	for _, name := range remotes {
-		b, ok := r.branches[name]
-		if !ok {
-			// skip branch; must be already merged
-			continue
+	w.Write(b)
+}
+
+// mirrorTemplates are the parsed -watcher.mirror.template templates.
+var mirrorTemplates []*template.Template
+
+// parseMirrorTemplates parses the -watcher.mirror.template flag value,
+// checking that each template renders a plausible git URL.
+func parseMirrorTemplates(s string) ([]*template.Template, error) {
+	var tmpls []*template.Template
+	for _, f := range strings.Fields(s) {
+		t, err := template.New("mirror").Option("missingkey=error").Parse(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad -watcher.mirror.template %q: %v", f, err)
 		}
-		if err := r.postNewCommits(b); err != nil {
-			return err
+		if _, err := renderMirrorURL(t, "example"); err != nil {
+			return nil, fmt.Errorf("bad -watcher.mirror.template %q: %v", f, err)
 		}
+		tmpls = append(tmpls, t)
 	}
-	return nil
+	return tmpls, nil
 }
 
-func (r *Repo) name() string {
-	if r.path == "" {
-		return "go"
+// mirrorURLs returns the git URLs the named repo is mirrored to,
+// one per -watcher.mirror.template template.
+func mirrorURLs(name string) ([]string, error) {
+	var urls []string
+	for _, t := range mirrorTemplates {
+		u, err := renderMirrorURL(t, name)
+		if err != nil {
+			return nil, fmt.Errorf("mirror URL for %s: %v", name, err)
+		}
+		urls = append(urls, u)
 	}
-	return path.Base(r.path)
+	return urls, nil
 }
 
-func (r *Repo) logf(format string, args ...interface{}) {
-	log.Printf(r.name()+": "+format, args...)
+// renderMirrorURL renders the mirror URL template t for the named repo.
+func renderMirrorURL(t *template.Template, name string) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, struct{ Name string }{name}); err != nil {
+		return "", err
+	}
+	u := buf.String()
+	if !isPlausibleGitURL(u) {
+		return "", fmt.Errorf("%q is not a git URL", u)
+	}
+	return u, nil
 }
 
-// postNewCommits looks for unseen commits on the specified branch and
-// posts them to the dashboard.
-func (r *Repo) postNewCommits(b *Branch) error {
-	if b.Head == b.LastSeen {
-		return nil
+// isPlausibleGitURL reports whether s looks like a git remote URL:
+// either a URL with a scheme git supports and a host, such as
+// https://host/path, or the scp-like form user@host:path.
+func isPlausibleGitURL(s string) bool {
+	if s == "" || strings.ContainsAny(s, " \t\n") || strings.HasPrefix(s, "-") {
+		return false
 	}
-	c := b.LastSeen
-	if c == nil {
-		// Haven't seen anything on this branch yet:
-		if b.Name == master {
-			// For the master branch, bootstrap by creating a dummy
-			// commit with a lone child that is the initial commit.
-			c = &Commit{}
-			for _, c2 := range r.commits {
-				if c2.Parent == "" {
-					c.children = []*Commit{c2}
-					break
-				}
-			}
-			if c.children == nil {
-				return fmt.Errorf("couldn't find initial commit")
-			}
-		} else {
-			// Find the commit that this branch forked from.
-			base, err := r.mergeBase("heads/"+b.Name, master)
-			if err != nil {
-				return err
-			}
-			var ok bool
-			c, ok = r.commits[base]
-			if !ok {
-				return fmt.Errorf("couldn't find base commit: %v", base)
-			}
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil || u.Path == "" {
+			return false
 		}
+		switch u.Scheme {
+		case "https", "http", "ssh", "git":
+			return u.Host != ""
+		case "file":
+			return true
+		}
+		return false
 	}
-	if err := r.postChildren(b, c); err != nil {
-		return err
-	}
-	b.LastSeen = b.Head
-	return nil
+	// scp-like syntax: [user@]host:path, with no slash before the colon.
+	i := strings.Index(s, ":")
+	return i > 0 && i < len(s)-1 && !strings.Contains(s[:i], "/")
 }
 
-// postChildren posts to the dashboard all descendants of the given parent.
-// It ignores descendants that are not on the given branch.
-func (r *Repo) postChildren(b *Branch, parent *Commit) error {
-	for _, c := range parent.children {
-		if c.Branch != b.Name {
-			continue
-		}
-		if err := r.postCommit(c); err != nil {
-			if strings.Contains(err.Error(), "this package already has a first commit; aborting") {
-				return nil
-			}
-			return err
+// defaultMirrorRepos is the default value of -watcher.mirror.repos.
+const defaultMirrorRepos = "arch,benchmarks,blog,build,crypto,debug,example,exp,gddo,go,gofrontend,image,mobile,net,oauth2,playground,proposal,review,sync,sys,talks,term,text,time,tools,tour"
+
+// A mirrorConfig says which repos are mirrored to Github.
+type mirrorConfig struct {
+	repos map[string]bool // names of repos to mirror
+	probe bool            // whether to probe the -watcher.subrepoprefix page of other repos
+}
+
+var (
+	mirrorCfg *mirrorConfig // set by runWatcher from the -watcher.mirror.* flags
+
+	// mirrorProbeURL, if non-empty, is the URL prefix of the pages
+	// probed for unlisted repos, in place of https:// followed by
+	// -watcher.subrepoprefix. It is set for testing.
+	mirrorProbeURL = ""
+)
+
+// loadMirrorConfig returns the mirrorConfig described by the
+// -watcher.mirror.repos list, -watcher.mirror.reposFile file and
+// -watcher.mirror.probe flag values. If no repos are listed at all,
+// every repo is probed.
+func loadMirrorConfig(list, file string, probe bool) (*mirrorConfig, error) {
+	mc := &mirrorConfig{repos: map[string]bool{}, probe: probe}
+	names := splitList(list)
+	if file != "" {
+		more, err := readListFile(file)
+		if err != nil {
+			return nil, err
 		}
+		names = append(names, more...)
 	}
-	for _, c := range parent.children {
-		if err := r.postChildren(b, c); err != nil {
-			return err
-		}
+	for _, name := range names {
+		mc.repos[name] = true
 	}
-	return nil
+	if len(mc.repos) == 0 {
+		mc.probe = true
+	}
+	return mc, nil
 }
 
-// postCommit sends a commit to the build dashboard.
-func (r *Repo) postCommit(c *Commit) error {
-	if !*report {
-		r.logf("dry-run mode; NOT posting commit to dashboard: %v", c)
-		return nil
+// shouldMirror reports whether the named repo should be mirrored from
+// Gerrit to Github.
+func shouldMirror(name string) bool {
+	if mirrorCfg.repos[name] {
+		return true
 	}
-	r.logf("sending commit to dashboard: %v", c)
-
-	t, err := time.Parse("Mon, 2 Jan 2006 15:04:05 -0700", c.Date)
+	if !mirrorCfg.probe {
+		return false
+	}
+	// Else, see if it appears to be a subrepo:
+	probe := mirrorProbeURL
+	if probe == "" {
+		probe = "https://" + *subrepoBase
+	}
+	r, err := watcherClient.Get(probe + name)
 	if err != nil {
-		return fmt.Errorf("postCommit: parsing date %q for commit %v: %v", c.Date, c, err)
+		watcherLogf("repo %v doesn't seem to exist: %v", name, err)
+		return false
 	}
-	dc := struct {
-		PackagePath string // (empty for main repo commits)
-		Hash        string
-		ParentHash  string
+	r.Body.Close()
+	return r.StatusCode/100 == 2
+}
 
-		User   string
-		Desc   string
-		Time   time.Time
-		Branch string
+// A semaphore limits the number of concurrent operations.
+// A nil semaphore imposes no limit.
+type semaphore chan struct{}
 
-		NeedsBenchmarking bool
-	}{
-		PackagePath: r.path,
-		Hash:        c.Hash,
-		ParentHash:  c.Parent,
+// newSemaphore returns a semaphore admitting n concurrent holders,
+// or nil (no limit) if n is not positive.
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
 
-		User:   c.Author,
-		Desc:   c.Desc,
-		Time:   t,
-		Branch: c.Branch,
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
 
-		NeedsBenchmarking: c.NeedsBenchmarking(),
+// tryAcquire acquires the semaphore if it can do so without
+// blocking, and reports whether it did.
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
 	}
-	b, err := json.Marshal(dc)
-	if err != nil {
-		return fmt.Errorf("postCommit: marshaling request body: %v", err)
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
 	}
+}
 
-	if !*network {
-		if c.Parent != "" {
-			if !networkSeen[c.Parent] {
-				r.logf("%v: %v", c.Parent, r.commits[c.Parent])
-				return fmt.Errorf("postCommit: no parent %v found on dashboard for %v", c.Parent, c)
-			}
-		}
-		if networkSeen[c.Hash] {
-			return fmt.Errorf("postCommit: already seen %v", c)
-		}
-		networkSeen[c.Hash] = true
-		return nil
+func (s semaphore) release() {
+	if s != nil {
+		<-s
 	}
+}
 
-	v := url.Values{"version": {fmt.Sprint(watcherVersion)}, "key": {dashboardKey}}
-	u := *dashFlag + "commit?" + v.Encode()
-	resp, err := http.Post(u, "text/json", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return fmt.Errorf("postCommit: reading body: %v", err)
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("postCommit: status: %v\nbody: %s", resp.Status, body)
+// a statusEntry is a status string at a specific time.
+type statusEntry struct {
+	status string
+	t      time.Time
+}
+
+// statusRing is a ring buffer of timestamped status messages.
+type statusRing struct {
+	mu    sync.Mutex    // guards rest
+	head  int           // next position to fill
+	total int           // number of entries ever added
+	ent   []statusEntry // ring buffer of entries
+}
+
+// newStatusRing returns a statusRing that keeps the last n entries.
+func newStatusRing(n int) *statusRing {
+	if n < 1 {
+		n = 1
 	}
+	return &statusRing{ent: make([]statusEntry, n)}
+}
 
-	var s struct {
-		Error string
+func (r *statusRing) add(status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ent[r.head] = statusEntry{status, time.Now()}
+	r.total++
+	r.head++
+	if r.head == len(r.ent) {
+		r.head = 0
 	}
-	if err := json.Unmarshal(body, &s); err != nil {
-		return fmt.Errorf("postCommit: decoding response: %v", err)
+}
+
+// latest returns the most recently added entry, if any.
+func (r *statusRing) latest() (ent statusEntry, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.total == 0 {
+		return statusEntry{}, false
 	}
-	if s.Error != "" {
-		return fmt.Errorf("postCommit: error: %v", s.Error)
+	i := r.head - 1
+	if i < 0 {
+		i = len(r.ent) - 1
 	}
-	return nil
+	return r.ent[i], true
 }
 
-// update looks for new commits and branches,
-// and updates the commits and branches maps.
-func (r *Repo) update(noisy bool) error {
-	remotes, err := r.remotes()
-	if err != nil {
-		return err
+// count returns the number of entries held, and the number
+// ever added.
+func (r *statusRing) count() (held, total int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	held = r.total
+	if held > len(r.ent) {
+		held = len(r.ent)
 	}
-	for _, name := range remotes {
-		b := r.branches[name]
+	return held, r.total
+}
 
-		// Find all unseen commits on this branch.
-		revspec := "heads/" + name
-		if b != nil {
-			// If we know about this branch,
-			// only log commits down to the known head.
-			revspec = b.Head.Hash + ".." + revspec
-		}
-		log, err := r.log("--topo-order", revspec)
-		if err != nil {
-			return err
-		}
-		if len(log) == 0 {
-			// No commits to handle; carry on.
-			continue
+// foreachDesc calls fn for each entry held, newest first.
+func (r *statusRing) foreachDesc(fn func(statusEntry)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.head
+	for k := 0; k < len(r.ent) && k < r.total; k++ {
+		i--
+		if i < 0 {
+			i = len(r.ent) - 1
 		}
+		fn(r.ent[i])
+	}
+}
 
-		var nDups, nDrops int
+// Repo represents a repository to be watched.
+type Repo struct {
+	root     string             // on-disk location of the git repo
+	path     string             // base import path for repo (blank for main repo)
+	commits  map[string]*Commit // keyed by full commit hash (40 lowercase hex digits)
+	branches map[string]*Branch // keyed by branch name, eg "release-branch.go1.3" (or empty for default)
+	dash     bool               // push new commits to the dashboard
+	dests    []mirrorDest       // remotes to push new commits to; empty if not mirroring
+	bundle   string             // if non-empty, the git bundle file the repo is cloned and fetched from
+	srcURL   string             // what the repo is cloned and fetched from
+	depth    int                // if positive, the depth of the repo's shallow clone; see -watcher.shallow
+	cacheDir string             // the git cache dir root is in
+	dashPath string             // if non-empty, overrides path when talking to the dashboard
+	nameOpt  string             // if non-empty, overrides the name derived from path
+	bench    *benchConfig       // which commits need benchmarking
+	local    bool               // root is an existing git dir, used as is; see repoOptions.gitDir
+	status   *statusRing
+
+	// dashClient, if non-nil, is used in place of the dashboard at
+	// -watcher.dash, whatever -watcher.network and -watcher.report
+	// say. See repoOptions.dash.
+	dashClient dashboardClient
+
+	// work carries functions for Watch to run on the goroutine
+	// watching the repo, which alone may touch its commit graph,
+	// while it waits between fetches. See do.
+	work chan func()
+
+	// defaultBranch is the name of the repo's default branch,
+	// e.g. "master" or "main". See findDefaultBranch.
+	defaultBranch string
+
+	// deletedBranches are the names of branches known to the
+	// dashboard that update found deleted upstream, and that
+	// have not yet been reported to the dashboard.
+	deletedBranches []string
+
+	// orphans holds the commits found by update whose parent
+	// isn't known, keyed by hash. See -watcher.allowOrphans.
+	orphans map[string]*Commit
+
+	// roots holds the commits found by update that have no parent:
+	// the initial commit, and those of any unrelated histories
+	// merged in. See initialCommit.
+	roots []*Commit
+
+	mu   sync.Mutex   // guards snap and lastSuccessfulFetch
+	snap repoSnapshot // for status pages; updated by recordSnapshot
+
+	// lastSuccessfulFetch is when the initial clone or a
+	// fetch last succeeded. See handleHealthz.
+	lastSuccessfulFetch time.Time
+
+	postLag  durationSamples // time from commit to posting it to the dashboard
+	fetchLag durationSamples // duration of successful fetches, including retries
+
+	lastHeartbeat time.Time // when maybeHeartbeat last posted a heartbeat
+	reclones      int       // times Watch has re-cloned a corrupt root; see recoverCorrupt
+	noSeenBatch   bool      // the dashboard doesn't support dashSeenBatch
+	noPostBatch   bool      // the dashboard doesn't support dashPostBatch
+
+	// cutoffs holds the hashes of commits that postNewCommits
+	// skipped posting due to -watcher.bootstrapDepth. Their
+	// children are posted to the dashboard as if parentless.
+	cutoffs map[string]bool
+
+	// authors holds the author and date of each commit within
+	// maxAuthorsWindow, newest first, and newAuthors those of
+	// commits added since; see recentAuthors.
+	authors    []commitAuthor
+	newAuthors []commitAuthor
+
+	wtMu      sync.Mutex // guards the worktree's contents, wtRev and wtArchive
+	wtRev     string     // commit checked out in the worktree, if any; see -watcher.worktree
+	wtArchive []byte     // tgz archive of the worktree at wtRev, once built
+}
+
+// durationSamples records the most recent durations of some
+// operation, to report their distribution.
+type durationSamples struct {
+	mu    sync.Mutex
+	n     int                // total number of samples added
+	ring  [256]time.Duration // most recent samples
+	total time.Duration      // sum of all samples
+}
+
+func (s *durationSamples) add(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ring[s.n%len(s.ring)] = d
+	s.n++
+	s.total += d
+}
+
+// count returns the total number of samples added.
+func (s *durationSamples) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// sum returns the sum of all samples added.
+func (s *durationSamples) sum() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// percentile returns the pth percentile (0 < p <= 100) of the
+// recent samples, or zero if there are none.
+func (s *durationSamples) percentile(p float64) time.Duration {
+	s.mu.Lock()
+	n := s.n
+	if n > len(s.ring) {
+		n = len(s.ring)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, s.ring[:n])
+	s.mu.Unlock()
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Nearest-rank method.
+	i := int(math.Ceil(p/100*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// String summarizes the distribution of the recent samples.
+func (s *durationSamples) String() string {
+	if s.count() == 0 {
+		return "no samples"
+	}
+	round := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+	return fmt.Sprintf("p50 %v, p95 %v, p99 %v (%d samples)",
+		round(s.percentile(50)), round(s.percentile(95)), round(s.percentile(99)), s.count())
+}
+
+// repoSnapshot is a point-in-time summary of a Repo's commit graph,
+// safe to read from HTTP handlers while the Repo is being watched.
+type repoSnapshot struct {
+	Commits  int // number of known commits
+	Orphans  int // number of commits with unknown parents
+	Branches []branchHead
+
+	// Authors holds the author and date of each known commit
+	// within maxAuthorsWindow of the time of the snapshot,
+	// newest first.
+	Authors []commitAuthor
+}
+
+// commitAuthor is the author and date of a commit.
+type commitAuthor struct {
+	Email string
+	Time  time.Time
+}
+
+// branchHead summarizes a Branch.
+type branchHead struct {
+	Name     string
+	Head     string // hash of head commit
+	LastSeen string // hash of last commit posted to the dashboard, if any
+
+	// Commits holds the branch's commits from its head back to
+	// LastSeen (inclusive), or at most maxBranchCommits of them,
+	// in which case Truncated is set. See serveBranch.
+	Commits   []branchCommit
+	Truncated bool
+}
+
+// maxBranchCommits is the most commits of each branch kept in
+// a repoSnapshot.
+const maxBranchCommits = 100
+
+// branchCommit is the JSON form of a commit served by serveBranch.
+type branchCommit struct {
+	Hash   string `json:"hash"`
+	Parent string `json:"parent"`
+	Author string `json:"author"`
+	Desc   string `json:"desc"`
+	Branch string `json:"branch"`
+	Posted bool   `json:"posted"` // LastSeen or earlier
+}
+
+// recordSnapshot updates r.snap from the commit graph.
+// It must be called from the goroutine watching the repo.
+func (r *Repo) recordSnapshot() {
+	snap := repoSnapshot{
+		Commits: len(r.commits),
+		Orphans: len(r.orphans),
+	}
+	for _, b := range r.branches {
+		bh := branchHead{Name: b.Name, Head: b.Head.Hash}
+		if b.LastSeen != nil {
+			bh.LastSeen = b.LastSeen.Hash
+		}
+		for c := b.Head; c != nil; c = c.parent {
+			if len(bh.Commits) == maxBranchCommits {
+				bh.Truncated = true
+				break
+			}
+			bh.Commits = append(bh.Commits, branchCommit{
+				Hash:   c.Hash,
+				Parent: c.Parent,
+				Author: c.Author,
+				Desc:   c.Desc,
+				Branch: c.Branch,
+				Posted: c == b.LastSeen,
+			})
+			if c == b.LastSeen {
+				break
+			}
+		}
+		snap.Branches = append(snap.Branches, bh)
+	}
+	sort.Slice(snap.Branches, func(i, j int) bool {
+		bi, bj := snap.Branches[i], snap.Branches[j]
+		if (bi.Name == r.defaultBranch) != (bj.Name == r.defaultBranch) {
+			return bi.Name == r.defaultBranch
+		}
+		return bi.Name < bj.Name
+	})
+	snap.Authors = r.recentAuthors()
+	r.mu.Lock()
+	r.snap = snap
+	r.mu.Unlock()
+}
+
+// addAuthor notes the author of c, newly added to r.commits, for
+// the next recordSnapshot, if c is within maxAuthorsWindow.
+func (r *Repo) addAuthor(c *Commit) {
+	t, err := parseCommitDate(c.Date)
+	if err != nil || watcherNow().Sub(t) > maxAuthorsWindow {
+		return
+	}
+	r.newAuthors = append(r.newAuthors, commitAuthor{Email: c.authorEmail(), Time: t})
+}
+
+// recentAuthors merges the authors noted by addAuthor into
+// r.authors, drops those no longer within maxAuthorsWindow, and
+// returns the result. Only the new authors are sorted, so the cost
+// is in proportion to the commits in the window, not to all of
+// r.commits. The slices returned are never modified.
+func (r *Repo) recentAuthors() []commitAuthor {
+	if len(r.newAuthors) > 0 {
+		b := r.newAuthors
+		sort.Slice(b, func(i, j int) bool { return b[i].Time.After(b[j].Time) })
+		a := r.authors
+		merged := make([]commitAuthor, 0, len(a)+len(b))
+		for len(a) > 0 && len(b) > 0 {
+			if b[0].Time.After(a[0].Time) {
+				merged, b = append(merged, b[0]), b[1:]
+			} else {
+				merged, a = append(merged, a[0]), a[1:]
+			}
+		}
+		merged = append(append(merged, a...), b...)
+		r.authors, r.newAuthors = merged, nil
+	}
+	cutoff := watcherNow().Add(-maxAuthorsWindow)
+	n := sort.Search(len(r.authors), func(i int) bool { return r.authors[i].Time.Before(cutoff) })
+	r.authors = r.authors[:n]
+	return r.authors
+}
+
+// resetCommits forgets r's commit graph, to be rebuilt by update.
+func (r *Repo) resetCommits() {
+	r.commits = make(map[string]*Commit)
+	r.branches = make(map[string]*Branch)
+	r.orphans = nil
+	r.roots = nil
+	r.authors, r.newAuthors = nil, nil
+}
+
+// snapshot returns the most recently recorded repoSnapshot.
+func (r *Repo) snapshot() repoSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.snap
+}
+
+var (
+	watchedMu    sync.Mutex
+	watchedRepos = make(map[string]*Repo) // keyed by name
+	repoRoutes   = make(map[string]*Repo) // keyed by HTTP route; see handleRepo
+)
+
+// registerRepo adds r to the set of watched repos.
+func registerRepo(r *Repo) {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	watchedRepos[r.name()] = r
+}
+
+// unregisterRepo removes r, whose watch has stopped, from the set
+// of watched repos, and stops serving its HTTP routes.
+func unregisterRepo(r *Repo) {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	if watchedRepos[r.name()] == r {
+		delete(watchedRepos, r.name())
+	}
+	for pattern, rr := range repoRoutes {
+		if rr == r {
+			repoRoutes[pattern] = nil
+		}
+	}
+}
+
+// handleRepo serves the HTTP route pattern with serve, called with
+// r. Unlike with http.Handle, a route can be registered again, by
+// a new Repo for a repo whose watch was stopped and restarted;
+// requests are then served with the new Repo. Requests for a route
+// whose repo has been unregistered get a 404.
+func handleRepo(pattern string, r *Repo, serve func(*Repo, http.ResponseWriter, *http.Request)) {
+	watchedMu.Lock()
+	_, ok := repoRoutes[pattern]
+	repoRoutes[pattern] = r
+	watchedMu.Unlock()
+	if ok {
+		return
+	}
+	http.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+		watchedMu.Lock()
+		r := repoRoutes[pattern]
+		watchedMu.Unlock()
+		if r == nil {
+			http.NotFound(w, req)
+			return
+		}
+		serve(r, w, req)
+	})
+}
+
+// fetched records that r was just fetched (or cloned) successfully.
+func (r *Repo) fetched() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSuccessfulFetch = watcherNow()
+}
+
+// healthzStaleFactor is how many of a repo's poll intervals (see
+// pollWait) can pass without a successful fetch before handleHealthz
+// reports the repo stale.
+const healthzStaleFactor = 3
+
+// requireToken returns a handler that serves requests with h if
+// they carry token as a bearer token in their Authorization header,
+// and otherwise responds 401 Unauthorized. Requests to /healthz, for
+// health checkers that can't send the token, are always served.
+func requireToken(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="watcher"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// handleHealthz serves /healthz, which reports whether every watched
+// repo has been fetched successfully recently enough. If any hasn't,
+// presumably because its Watch loop is stuck or failing, it responds
+// with 503 Service Unavailable and lists the stale repos.
+func handleHealthz(w http.ResponseWriter, req *http.Request) {
+	now := watcherNow()
+	var stale []string
+	for _, r := range allRepos() {
+		r.mu.Lock()
+		last := r.lastSuccessfulFetch
+		r.mu.Unlock()
+		max := healthzStaleFactor * r.pollWait()
+		if last.IsZero() {
+			// Still cloning; allow it as long since startup.
+			if now.Sub(processStartTime) > max {
+				stale = append(stale, fmt.Sprintf("%s: no successful fetch in %v since startup (want within %v)", r.name(), now.Sub(processStartTime).Round(time.Second), max))
+			}
+			continue
+		}
+		if d := now.Sub(last); d > max {
+			stale = append(stale, fmt.Sprintf("%s: last successful fetch %v ago (want within %v)", r.name(), d.Round(time.Second), max))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(stale) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%d stale repos:\n%s\n", len(stale), strings.Join(stale, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// allRepos returns the watched repos, sorted by name.
+func allRepos() []*Repo {
+	watchedMu.Lock()
+	defer watchedMu.Unlock()
+	var rs []*Repo
+	for _, r := range watchedRepos {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].name() < rs[j].name() })
+	return rs
+}
+
+// handleWatcherAll serves /debug/watcher/all, a summary of
+// the status of every watched repo.
+func handleWatcherAll(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, "<html><head><title>watcher: all repos</title><body><h1>watcher status for all repos</h1>\n")
+	nowRound := watcherNow().Round(time.Second)
+	for _, r := range allRepos() {
+		name := html.EscapeString(r.name())
+		fmt.Fprintf(w, "<h2><a href='/debug/watcher/%s'>%s</a></h2>\n<pre>\n", name, name)
+		if ent, ok := r.status.latest(); ok {
+			fmt.Fprintf(w, "status:   %s (%v ago)\n", html.EscapeString(ent.status), nowRound.Sub(ent.t.Round(time.Second)))
+		}
+		snap := r.snapshot()
+		fmt.Fprintf(w, "commits:  %d\n", snap.Commits)
+		if snap.Orphans > 0 {
+			fmt.Fprintf(w, "orphans:  %d\n", snap.Orphans)
+		}
+		for _, b := range snap.Branches {
+			fmt.Fprintf(w, "branch:   %-30s head %s last seen %s\n", html.EscapeString(b.Name), b.Head, b.LastSeen)
+		}
+		fmt.Fprintf(w, "</pre>\n")
+	}
+}
+
+// handleWatcherIndex serves /debug/watcher/, an index of the
+// watched repos: links to their status pages, with their branch
+// heads, mirror destinations and last successful fetch.
+func handleWatcherIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/debug/watcher/" {
+		// Not a watched repo's route either.
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, "<html><head><title>watcher</title><body><h1>watched repos</h1>\n")
+	fmt.Fprintf(w, "<p>See also <a href='/debug/watcher/all'>the status of all repos</a>, <a href='/debug/watcher/version'>version</a>, <a href='/metrics'>metrics</a>.</p>\n")
+	fmt.Fprintf(w, "<table border=1 cellpadding=4>\n<tr><th>repo</th><th>branches (head / last seen)</th><th>mirrored to</th><th>last successful fetch</th></tr>\n")
+	now := watcherNow()
+	for _, r := range allRepos() {
+		name := html.EscapeString(r.name())
+		fmt.Fprintf(w, "<tr><td><a href='/debug/watcher/%s'>%s</a></td><td>", name, name)
+		for _, b := range r.snapshot().Branches {
+			last := b.LastSeen
+			if last == "" {
+				last = "-"
+			}
+			fmt.Fprintf(w, "<a href='/debug/watcher/%s/branch/%s'>%s</a>: %s / %s<br>\n", name, html.EscapeString(b.Name), html.EscapeString(b.Name), b.Head, last)
+		}
+		fmt.Fprintf(w, "</td><td>")
+		for _, d := range r.dests {
+			fmt.Fprintf(w, "%s<br>\n", html.EscapeString(d.url))
+		}
+		r.mu.Lock()
+		fetched := r.lastSuccessfulFetch
+		r.mu.Unlock()
+		if fetched.IsZero() {
+			fmt.Fprintf(w, "</td><td>never</td></tr>\n")
+		} else {
+			fmt.Fprintf(w, "</td><td>%s (%v ago)</td></tr>\n", fetched.UTC().Format(time.RFC3339), now.Sub(fetched).Round(time.Second))
+		}
+	}
+	fmt.Fprintf(w, "</table>\n")
+}
+
+// repoOptions holds optional settings for NewRepo.
+type repoOptions struct {
+	// dashPath, if non-empty, is the package path reported to
+	// the dashboard for the repo's commits, instead of the
+	// repo's import path.
+	dashPath string
+
+	// name, if non-empty, is the repo's name, used in its HTTP
+	// routes, log messages and git directory, instead of the
+	// last element of its import path.
+	name string
+
+	// gitDir, if non-empty, is an existing git directory, such as a
+	// test fixture, to use as the repo's root as is: NewRepo doesn't
+	// fetch or clone it, nor push it to any mirror destinations.
+	gitDir string
+
+	// dash, if non-nil, is the dashboard the repo's commits are
+	// posted to and looked up in, in place of -watcher.dash.
+	dash dashboardClient
+}
+
+// repoRoot returns the git directory inside dir that NewRepo
+// uses for the repo with the given import path.
+func repoRoot(dir, importPath string) string {
+	if importPath == "" {
+		return filepath.Join(dir, "go")
+	}
+	return filepath.Join(dir, path.Base(importPath))
+}
+
+// checkRepoRoots returns an error listing any repos, identified by
+// import path ("" for the main Go repo), whose git directories inside
+// dir would be the same, and so clobber each other.
+func checkRepoRoots(dir string, importPaths []string) error {
+	byRoot := make(map[string][]string)
+	var roots []string
+	for _, p := range importPaths {
+		root := repoRoot(dir, p)
+		if byRoot[root] == nil {
+			roots = append(roots, root)
+		}
+		if p == "" {
+			p = "go"
+		}
+		byRoot[root] = append(byRoot[root], p)
+	}
+	var conflicts []string
+	for _, root := range roots {
+		if ps := byRoot[root]; len(ps) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s)", root, strings.Join(ps, ", ")))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("repos share git directories: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// NewRepo checks out a new instance of the Mercurial repository
+// specified by srcURL to a new directory inside dir.
+// Changes from the source repository will be mirrored to each of
+// the destination repositories in dstURLs, if any.
+// The importPath argument is the base import path of the repository,
+// and should be empty for the main Go repo.
+// The dash argument should be set true if commits to this
+// repo should be reported to the build dashboard.
+// The opt argument holds less commonly used settings; its
+// zero value provides the defaults.
+func NewRepo(dir, srcURL string, dstURLs []string, importPath string, dash bool, opt repoOptions) (*Repo, error) {
+	root := repoRoot(dir, importPath)
+	if opt.name != "" {
+		root = filepath.Join(dir, opt.name)
+	}
+	if opt.gitDir != "" {
+		root = opt.gitDir
+	}
+	r := &Repo{
+		path:     importPath,
+		root:     root,
+		commits:  make(map[string]*Commit),
+		branches: make(map[string]*Branch),
+		dests:    mirrorDests(dstURLs),
+		srcURL:   srcURL,
+		cacheDir: dir,
+		dash:     dash,
+		dashPath: opt.dashPath,
+		nameOpt:  opt.name,
+		status:   newStatusRing(*statusSize),
+		local:    opt.gitDir != "",
+
+		dashClient: opt.dash,
+		work:       make(chan func()),
+	}
+	if f, ok := bundleFile(srcURL); ok {
+		// git clones and fetches from a bundle file
+		// just as from a repo.
+		r.bundle, r.srcURL = f, f
+	}
+	if *shallow > 0 && importPath != "" && len(r.dests) == 0 && r.bundle == "" {
+		// Mirror destinations need the full history, and
+		// git can't make shallow clones of bundles.
+		r.depth = *shallow
+	}
+	r.bench = benchConfigs[r.name()]
+	if r.bench == nil && importPath == "" {
+		r.bench = defaultBenchConfig
+	}
+
+	registerRepo(r)
+	if serveArchives(r.name()) {
+		handleRepo("/"+r.name()+".tar.gz", r, (*Repo).ServeHTTP)
+	}
+	handleRepo("/debug/watcher/"+r.name(), r, (*Repo).ServeHTTP)
+	handleRepo("/debug/watcher/"+r.name()+"/authors", r, (*Repo).serveAuthors)
+	handleRepo("/debug/watcher/"+r.name()+"/branch/", r, (*Repo).ServeHTTP)
+	handleRepo("/debug/watcher/"+r.name()+"/repost", r, (*Repo).serveRepost)
+	handleRepo("/debug/watcher/"+r.name()+"/resync", r, (*Repo).serveResync)
+
+	needClone := !r.local
+	if needClone && r.shouldTryReuseGitDir() {
+		r.setStatus("reusing git dir; running git fetch")
+		cmd := exec.Command("git", fetchArgs()...)
+		cmd.Dir = r.root
+		r.logf("running git fetch")
+		t0 := time.Now()
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			r.logf("git fetch failed; proceeding to wipe + clone instead; err: %v, stderr: %s", err, stderr.Bytes())
+		} else {
+			needClone = false
+			r.logf("ran git fetch in %v", time.Since(t0))
+		}
+	}
+	if needClone {
+		if err := r.clone(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	r.fetched()
+	r.defaultBranch = r.findDefaultBranch()
+
+	if *useWorktree {
+		r.updateWorktree()
+	}
+
+	if len(r.dests) > 0 && !r.local {
+		if err := r.addRemotes(); err != nil {
+			return nil, err
+		}
+		r.logf("starting initial push to %v", dstURLs)
+		if err := r.push(); err != nil {
+			return nil, err
+		}
+		r.logf("did initial push to %v", dstURLs)
+	}
+
+	if r.dash {
+		r.logf("loading commit log")
+		if err := r.update(false); err != nil {
+			return nil, err
+		}
+		r.logf("found %v branches among %v commits\n", len(r.branches), len(r.commits))
+	}
+
+	return r, nil
+}
+
+// clone removes r.root and makes it a fresh mirror clone of r.srcURL,
+// trying up to -watcher.cloneAttempts times. It gives up if ctx is
+// done while it waits for disk space.
+func (r *Repo) clone(ctx context.Context) error {
+	t0 := time.Now()
+	n := 0
+	err := try(*cloneTries, *backoff, func() error {
+		n++
+		// Remove the cache root, or what's left of
+		// it by a failed attempt.
+		r.setStatus("need clone; removing cache root")
+		os.RemoveAll(r.root)
+		if err := r.waitForDiskSpace(ctx, r.cacheDir); err != nil {
+			return err
+		}
+		r.setStatus(fmt.Sprintf("running fresh git clone --mirror, attempt %d of %d", n, *cloneTries))
+		r.logf("cloning %v", r.srcURL)
+		args := []string{"clone", "--mirror"}
+		if r.depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(r.depth))
+		}
+		cmd := exec.Command("git", append(args, r.srcURL, r.root)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			r.logf("git clone attempt %d failed: %v\n%s", n, err, out)
+			return fmt.Errorf("cloning %s: %v\n\n%s", r.srcURL, err, out)
+		}
+		return nil
+	})
+	if err != nil {
+		r.setStatus("git clone failed")
+		os.RemoveAll(r.root)
+		return err
+	}
+	r.setStatus("cloned")
+	r.logf("cloned in %v", time.Since(t0))
+	return nil
+}
+
+// addRemotes adds a git remote for each of r.dests.
+func (r *Repo) addRemotes() error {
+	for _, d := range r.dests {
+		r.setStatus("adding " + d.remote + " remote")
+		if err := r.addRemote(d.remote, d.url); err != nil {
+			r.setStatus("failed to add " + d.remote)
+			return fmt.Errorf("adding remote: %v", err)
+		}
+		r.setStatus("added " + d.remote + " remote")
+	}
+	return nil
+}
+
+// maxReclones is the most times Watch re-clones a repo whose git
+// directory it finds corrupt, before giving up on the repo.
+const maxReclones = 3
+
+// corrupt reports whether r.root is missing or fails
+// git fsck's connectivity check.
+func (r *Repo) corrupt() bool {
+	cmd := exec.Command("git", "fsck", "--connectivity-only")
+	cmd.Dir = r.root
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.logf("git fsck --connectivity-only: %v\n%s", err, out)
+		return true
+	}
+	return false
+}
+
+// recoverCorrupt is called by Watch when a fetch fails with fetchErr.
+// If r.root is corrupt (say, after an interrupted write or a full disk),
+// it removes it and clones the repo afresh, returning nil if that worked.
+// Otherwise, or once r has been re-cloned maxReclones times, it returns
+// an error.
+func (r *Repo) recoverCorrupt(ctx context.Context, fetchErr error) error {
+	if !r.corrupt() {
+		return fetchErr
+	}
+	if r.reclones >= maxReclones {
+		r.setStatus("git dir corrupt; giving up")
+		return fmt.Errorf("%v\n(git dir %s still corrupt after %d re-clones)", fetchErr, r.root, maxReclones)
+	}
+	r.reclones++
+	r.logf("git dir %s is corrupt; re-cloning (%d of %d)", r.root, r.reclones, maxReclones)
+	r.setStatus(fmt.Sprintf("git dir corrupt; re-cloning (%d of %d)", r.reclones, maxReclones))
+	if err := r.clone(ctx); err != nil {
+		return err
+	}
+	if err := r.addRemotes(); err != nil {
+		return err
+	}
+	r.fetched()
+	return nil
+}
+
+// bundleFile returns the name of the git bundle file named by a
+// bundle://<file> source URL, and whether srcURL is such a URL.
+func bundleFile(srcURL string) (string, bool) {
+	if !strings.HasPrefix(srcURL, "bundle://") {
+		return "", false
+	}
+	return strings.TrimPrefix(srcURL, "bundle://"), true
+}
+
+// watcherDiskFree reports the free space in bytes on the filesystem
+// containing dir. It is a variable for testing.
+var watcherDiskFree = freeDiskSpace
+
+// diskRetryInterval is how often waitForDiskSpace re-checks
+// the free disk space.
+var diskRetryInterval = time.Minute
+
+// checkDiskSpace returns an error if the filesystem containing dir
+// has less free space than required by -watcher.minfreemb.
+func checkDiskSpace(dir string) error {
+	if *minFreeMB <= 0 {
+		return nil
+	}
+	free, err := watcherDiskFree(dir)
+	if err != nil {
+		// Don't block on platforms or filesystems where we can't tell.
+		return nil
+	}
+	if want := uint64(*minFreeMB) << 20; free < want {
+		return fmt.Errorf("insufficient disk space in %s: %d MB free, need %d MB", dir, free>>20, *minFreeMB)
+	}
+	return nil
+}
+
+// waitForDiskSpace blocks until the filesystem containing dir has
+// enough free space (see checkDiskSpace), rather than letting a git
+// clone or fetch fail on a full disk. It returns ctx's error if ctx
+// is done first.
+func (r *Repo) waitForDiskSpace(ctx context.Context, dir string) error {
+	for {
+		err := checkDiskSpace(dir)
+		if err == nil {
+			return nil
+		}
+		r.logf("%v; pausing", err)
+		r.setStatus(err.Error() + "; pausing")
+		t := time.NewTimer(diskRetryInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *Repo) setStatus(status string) {
+	r.status.add(status)
+}
+
+// shouldTryReuseGitDir reports whether we should try to reuse r.root as the git
+// directory. (The directory may be corrupt, though.)
+// Each of r.dests must already be configured with the right URL.
+func (r *Repo) shouldTryReuseGitDir() bool {
+	if _, err := os.Stat(filepath.Join(r.root, "FETCH_HEAD")); err != nil {
+		if os.IsNotExist(err) {
+			r.logf("not reusing git dir; no FETCH_HEAD at %s", r.root)
+		} else {
+			r.logf("not reusing git dir; %v", err)
+		}
+		return false
+	}
+	if len(r.dests) == 0 {
+		r.logf("reusing git dir; not mirroring")
+		return true
+	}
+
+	// Do the destination remotes match? If not, we return false and
+	// nuke the world and re-clone out of laziness.
+	cmd := exec.Command("git", "remote", "-v")
+	cmd.Dir = r.root
+	out, err := cmd.Output()
+	if err != nil {
+		watcherLogf("git remote -v: %v", err)
+	}
+	urls := map[string]string{} // remote name -> URL
+	for _, ln := range strings.Split(string(out), "\n") {
+		f := strings.Fields(ln)
+		if len(f) < 2 {
+			continue
+		}
+		urls[f[0]] = f[1]
+	}
+	for _, d := range r.dests {
+		if u, ok := urls[d.remote]; !ok || u != d.url {
+			if ok {
+				r.logf("found %s of %q, which doesn't equal sought %q", d.remote, u, d.url)
+			}
+			r.logf("not reusing old repo: remote %q URL doesn't match", d.remote)
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repo) addRemote(name, url string) error {
+	gitConfig := filepath.Join(r.root, "config")
+	f, err := os.OpenFile(gitConfig, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "\n[remote %q]\n\turl = %v\n", name, url)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Watch continuously runs "git fetch" in the repo, checks for
+// new commits, posts any new commits to the dashboard (if enabled),
+// and mirrors commits to a destination repo (if enabled).
+// It returns nil once ctx is done, but never in the middle of
+// a fetch, push and dashboard update cycle. Otherwise it only
+// returns a non-nil error.
+func (r *Repo) Watch(ctx context.Context) error {
+	tickler := repoTickler(r.gerritName())
+	for {
+		if ctx.Err() != nil {
+			r.setStatus("stopped")
+			return nil
+		}
+		if err := r.fetch(ctx); err != nil {
+			if ctx.Err() != nil {
+				// Stopped while waiting for disk space.
+				continue
+			}
+			if err := r.recoverCorrupt(ctx, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if *useWorktree {
+			r.updateWorktree()
+		}
+		if len(r.dests) > 0 {
+			if err := r.push(); err != nil {
+				return err
+			}
+		}
+		if r.dash {
+			if err := r.updateDashboard(); err != nil {
+				return err
+			}
+		}
+
+		if r.dash {
+			r.maybeHeartbeat()
+		}
+
+		r.setStatus("waiting")
+		// A new timer each time around; it's stopped below
+		// unless it fired, so none outlive their iteration.
+		timer := time.NewTimer(r.pollWait())
+	wait:
+		for {
+			select {
+			case fn := <-r.work:
+				fn()
+				continue wait
+			case <-tickler:
+				r.setStatus("got update tickle")
+				timer.Stop()
+			case <-timer.C:
+				r.setStatus("poll timer fired")
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			break
+		}
+	}
+}
+
+// do runs fn on the goroutine watching r, once Watch is waiting
+// between fetches, and waits for it to finish. It returns an error,
+// without running fn, if ctx is done first.
+func (r *Repo) do(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	select {
+	case r.work <- func() { fn(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// pollWait returns the longest Watch waits for a tickle before
+// fetching r again anyway.
+func (r *Repo) pollWait() time.Duration {
+	if r.bundle != "" {
+		// Nothing tickles a repo fetched from a bundle
+		// when the bundle is refreshed.
+		return *pollInterval
+	}
+	// We still run a timer but a slow one (see
+	// -watcher.polltimer), just in case the mechanism
+	// updating the repo tickler breaks for some reason.
+	wait := *pollTimer
+	if r.dash && *heartbeat > 0 && *heartbeat < wait {
+		wait = *heartbeat
+	}
+	return wait
+}
+
+func (r *Repo) updateDashboard() (err error) {
+	r.setStatus("updating dashboard")
+	defer func() {
+		if err == nil {
+			r.setStatus("updated dashboard")
+		}
+	}()
+	if err := r.update(true); err != nil {
+		return err
+	}
+	remotes, err := r.remotes()
+	if err != nil {
+		return err
+	}
+	for _, name := range remotes {
+		b, ok := r.branches[name]
+		if !ok {
+			// skip branch; must be already merged
+			continue
+		}
+		if err := r.postNewCommits(b); err != nil {
+			return err
+		}
+	}
+	// A deletion the dashboard misses shouldn't hold up
+	// everything else, so failures are only logged.
+	for _, name := range r.deletedBranches {
+		if err := r.postBranchDeleted(name); err != nil {
+			r.logf("%v", err)
+		}
+	}
+	r.deletedBranches = nil
+	r.recordSnapshot()
+	return nil
+}
+
+func (r *Repo) name() string {
+	if r.nameOpt != "" {
+		return r.nameOpt
+	}
+	return r.gerritName()
+}
+
+// gerritName returns the name of r's Gerrit project,
+// which is what repo ticklers are keyed by.
+func (r *Repo) gerritName() string {
+	if r.path == "" {
+		return "go"
+	}
+	return path.Base(r.path)
+}
+
+// dashPackagePath returns the package path that identifies
+// the repo to the dashboard.
+func (r *Repo) dashPackagePath() string {
+	if r.dashPath != "" {
+		return r.dashPath
+	}
+	return r.path
+}
+
+// postNewCommits looks for unseen commits on the specified branch and
+// posts them to the dashboard.
+func (r *Repo) postNewCommits(b *Branch) error {
+	if b.Head == b.LastSeen {
+		return nil
+	}
+	c := b.LastSeen
+	if c == nil && *maxBootstrap > 0 {
+		c = r.bootstrapCutoff(b, *maxBootstrap)
+	}
+	if c == nil {
+		// Haven't seen anything on this branch yet:
+		if b.Name == r.defaultBranch {
+			// For the default branch, bootstrap by creating a dummy
+			// commit with a lone child that is the initial commit.
+			root, err := r.initialCommit(b)
+			if err != nil {
+				return err
+			}
+			c = &Commit{children: []*Commit{root}}
+		} else {
+			// Find the commit that this branch forked from.
+			base, err := r.mergeBase("heads/"+b.Name, r.defaultBranch)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			c, ok = r.commits[base]
+			if !ok {
+				return fmt.Errorf("couldn't find base commit: %v", base)
+			}
+			// The dashboard may not know the fork base either,
+			// for instance if the default branch was cut off by
+			// -watcher.bootstrapDepth below it, or isn't watched.
+			if err := r.postUnseenAncestors(c); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.postCommits(r.childrenToPost(nil, b, c)); err != nil {
+		if !strings.Contains(err.Error(), "this package already has a first commit; aborting") {
+			return err
+		}
+	}
+	b.LastSeen = b.Head
+	return nil
+}
+
+// initialCommit returns the root commit that b's history starts from.
+// If r has several roots, as when unrelated histories were merged,
+// that is the one at the end of b's first-parent history.
+func (r *Repo) initialCommit(b *Branch) (*Commit, error) {
+	switch len(r.roots) {
+	case 0:
+		return nil, fmt.Errorf("couldn't find initial commit")
+	case 1:
+		return r.roots[0], nil
+	}
+	first := b.Head
+	for first.parent != nil {
+		first = first.parent
+	}
+	for _, c := range r.roots {
+		if c == first {
+			r.logf("found %d root commits; using %v, the first-parent root of branch %q", len(r.roots), c, b.Name)
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("couldn't find initial commit: none of the %d root commits is the first-parent root of branch %q", len(r.roots), b.Name)
+}
+
+// bootstrapCutoff returns the commit n commits behind b's head,
+// recording it in r.cutoffs, so that only the last n commits on b
+// are posted. It returns nil if b has no more than n commits of its
+// own, in which case they're all posted as usual.
+func (r *Repo) bootstrapCutoff(b *Branch, n int) *Commit {
+	c := b.Head
+	for i := 0; i < n; i++ {
+		c = c.parent
+		if c == nil || c.Branch != b.Name {
+			return nil
+		}
+	}
+	r.logf("branch %q has no commits on the dashboard; posting only the last %d", b.Name, n)
+	if r.cutoffs == nil {
+		r.cutoffs = make(map[string]bool)
+	}
+	r.cutoffs[c.Hash] = true
+	return c
+}
+
+// postUnseenAncestors posts c and its first-parent ancestors back to
+// the newest one the dashboard has seen (or, if it has seen none,
+// back to the initial commit or a -watcher.bootstrapDepth cutoff),
+// oldest first, whichever branches they are on.
+func (r *Repo) postUnseenAncestors(c *Commit) error {
+	seen, err := r.lastSeen(c.Hash)
+	if err != nil {
+		return err
+	}
+	var unseen []*Commit
+	for a := c; a != nil && a != seen && !r.cutoffs[a.Hash]; a = a.parent {
+		unseen = append(unseen, a)
+	}
+	if len(unseen) == 0 {
+		return nil
+	}
+	r.logf("fork base %v isn't on the dashboard; posting it and %d unseen ancestors", c, len(unseen)-1)
+	for i, j := 0, len(unseen)-1; i < j; i, j = i+1, j-1 {
+		unseen[i], unseen[j] = unseen[j], unseen[i]
+	}
+	return r.postCommits(unseen)
+}
+
+// childrenToPost appends to cs the descendants of parent on branch
+// b, following first-parent links only, in the order they are to be
+// posted: each commit once, after its first parent.
+func (r *Repo) childrenToPost(cs []*Commit, b *Branch, parent *Commit) []*Commit {
+	for _, c := range parent.children {
+		if c.Branch == b.Name && c.firstChildOf(parent) {
+			cs = append(cs, c)
+		}
+	}
+	for _, c := range parent.children {
+		if c.firstChildOf(parent) {
+			cs = r.childrenToPost(cs, b, c)
+		}
+	}
+	return cs
+}
+
+// postBatchSize is the most commits postCommitBatch sends to the
+// dashboard in one request.
+const postBatchSize = 100
+
+// postCommits sends the commits cs, in order, to the build dashboard,
+// postBatchSize at a time, stopping at the first that fails.
+func (r *Repo) postCommits(cs []*Commit) error {
+	for len(cs) > 0 {
+		n := len(cs)
+		if n > postBatchSize {
+			n = postBatchSize
+		}
+		if err := r.postCommitBatch(cs[:n]); err != nil {
+			return err
+		}
+		cs = cs[n:]
+	}
+	return nil
+}
+
+// postCommitBatch sends the commits cs, in order, to the build
+// dashboard in a single request, or with postCommit one at a time
+// if the dashboard doesn't support that.
+func (r *Repo) postCommitBatch(cs []*Commit) error {
+	_, goDash := dashCommitFormat.(goDashFormat)
+	if r.noPostBatch || !goDash || !*report || !*network || len(cs) == 1 || r.dashClient != nil {
+		for _, c := range cs {
+			if err := r.postCommit(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		batch    []*Commit
+		bodies   []interface{}
+		times    []time.Time
+		badDates []bool
+	)
+	for _, c := range cs {
+		if blockedCommits[c.Hash] {
+			r.logf("not posting blocked commit %v", c)
+			continue
+		}
+		if err := verifyCommit(c); err != nil {
+			r.logf("not posting commit %v: %v", c, err)
+			continue
+		}
+		if !postFilter.allows(c) {
+			r.logf("not posting commit %v: excluded by -watcher.postfilter", c)
+			continue
+		}
+		t, badDate, ok := r.postTime(c)
+		if !ok {
+			continue
+		}
+		_, _, body := dashCommitFormat.commitRequest(r, c, t)
+		batch = append(batch, c)
+		bodies = append(bodies, body)
+		times = append(times, t)
+		badDates = append(badDates, badDate)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(bodies)
+	if err != nil {
+		return fmt.Errorf("postCommits: marshaling request body: %v", err)
+	}
+	r.logf("sending %d commits to dashboard: %v through %v", len(batch), batch[0], batch[len(batch)-1])
+
+	results, err := func() ([]postResult, error) {
+		if !postSem.tryAcquire() {
+			r.setStatus("waiting for a dashboard post slot")
+			postSem.acquire()
+		}
+		defer postSem.release()
+		defer r.timeMetric("watcher_post_duration_seconds", time.Now())
+		var results []postResult
+		err := r.retryRateLimited(func() (err error) {
+			results, err = dashPostBatch(b)
+			return err
+		})
+		return results, err
+	}()
+	if err == errPostBatchUnsupported {
+		r.logf("dashboard doesn't support batch commit posts; falling back to one at a time")
+		r.noPostBatch = true
+		return r.postCommitBatch(cs)
+	}
+	if err != nil {
+		incMetric("watcher_dashboard_errors_total", r.name())
+		return fmt.Errorf("postCommits: %v", err)
+	}
+	for i, c := range batch {
+		if i >= len(results) {
+			return fmt.Errorf("postCommits: dashboard reported on %d of %d commits", len(results), len(batch))
+		}
+		if res := results[i]; res.Hash != c.Hash {
+			return fmt.Errorf("postCommits: dashboard reported on %s in place of %v", res.Hash, c)
+		} else if res.Error != "" {
+			incMetric("watcher_dashboard_errors_total", r.name())
+			return fmt.Errorf("postCommit: error: %v", res.Error)
+		}
+		incMetric("watcher_commits_posted_total", r.name())
+		if !badDates[i] {
+			r.recordPostLag(time.Since(times[i]))
+		}
+	}
+	r.setStatus(fmt.Sprintf("posted %d commits, through %v", len(batch), batch[len(batch)-1]))
+	return nil
+}
+
+// errPostBatchUnsupported is returned by dashPostBatch when the
+// dashboard is too old to support batch commit posts.
+var errPostBatchUnsupported = errors.New("dashboard does not support batch commit posts")
+
+// A postResult is the dashboard's response to one of the commits
+// in a batch sent by dashPostBatch.
+type postResult struct {
+	Hash  string
+	Error string // empty if the commit was added
+}
+
+// dashPostBatch sends the JSON-encoded array of commits b to the
+// dashboard's batch commit endpoint, which adds them in order until
+// one fails, and returns the result for each commit it tried.
+func dashPostBatch(b []byte) ([]postResult, error) {
+	v := url.Values{"version": {fmt.Sprint(watcherVersion)}, "key": {dashboardKey}}
+	req, err := http.NewRequest("POST", *dashFlag+"commits?"+v.Encode(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := watcherClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errPostBatchUnsupported
+	}
+	if err := checkRateLimit(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status: %v", resp.Status)
+	}
+	var res struct {
+		Response []postResult
+		Error    string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("decoding response: %v", err)
+	}
+	if res.Error != "" {
+		if strings.Contains(res.Error, "version") {
+			return nil, errPostBatchUnsupported
+		}
+		return nil, fmt.Errorf("error: %v", res.Error)
+	}
+	return res.Response, nil
+}
+
+// postCommit sends a commit to the build dashboard.
+// Blocked commits (see -watcher.blockedCommits) and those
+// excluded by -watcher.postfilter are not sent.
+func (r *Repo) postCommit(c *Commit) error {
+	if blockedCommits[c.Hash] {
+		r.logf("not posting blocked commit %v", c)
+		return nil
+	}
+	if err := verifyCommit(c); err != nil {
+		r.logf("not posting commit %v: %v", c, err)
+		return nil
+	}
+	if !postFilter.allows(c) {
+		r.logf("not posting commit %v: excluded by -watcher.postfilter", c)
+		return nil
+	}
+	if !*report && r.dashClient == nil {
+		r.logf("dry-run mode; NOT posting commit to dashboard: %v", c)
+		return nil
+	}
+	r.logf("sending commit to dashboard: %v", c)
+
+	t, badDate, ok := r.postTime(c)
+	if !ok {
+		return nil
+	}
+	parent := r.dashParent(c)
+	method, endpoint, body := dashCommitFormat.commitRequest(r, c, t)
+
+	if !*network && r.dashClient == nil {
+		if parent != "" {
+			if !networkSeen[parent] {
+				r.logf("%v: %v", parent, r.commits[parent])
+				return fmt.Errorf("postCommit: no parent %v found on dashboard for %v", parent, c)
+			}
+		}
+		if networkSeen[c.Hash] {
+			return fmt.Errorf("postCommit: already seen %v", c)
+		}
+		networkSeen[c.Hash] = true
+		return nil
+	}
+
+	if !postSem.tryAcquire() {
+		r.setStatus("waiting for a dashboard post slot")
+		postSem.acquire()
+	}
+	defer postSem.release()
+
+	start := time.Now()
+	err := r.retryRateLimited(func() error { return r.dashboard().PostCommit(method, endpoint, body) })
+	r.timeMetric("watcher_post_duration_seconds", start)
+	if err != nil {
+		incMetric("watcher_dashboard_errors_total", r.name())
+		return fmt.Errorf("postCommit: %v", err)
+	}
+	incMetric("watcher_commits_posted_total", r.name())
+	if badDate {
+		r.setStatus(fmt.Sprintf("posted %v with bad date %q", c, c.Date))
+		return nil
+	}
+	lag := time.Since(t)
+	r.recordPostLag(lag)
+	r.setStatus(fmt.Sprintf("posted %v %v after commit", c, lag.Round(100*time.Millisecond)))
+	return nil
+}
+
+// postTime returns the time to post commit c to the dashboard with,
+// its date, and whether c should be posted at all. If c's date can't
+// be parsed, it reports badDate and applies -watcher.badDatePolicy.
+func (r *Repo) postTime(c *Commit) (t time.Time, badDate, ok bool) {
+	t, err := parseCommitDate(c.Date)
+	if err == nil {
+		return t, false, true
+	}
+	switch *badDates {
+	case "zero":
+		r.logf("commit %v: %v; posting it with the zero time", c, err)
+		return time.Time{}, true, true
+	case "now":
+		r.logf("commit %v: %v; posting it with the current time", c, err)
+		return time.Now(), true, true
+	}
+	r.logf("not posting commit %v: %v", c, err)
+	return time.Time{}, true, false
+}
+
+// A commitFormat describes how commits are sent to the dashboard.
+type commitFormat interface {
+	// commitRequest returns the HTTP method and the endpoint
+	// (relative to -watcher.dash) used to send commit c of repo r,
+	// committed at time t, to the dashboard, and the value to send
+	// as the JSON-encoded request body.
+	commitRequest(r *Repo, c *Commit, t time.Time) (method, endpoint string, body interface{})
+}
+
+// A dashboardClient talks to the build dashboard on behalf of a Repo.
+type dashboardClient interface {
+	// PostCommit sends a commit to the dashboard: body, JSON-encoded,
+	// with the HTTP method to the endpoint, as returned by
+	// dashCommitFormat's commitRequest.
+	PostCommit(method, endpoint string, body interface{}) error
+
+	// CommitSeen reports whether the dashboard knows the commit
+	// with the given hash in the repo with the given package path
+	// (empty for the main repo).
+	CommitSeen(hash, path string) (bool, error)
+}
+
+// dashboard returns the dashboardClient r talks to.
+func (r *Repo) dashboard() dashboardClient {
+	if r.dashClient != nil {
+		return r.dashClient
+	}
+	return httpDashboard{}
+}
+
+// httpDashboard is the dashboardClient of the dashboard
+// at -watcher.dash.
+type httpDashboard struct{}
+
+func (httpDashboard) PostCommit(method, endpoint string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshaling request body: %v", err)
+	}
+	return dashRequest(method, endpoint, b)
+}
+
+func (httpDashboard) CommitSeen(hash, path string) (bool, error) {
+	v := url.Values{"hash": {hash}, "packagePath": {path}}
+	u := *dashFlag + "commit?" + v.Encode()
+	resp, err := watcherClient.Get(u)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := checkRateLimit(resp); err != nil {
+		return false, err
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("status: %v", resp.Status)
+	}
+	var s struct {
+		Error string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	if err != nil {
+		return false, err
+	}
+	switch s.Error {
+	case "":
+		// Found one.
+		return true, nil
+	case "Commit not found":
+		// Commit not found, keep looking for earlier commits.
+		return false, nil
+	default:
+		return false, fmt.Errorf("dashboard: %v", s.Error)
+	}
+}
+
+// dashCommitFormat is the format in which postCommit sends commits.
+var dashCommitFormat commitFormat = goDashFormat{}
+
+// goDashFormat is the commitFormat of the Go build dashboard.
+type goDashFormat struct{}
+
+// dashCommit is the body of the Go build dashboard's commit request.
+type dashCommit struct {
+	PackagePath string // (empty for main repo commits)
+	Hash        string
+	ParentHash  string
+
+	User           string
+	Desc           string
+	Subject        string // first line of Desc
+	Body           string // rest of Desc
+	Time           time.Time
+	Branch         string
+	OriginalBranch string   // branch the commit was first seen on; Branch is the default branch if it contains the commit
+	Branches       []string // all branches containing the commit
+
+	NeedsBenchmarking bool
+	ReleaseRelevant   bool
+	DependencyBump    bool
+	Empty             bool
+	LargeChange       bool
+
+	GerritChangeNumber int    // zero if unknown
+	Topic              string // Gerrit topic; empty if none
+	CherryPickOf       string // hash of the commit this was cherry-picked from; empty if none
+
+	// Files lists the files changed by the commit, if
+	// -watcher.postFiles is set; FilesTruncated reports whether
+	// there were more than -watcher.postFiles of them.
+	Files          []string `json:",omitempty"`
+	FilesTruncated bool     `json:",omitempty"`
+}
+
+func (goDashFormat) commitRequest(r *Repo, c *Commit, t time.Time) (method, endpoint string, body interface{}) {
+	var files []string
+	var truncated bool
+	if *postFiles > 0 {
+		files = c.files()
+		if len(files) > *postFiles {
+			files, truncated = files[:*postFiles], true
+		}
+	}
+	return "POST", "commit", &dashCommit{
+		PackagePath: r.dashPackagePath(),
+		Hash:        c.Hash,
+		ParentHash:  r.dashParent(c),
+
+		User:           c.Author,
+		Desc:           c.Desc,
+		Subject:        c.Subject(),
+		Body:           c.Body(),
+		Time:           t,
+		Branch:         c.Branch,
+		OriginalBranch: c.OriginalBranch,
+		Branches:       c.Branches,
+
+		NeedsBenchmarking: c.NeedsBenchmarking(r.bench, r.defaultBranch),
+		ReleaseRelevant:   c.ReleaseRelevant(releasePrefix),
+		DependencyBump:    c.DependencyBump(),
+		Empty:             c.Empty(),
+		LargeChange:       c.LargeChange,
+
+		GerritChangeNumber: c.GerritChangeNumber(),
+		Topic:              c.Topic(),
+		CherryPickOf:       c.CherryPickOf(),
+
+		Files:          files,
+		FilesTruncated: truncated,
+	}
+}
+
+// dashParent returns the hash of the commit to report to the
+// dashboard as c's parent: its first parent, skipping over any
+// commits that are never posted (see unposted), or "" if the parent
+// was cut off by -watcher.bootstrapDepth. If all of c's ancestors
+// are skipped, c is posted as if it were the initial commit.
+func (r *Repo) dashParent(c *Commit) string {
+	p := c.Parent
+	if r.cutoffs[p] {
+		return ""
+	}
+	for r.unposted(p) {
+		pc, ok := r.commits[p]
+		if !ok {
+			break
+		}
+		p = pc.Parent
+	}
+	return p
+}
+
+// unposted reports whether the commit with hash h is one that is
+// never posted: a blocked commit, one failing verifyCommit, or one
+// excluded by -watcher.postfilter.
+func (r *Repo) unposted(h string) bool {
+	if blockedCommits[h] {
+		return true
+	}
+	c, ok := r.commits[h]
+	return ok && (verifyCommit(c) != nil || !postFilter.allows(c))
+}
+
+// postFilter holds the parsed -watcher.postfilter.
+var postFilter commitFilter
+
+// A commitFilter decides which commits are posted to the dashboard.
+// A commit is posted if it meets all the conditions; so with none,
+// every commit is.
+type commitFilter []commitCond
+
+// A commitCond is one of a commitFilter's conditions.
+type commitCond struct {
+	negate bool
+	author string         // if non-empty, the author must contain this
+	desc   *regexp.Regexp // if non-nil, the description must match this
+}
+
+// parseCommitFilter parses the -watcher.postfilter flag value.
+func parseCommitFilter(s string) (commitFilter, error) {
+	var f commitFilter
+	for _, term := range strings.Fields(s) {
+		var cond commitCond
+		t := term
+		if strings.HasPrefix(t, "!") {
+			cond.negate, t = true, t[1:]
+		}
+		i := strings.Index(t, ":")
+		if i < 0 || i == len(t)-1 {
+			return nil, fmt.Errorf("invalid -watcher.postfilter condition %q; want author:SUBSTRING or desc:REGEXP", term)
+		}
+		switch key, val := t[:i], t[i+1:]; key {
+		case "author":
+			cond.author = val
+		case "desc":
+			re, err := regexp.Compile(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -watcher.postfilter condition %q: %v", term, err)
+			}
+			cond.desc = re
+		default:
+			return nil, fmt.Errorf("invalid -watcher.postfilter condition %q; want author:SUBSTRING or desc:REGEXP", term)
+		}
+		f = append(f, cond)
+	}
+	return f, nil
+}
+
+// allows reports whether f lets c be posted.
+func (f commitFilter) allows(c *Commit) bool {
+	for _, cond := range f {
+		var match bool
+		if cond.desc != nil {
+			match = cond.desc.MatchString(c.Desc)
+		} else {
+			match = strings.Contains(c.Author, cond.author)
+		}
+		if match == cond.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyCommit returns an error if -watcher.verifysig is set and c's
+// signature isn't good and valid, or c is unsigned and unsigned
+// commits aren't allowed (see -watcher.unsigned). Such commits are
+// not posted to the dashboard.
+func verifyCommit(c *Commit) error {
+	if !*verifySig {
+		return nil
+	}
+	switch c.SigStatus {
+	case "G":
+		return nil
+	case "N", "":
+		if *unsignedPol == "allow" {
+			return nil
+		}
+		return errors.New("commit is unsigned")
+	case "B":
+		return errors.New("bad signature")
+	case "E":
+		return errors.New("signature can't be checked (missing key?)")
+	case "U":
+		return errors.New("good signature of unknown validity")
+	default:
+		// X, Y and R: expired signature, expired key
+		// or revoked key.
+		return fmt.Errorf("signature not valid (status %q)", c.SigStatus)
+	}
+}
+
+// readBlockedCommits reads a file of full commit hashes, one per line.
+// Blank lines and text following a '#' are ignored.
+func readBlockedCommits(file string) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]bool)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = trimListLine(line)
+		if line == "" {
+			continue
+		}
+		if !isCommitHash(line) {
+			return nil, fmt.Errorf("%s:%d: %q is not a full lowercase commit hash", file, i+1, line)
+		}
+		m[line] = true
+	}
+	return m, nil
+}
+
+// readListFile returns the non-blank lines of file, trimmed as
+// by trimListLine.
+func readListFile(file string) ([]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = trimListLine(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// trimListLine trims a line of a list file of surrounding space
+// and of any text following a '#'.
+func trimListLine(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// dashRequest sends the JSON-encoded body to the named dashboard
+// endpoint (e.g. "commit") using the given HTTP method and checks
+// the response for errors.
+func dashRequest(method, endpoint string, b []byte) error {
+	v := url.Values{"version": {fmt.Sprint(watcherVersion)}, "key": {dashboardKey}}
+	u := *dashFlag + endpoint + "?" + v.Encode()
+	req, err := http.NewRequest(method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := watcherClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading body: %v", err)
+	}
+	if err := checkRateLimit(resp); err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("status: %v\nbody: %s", resp.Status, body)
+	}
+
+	var s struct {
+		Error string
+	}
+	if err := json.Unmarshal(body, &s); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	if s.Error != "" {
+		return fmt.Errorf("error: %v", s.Error)
+	}
+	return nil
+}
+
+// maybeHeartbeat posts a heartbeat for r to the dashboard if
+// -watcher.heartbeat is set and at least that long has passed
+// since the last one. Failures are logged but otherwise ignored.
+func (r *Repo) maybeHeartbeat() {
+	if *heartbeat <= 0 {
+		return
+	}
+	now := watcherNow()
+	if !r.lastHeartbeat.IsZero() && now.Sub(r.lastHeartbeat) < *heartbeat {
+		return
+	}
+	r.lastHeartbeat = now
+	if !*report || !*network {
+		return
+	}
+	b, err := json.Marshal(struct {
+		PackagePath string // (empty for main repo)
+		Time        time.Time
+	}{r.dashPackagePath(), now})
+	if err != nil {
+		r.logf("heartbeat: marshaling request body: %v", err)
+		return
+	}
+	if err := dashRequest("POST", "heartbeat", b); err != nil {
+		incMetric("watcher_dashboard_errors_total", r.name())
+		r.logf("heartbeat: %v", err)
+	}
+}
+
+// postBranchDeleted tells the build dashboard that the named
+// branch, whose commits were previously reported, has been
+// deleted upstream.
+func (r *Repo) postBranchDeleted(name string) error {
+	if !*report {
+		r.logf("dry-run mode; NOT posting deletion of branch %q to dashboard", name)
+		return nil
+	}
+	if !*network {
+		return nil
+	}
+	r.logf("sending deletion of branch %q to dashboard", name)
+	b, err := json.Marshal(struct {
+		PackagePath string // (empty for main repo)
+		Branch      string
+	}{r.dashPackagePath(), name})
+	if err != nil {
+		return fmt.Errorf("postBranchDeleted: marshaling request body: %v", err)
+	}
+	if err := dashRequest("POST", "branch-deleted", b); err != nil {
+		incMetric("watcher_dashboard_errors_total", r.name())
+		return fmt.Errorf("postBranchDeleted: %v", err)
+	}
+	return nil
+}
+
+// update looks for new commits and branches,
+// and updates the commits and branches maps.
+func (r *Repo) update(noisy bool) error {
+	remotes, err := r.remotes()
+	if err != nil {
+		return err
+	}
+	if *branches != "" {
+		// remotes returns -watcher.branches as is,
+		// so drop the branches that don't exist.
+		var bs []string
+		for _, name := range remotes {
+			if r.hasBranch(name) {
+				bs = append(bs, name)
+			}
+		}
+		remotes = bs
+	}
+
+	// Forget branches that have been deleted upstream.
+	live := make(map[string]bool)
+	for _, name := range remotes {
+		live[name] = true
+	}
+	for name, b := range r.branches {
+		if live[name] {
+			continue
+		}
+		r.logf("branch %q deleted", name)
+		delete(r.branches, name)
+		if b.LastSeen != nil {
+			// The dashboard knows about it; tell it later.
+			r.deletedBranches = append(r.deletedBranches, name)
+		}
+	}
+
+	// Find all unseen commits on each branch, running git log
+	// for several branches at once. The results are merged into
+	// r.commits one branch at a time, in order, below.
+	logs := make([][]*Commit, len(remotes))
+	errs := make([]error, len(remotes))
+	sem := newSemaphore(*logWorkers)
+	var wg sync.WaitGroup
+	for i, name := range remotes {
+		revspec := "heads/" + name
+		if b := r.branches[name]; b != nil {
+			// If we know about this branch,
+			// only log commits down to the known head.
+			revspec = b.Head.Hash + ".." + revspec
+		}
+		wg.Add(1)
+		go func(i int, revspec string) {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			logs[i], errs[i] = r.log("--topo-order", revspec)
+		}(i, revspec)
+	}
+	wg.Wait()
+
+	for i, name := range remotes {
+		b := r.branches[name]
+		log, err := logs[i], errs[i]
+		if err != nil {
+			return err
+		}
+		if len(log) == 0 {
+			// No commits to handle; carry on.
+			continue
+		}
+
+		var nDups, nDrops int
+
+		// Add unknown commits to r.commits.
+		var added []*Commit
+		for _, c := range log {
+			if noisy {
+				r.logf("found new commit %v", c)
+			}
+			// If we've already seen this commit,
+			// only store the default branch's one in r.commits.
+			if old, ok := r.commits[c.Hash]; ok {
+				nDups++
+				old.addBranch(name)
+				if name != r.defaultBranch {
+					nDrops++
+					continue
+				}
+				c.Branches = old.Branches
+				c.OriginalBranch = old.OriginalBranch
+			} else {
+				c.OriginalBranch = name
+				r.addAuthor(c)
+			}
+			c.Branch = name
+			c.addBranch(name)
+			r.commits[c.Hash] = c
+			added = append(added, c)
+		}
+
+		if nDups > 0 {
+			r.logf("saw %v duplicate commits; dropped %v of them", nDups, nDrops)
+		}
+
+		// Link added commits.
+		var orphans []*Commit
+		for _, c := range added {
+			if c.Parent == "" {
+				if r.depth > 0 && r.shallowBoundary()[c.Hash] {
+					// Its parents weren't fetched.
+					r.logf("commit %v is at the shallow clone's boundary", c)
+					continue
+				}
+				// This is the initial commit; no parent.
+				r.logf("no parents for initial commit %v", c)
+				r.roots = append(r.roots, c)
+				continue
+			}
+			// Find parent commit.
+			p, ok := r.commits[c.Parent]
+			if !ok {
+				if !*allowOrphans {
+					return fmt.Errorf("can't find parent %q for %v", c.Parent, c)
+				}
+				orphans = append(orphans, c)
+				continue
+			}
+			// Link parent Commit.
+			c.parent = p
+			c.parents = []*Commit{p}
+			// Link child Commits.
+			p.children = append(p.children, c)
+			// Link any other parents of a merge. They're reachable
+			// from the branch head, so they're known unless the log
+			// was filtered (see -watcher.filter).
+			for _, h := range c.Parents[1:] {
+				if p, ok := r.commits[h]; ok {
+					c.parents = append(c.parents, p)
+					p.children = append(p.children, c)
+				}
+			}
+		}
+
+		if len(orphans) > 0 {
+			if r.orphans == nil {
+				r.orphans = make(map[string]*Commit)
+			}
+			var hashes []string
+			for _, c := range orphans {
+				r.orphans[c.Hash] = c
+				hashes = append(hashes, c.Hash[:7]+" (parent "+c.Parent[:7]+")")
+			}
+			r.logf("warning: %d commits on branch %q have unknown parents and won't be posted: %s",
+				len(orphans), name, strings.Join(hashes, ", "))
+		}
+
+		// Update branch head, or add newly discovered branch.
+		head := log[0]
+		if b != nil {
+			// Known branch; update head.
+			old := b.Head
+			b.Head = head
+			r.logf("updated branch head: %v", b)
+			emitHeadEvent(headEvent{
+				Repo:    r.name(),
+				Branch:  name,
+				OldHead: old.Hash,
+				NewHead: head.Hash,
+				Commits: len(log),
+			})
+		} else {
+			// It's a new branch; add it.
+			seen, err := r.lastSeen(head.Hash)
+			if err != nil {
+				return err
+			}
+			if seen == nil && r.depth > 0 {
+				if deepened, err := r.deepen(name, head); err != nil {
+					return err
+				} else if deepened {
+					// Commits that were parentless now have
+					// parents; rebuild the graph from scratch.
+					r.resetCommits()
+					return r.update(noisy)
+				}
+			}
+			b = &Branch{Name: name, Head: head, LastSeen: seen}
+			r.branches[name] = b
+			r.logf("found branch: %v", b)
+		}
+	}
+
+	r.recordSnapshot()
+	return nil
+}
+
+// A headEvent records a known branch head advancing to a new commit.
+type headEvent struct {
+	Repo    string
+	Branch  string
+	OldHead string
+	NewHead string
+	Commits int // number of commits between OldHead and NewHead
+}
+
+// emitHeadEvent is called by update each time a known branch head
+// advances. By default it writes the event as a JSON log line if
+// -watcher.headevents is set. It is a variable for testing.
+var emitHeadEvent = func(ev headEvent) {
+	if !*headEvents {
+		return
+	}
+	j, err := json.Marshal(ev)
+	if err != nil {
+		watcherLogf("marshaling head event: %v", err)
+		return
+	}
+	watcherLogf("head-event %s", j)
+}
+
+// lastSeen finds the most recent commit the dashboard has seen,
+// starting at the specified head. If the dashboard hasn't seen
+// any of the commits from head to the beginning, it returns nil.
+func (r *Repo) lastSeen(head string) (*Commit, error) {
+	h, ok := r.commits[head]
+	if !ok {
+		return nil, fmt.Errorf("lastSeen: can't find %q in commits", head)
+	}
+
+	var s []*Commit
+	for c := h; c != nil; c = c.parent {
+		s = append(s, c)
+	}
+
+	if !r.noSeenBatch {
+		c, err := r.lastSeenBatch(s)
+		if err != errSeenBatchUnsupported {
+			return c, err
+		}
+		r.logf("dashboard doesn't support batch commit lookups; falling back to one at a time")
+		r.noSeenBatch = true
+	}
+
+	var err error
+	i := sort.Search(len(s), func(i int) bool {
+		if err != nil {
+			return false
+		}
+		err = r.retryRateLimited(func() (err error) {
+			ok, err = r.dashSeen(s[i].Hash)
+			return err
+		})
+		return ok
+	})
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("lastSeen: %v", err)
+	case i < len(s):
+		return s[i], nil
+	default:
+		// Dashboard saw no commits.
+		return nil, nil
+	}
+}
+
+// seenBatchSize is the number of commits lastSeenBatch
+// looks up per dashboard request.
+const seenBatchSize = 64
+
+// lastSeenBatch returns the first commit in s that the dashboard
+// has seen, where s lists a branch's commits from its head back
+// (and so any commit seen implies the later ones in s were too).
+// Like a sort.Search that probes seenBatchSize commits at a time,
+// it narrows the range of candidates by that factor per round trip.
+func (r *Repo) lastSeenBatch(s []*Commit) (*Commit, error) {
+	lo, hi := 0, len(s) // s[:lo] are unseen; s[hi] is seen, if hi < len(s)
+	for lo < hi {
+		var probes []int
+		if n := hi - lo; n <= seenBatchSize {
+			for i := lo; i < hi; i++ {
+				probes = append(probes, i)
+			}
+		} else {
+			for j := 0; j < seenBatchSize; j++ {
+				probes = append(probes, lo+j*n/seenBatchSize)
+			}
+		}
+		hashes := make([]string, len(probes))
+		for j, i := range probes {
+			hashes[j] = s[i].Hash
+		}
+		var seen map[string]bool
+		err := r.retryRateLimited(func() (err error) {
+			seen, err = r.dashSeenBatch(hashes)
+			return err
+		})
+		if err == errSeenBatchUnsupported {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lastSeen: %v", err)
+		}
+		next := hi
+		for _, i := range probes {
+			if seen[s[i].Hash] {
+				next = i
+				break
+			}
+			lo = i + 1
+		}
+		hi = next
+	}
+	if hi < len(s) {
+		return s[hi], nil
+	}
+	// Dashboard saw no commits.
+	return nil, nil
+}
+
+// errSeenBatchUnsupported is returned by dashSeenBatch when the
+// dashboard is too old to support batch lookups.
+var errSeenBatchUnsupported = errors.New("dashboard does not support batch commit lookups")
+
+// dashSeenBatch reports which of the given commits the dashboard has
+// seen, as a set of hashes.
+func (r *Repo) dashSeenBatch(hashes []string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	if r.dashClient != nil {
+		for _, h := range hashes {
+			ok, err := r.dashClient.CommitSeen(h, r.dashPackagePath())
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				seen[h] = true
+			}
+		}
+		return seen, nil
+	}
+	if !*network {
+		for _, h := range hashes {
+			if networkSeen[h] {
+				seen[h] = true
+			}
+		}
+		return seen, nil
+	}
+	b, err := json.Marshal(struct {
+		PackagePath string // (empty for main repo)
+		Hashes      []string
+	}{r.dashPackagePath(), hashes})
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{"version": {fmt.Sprint(watcherVersion)}, "key": {dashboardKey}}
+	req, err := http.NewRequest("POST", *dashFlag+"commits-seen?"+v.Encode(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := watcherClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errSeenBatchUnsupported
+	}
+	if err := checkRateLimit(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status: %v", resp.Status)
+	}
+	var res struct {
+		Response map[string]bool
+		Error    string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		if strings.Contains(res.Error, "version") {
+			return nil, errSeenBatchUnsupported
+		}
+		return nil, fmt.Errorf("dashboard: %v", res.Error)
+	}
+	for h, ok := range res.Response {
+		if ok {
+			seen[h] = true
+		}
+	}
+	return seen, nil
+}
 
-		// Add unknown commits to r.commits.
-		var added []*Commit
-		for _, c := range log {
-			if noisy {
-				r.logf("found new commit %v", c)
+// dashSeen reports whether the build dashboard knows the specified commit.
+func (r *Repo) dashSeen(hash string) (bool, error) {
+	if !*network && r.dashClient == nil {
+		return networkSeen[hash], nil
+	}
+	return r.dashboard().CommitSeen(hash, r.dashPackagePath())
+}
+
+// mergeBase returns the hash of the merge base for revspecs a and b.
+//
+// In a shallow clone (see -watcher.shallow), the merge base may be
+// older than the history fetched, in which case git merge-base fails.
+// update deepens the history of a new branch until its merge base with
+// the default branch is found (see deepen) before postNewCommits needs
+// it, but if that failed, the error says so.
+func (r *Repo) mergeBase(a, b string) (string, error) {
+	cmd := exec.Command("git", "merge-base", a, b)
+	cmd.Dir = r.root
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(r.shallowBoundary()) > 0 {
+			return "", fmt.Errorf("git merge-base %s..%s: %v (the merge base may be outside the history of the shallow clone)", a, b, err)
+		}
+		return "", fmt.Errorf("git merge-base %s..%s: %v", a, b, err)
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// shallowBoundary returns the set of hashes of the commits at the
+// boundary of r's shallow clone: those whose parents weren't fetched,
+// which git log reports as having none. It is empty if r has its
+// full history.
+func (r *Repo) shallowBoundary() map[string]bool {
+	b, err := ioutil.ReadFile(filepath.Join(r.root, "shallow"))
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, h := range strings.Fields(string(b)) {
+		m[h] = true
+	}
+	return m
+}
+
+// deepen is called by update when the dashboard has seen none of the
+// commits on the new branch from head back to the oldest one in r's
+// shallow clone. If the history ends at the clone's boundary, so that
+// the dashboard may have seen older commits, or if the branch's merge
+// base with the default branch isn't in the history, deepen fetches
+// more of the history (doubling its depth) and reports true, in which
+// case the commit graph must be rebuilt. It reports false if the
+// history is complete enough as it is.
+func (r *Repo) deepen(branch string, head *Commit) (bool, error) {
+	boundary := r.shallowBoundary()
+	if len(boundary) == 0 {
+		return false, nil
+	}
+	oldest := head
+	for oldest.parent != nil {
+		oldest = oldest.parent
+	}
+	need := boundary[oldest.Hash]
+	if !need && branch != r.defaultBranch {
+		_, err := r.mergeBase("heads/"+branch, r.defaultBranch)
+		need = err != nil
+	}
+	if !need {
+		return false, nil
+	}
+	r.logf("deepening shallow clone by %d commits to look further back on branch %q", r.depth, branch)
+	r.setStatus(fmt.Sprintf("running git fetch --deepen=%d", r.depth))
+	ctx, cancel := context.WithTimeout(context.Background(), *gitTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.Command("git", "fetch", "--deepen="+strconv.Itoa(r.depth), "origin")
+	cmd.Dir = r.root
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := runCmd(ctx, cmd); err != nil {
+		return false, fmt.Errorf("git fetch --deepen=%d: %v\n\n%s", r.depth, err, out.Bytes())
+	}
+	r.depth *= 2
+	return true, nil
+}
+
+// findDefaultBranch returns the name of r's default branch: the one
+// named by -watcher.defaultbranch, or else the one origin's HEAD (or,
+// in a mirror clone, the local HEAD) refers to, or else master.
+func (r *Repo) findDefaultBranch() string {
+	if *defBranch != "" {
+		return *defBranch
+	}
+	for _, ref := range []string{"refs/remotes/origin/HEAD", "HEAD"} {
+		cmd := exec.Command("git", "symbolic-ref", "--quiet", ref)
+		cmd.Dir = r.root
+		out, err := cmd.Output()
+		if err != nil {
+			continue
+		}
+		target := strings.TrimSpace(string(out))
+		for _, prefix := range []string{"refs/remotes/origin/", "refs/heads/"} {
+			if strings.HasPrefix(target, prefix) {
+				name := strings.TrimPrefix(target, prefix)
+				if r.hasBranch(name) {
+					return name
+				}
+			}
+		}
+	}
+	r.logf("couldn't determine default branch; assuming %s", master)
+	return master
+}
+
+// hasBranch reports whether r has a branch with the given name.
+func (r *Repo) hasBranch(name string) bool {
+	cmd := exec.Command("git", "show-ref", "--verify", "--quiet", "refs/heads/"+name)
+	cmd.Dir = r.root
+	return cmd.Run() == nil
+}
+
+// remotes returns a slice of remote branches known to the git repo.
+// It always puts the default branch first.
+func (r *Repo) remotes() ([]string, error) {
+	if *branches != "" {
+		return strings.Split(*branches, ","), nil
+	}
+
+	cmd := exec.Command("git", "branch")
+	cmd.Dir = r.root
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("git branch: %v", err)
+	}
+	bs := []string{r.defaultBranch}
+	for _, b := range strings.Split(string(out), "\n") {
+		b = strings.TrimPrefix(b, "* ")
+		b = strings.TrimSpace(b)
+		// Ignore aliases, blank lines, and the default branch (it's already in bs).
+		if b == "" || strings.Contains(b, "->") || b == r.defaultBranch {
+			continue
+		}
+		if !watchBranch(b) {
+			continue
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
+// watchBranch reports whether the named branch (other than the default)
+// should be watched, according to -watcher.branchmode.
+func watchBranch(name string) bool {
+	// Ignore pre-go1 release branches; they are just noise.
+	if strings.HasPrefix(name, "release-branch.r") {
+		return false
+	}
+	switch *branchMode {
+	case "default-only":
+		return false
+	case "default-plus-release":
+		return strings.HasPrefix(name, "release-branch.")
+	}
+	return true
+}
+
+// logFormat returns the git log --format argument used by log,
+// with the given boundaries before each commit and before its files.
+// If sig is set, it includes each commit's signature status, which
+// git can only report by verifying the signature; see -watcher.verifysig.
+func logFormat(logBoundary, fileBoundary string, sig bool) string {
+	sigStatus := ""
+	if sig {
+		sigStatus = "%G?\n"
+	}
+	return `--format=format:` + logBoundary + `%H
+%P
+%an <%ae>
+%cD
+` + sigStatus + `%B
+` + fileBoundary
+}
+
+// logBoundaries returns new boundaries for logFormat. They include a
+// random nonce, so that no commit message can contain them and be
+// mistaken for the start of another commit or of its files.
+func logBoundaries() (logBoundary, fileBoundary string) {
+	var b [8]byte
+	nonce := ""
+	if _, err := cryptorand.Read(b[:]); err == nil {
+		nonce = fmt.Sprintf("%x", b)
+	} else {
+		nonce = strconv.FormatInt(rand.Int63(), 16)
+	}
+	return "_-_- magic boundary " + nonce + " -_-_", "_-_- file boundary " + nonce + " -_-_"
+}
+
+// log runs "git log" with the supplied arguments
+// and parses the output into Commit values.
+func (r *Repo) log(dir string, args ...string) ([]*Commit, error) {
+	files := "--name-only"
+	if *largeChange > 0 {
+		files = "--numstat"
+	}
+	logBoundary, fileBoundary := logBoundaries()
+	args = append([]string{"log", "--date=rfc", files, "--parents", logFormat(logBoundary, fileBoundary, *verifySig)}, args...)
+	if r.path == "" && *filter != "" {
+		paths := strings.Split(*filter, ",")
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.root
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("git %v: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	var cs []*Commit
+	for _, text := range strings.Split(string(out), logBoundary) {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		nFields := 5
+		if *verifySig {
+			nFields = 6
+		}
+		p := strings.SplitN(text, "\n", nFields)
+		if len(p) != nFields {
+			return nil, fmt.Errorf("git log %v: malformed commit: %q", strings.Join(args, " "), text)
+		}
+
+		// The change summary contains the change description and files
+		// modified in this commit.  There is no way to directly refer
+		// to the modified files in the log formatting string, so we look
+		// for the file boundary after the description.
+		changeSummary := p[nFields-1]
+		descAndFiles := strings.SplitN(changeSummary, fileBoundary, 2)
+		desc := strings.TrimSpace(descAndFiles[0])
+
+		// For branch merges, the list of files can still be empty
+		// because there are no changed files.
+		files := strings.Replace(strings.TrimSpace(descAndFiles[1]), "\n", " ", -1)
+		var changed int
+		if *largeChange > 0 {
+			files, changed = parseNumstat(strings.TrimSpace(descAndFiles[1]))
+		}
+
+		parents := strings.Fields(p[1])
+		var parent string
+		if len(parents) > 0 {
+			parent = parents[0]
+		}
+		c := &Commit{
+			Hash:    p[0],
+			Parent:  parent,
+			Parents: parents,
+			Author:  p[2],
+			Date:    p[3],
+			Desc:    desc,
+			Files:   files,
+			Changed: changed,
+		}
+		if *verifySig {
+			c.SigStatus = p[4]
+		}
+		if *largeChange > 0 && changed > *largeChange {
+			c.LargeChange = true
+			r.logf("warning: commit %v changes %d lines, more than -watcher.largeChange=%d", c, changed, *largeChange)
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// parseNumstat parses the output of git log --numstat for a single
+// commit, returning the changed files, space-separated as in
+// Commit.Files, and the total number of lines inserted and deleted.
+// Binary files are listed but count no lines.
+func parseNumstat(s string) (files string, changed int) {
+	var names []string
+	for _, line := range strings.Split(s, "\n") {
+		f := strings.SplitN(line, "\t", 3)
+		if len(f) != 3 {
+			continue
+		}
+		for _, n := range f[:2] {
+			if v, err := strconv.Atoi(n); err == nil {
+				changed += v
+			}
+		}
+		names = append(names, numstatPath(f[2]))
+	}
+	return strings.Join(names, " "), changed
+}
+
+// numstatPath returns the new name of the file described by a
+// git --numstat path, which for renames has the form "old => new"
+// or "dir/{old => new}/file".
+func numstatPath(p string) string {
+	i := strings.Index(p, " => ")
+	if i < 0 {
+		return p
+	}
+	lb, rb := strings.LastIndex(p[:i], "{"), strings.Index(p[i:], "}")
+	if lb < 0 || rb < 0 {
+		return p[i+len(" => "):]
+	}
+	rb += i
+	return strings.TrimPrefix(path.Clean(p[:lb]+p[i+len(" => "):rb]+p[rb+1:]), "/")
+}
+
+// fetch runs "git fetch" in the repository root.
+// It makes up to -watcher.retries attempts, in case of transient
+// errors, waiting -watcher.backoff (doubling each time) between them.
+// It gives up if ctx is done while it waits for disk space.
+func (r *Repo) fetch(ctx context.Context) (err error) {
+	n := 0
+	defer func() {
+		if err != nil {
+			r.setStatus("git fetch failed")
+		} else {
+			r.setStatus("ran git fetch")
+		}
+	}()
+	if err := r.waitForDiskSpace(ctx, r.root); err != nil {
+		return err
+	}
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			r.fetchLag.add(time.Since(start))
+			r.fetched()
+		}
+	}()
+	defer r.timeMetric("watcher_fetch_duration_seconds", time.Now())
+	return try(*retries, *backoff, r.countAttempts("fetch", func() error {
+		n++
+		if !fetchSem.tryAcquire() {
+			r.setStatus("waiting for a git fetch slot")
+			fetchSem.acquire()
+		}
+		defer fetchSem.release()
+		if n > 1 {
+			r.setStatus(fmt.Sprintf("running git fetch origin, attempt %d", n))
+		} else {
+			r.setStatus("running git fetch origin")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *gitTimeout)
+		defer cancel()
+		var out bytes.Buffer
+		cmd := exec.Command("git", fetchArgs()...)
+		cmd.Dir = r.root
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := runCmd(ctx, cmd); err != nil {
+			err = fmt.Errorf("%v\n\n%s", err, out.Bytes())
+			r.logf("git fetch: %v", err)
+			return err
+		}
+		return nil
+	}))
+}
+
+// gitKillGrace is how long runCmd waits for a command to exit
+// after asking it to terminate, before killing it.
+var gitKillGrace = 10 * time.Second
+
+// runCmd starts cmd and waits for it to complete. If ctx is done
+// first, runCmd asks cmd's process group to terminate and, if it
+// hasn't exited after gitKillGrace, kills it. Either way the process
+// is reaped before runCmd returns.
+func runCmd(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	terminateProcessGroup(cmd)
+	timer := time.NewTimer(gitKillGrace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-timer.C:
+	}
+	watcherLogf("%s didn't exit %v after SIGTERM; killing it", cmd.Args, gitKillGrace)
+	killProcessGroup(cmd)
+	<-done
+	return ctx.Err()
+}
+
+// fetchArgs returns the arguments to git used to fetch from origin.
+func fetchArgs() []string {
+	if *prune {
+		return []string{"fetch", "--prune", "origin"}
+	}
+	return []string{"fetch", "origin"}
+}
+
+// maxConcurrentPushes is the maximum number of a repo's
+// destinations that push pushes to at once.
+const maxConcurrentPushes = 4
+
+// A mirrorDest is a git remote that a repo is mirrored to.
+type mirrorDest struct {
+	remote string // name of the git remote, e.g. "dest"
+	url    string
+}
+
+// mirrorDests returns the mirrorDests with the given URLs. The
+// first remote is named "dest"; any others "dest2", "dest3" and
+// so on.
+func mirrorDests(urls []string) []mirrorDest {
+	var ds []mirrorDest
+	for i, u := range urls {
+		d := mirrorDest{remote: "dest", url: u}
+		if i > 0 {
+			d.remote = fmt.Sprintf("dest%d", i+1)
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// push mirrors the repository to each of r.dests, pushing to up
+// to maxConcurrentPushes of them in parallel. It returns an error
+// if pushing to any of them failed.
+func (r *Repo) push() error {
+	defer r.timeMetric("watcher_push_duration_seconds", time.Now())
+	if len(r.dests) == 1 {
+		return r.pushTo(r.dests[0])
+	}
+	sem := newSemaphore(maxConcurrentPushes)
+	errs := make([]error, len(r.dests))
+	var wg sync.WaitGroup
+	for i, d := range r.dests {
+		wg.Add(1)
+		go func(i int, d mirrorDest) {
+			defer wg.Done()
+			sem.acquire()
+			defer sem.release()
+			errs[i] = r.pushTo(d)
+		}(i, d)
+	}
+	wg.Wait()
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("pushing to %s (%s): %v", r.dests[i].remote, r.dests[i].url, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// pushTo runs "git push -f" in the repository root to push every
+// changed ref to the destination d.
+// It makes up to -watcher.retries attempts, in case of transient
+// errors, waiting -watcher.backoff (doubling each time) between them.
+func (r *Repo) pushTo(d mirrorDest) (err error) {
+	n := 0
+	r.setStatus("syncing to " + d.url)
+	defer func() {
+		if err != nil {
+			r.setStatus("sync to " + d.url + " failed")
+		} else {
+			r.setStatus("did sync to " + d.url)
+		}
+	}()
+	return try(*retries, *backoff, r.countAttempts("push", func() error {
+		n++
+		if n > 1 {
+			r.setStatus(fmt.Sprintf("syncing to %s, attempt %d", d.url, n))
+		}
+		r.setStatus("sync: fetching local refs")
+		local, err := r.getLocalRefs() // ref -> hash to push
+		if err != nil {
+			r.logf("failed to get local refs: %v", err)
+			return err
+		}
+		r.setStatus(fmt.Sprintf("sync: got %d local refs", len(local)))
+
+		r.setStatus("sync: fetching remote refs")
+		remote, err := r.getRemoteRefs(d.remote)
+		if err != nil {
+			r.logf("failed to get remote refs of %s: %v", d.remote, err)
+			return err
+		}
+		r.setStatus(fmt.Sprintf("sync: got %d remote refs", len(remote)))
+
+		// If a previous push was interrupted, resume it: push only
+		// the refs it left pending, and only those still at the
+		// hash it was pushing. The rest are left to the next push.
+		var pending map[string]string
+		if *pushState {
+			pending, err = r.loadPushState(d.remote)
+			if err != nil {
+				r.logf("ignoring unreadable push state: %v", err)
 			}
-			// If we've already seen this commit,
-			// only store the master one in r.commits.
-			if _, ok := r.commits[c.Hash]; ok {
-				nDups++
-				if name != master {
-					nDrops++
-					continue
+			if len(pending) > 0 {
+				r.setStatus(fmt.Sprintf("sync: resuming %d refs pending from previous push", len(pending)))
+				r.logf("resuming push of %d pending refs", len(pending))
+				for ref, hash := range pending {
+					if local[ref] != hash {
+						r.logf("dropping pending ref %s: no longer at %s locally", ref, hash)
+					}
 				}
 			}
-			c.Branch = name
-			r.commits[c.Hash] = c
-			added = append(added, c)
-		}
-
-		if nDups > 0 {
-			r.logf("saw %v duplicate commits; dropped %v of them", nDups, nDrops)
 		}
 
-		// Link added commits.
-		for _, c := range added {
-			if c.Parent == "" {
-				// This is the initial commit; no parent.
-				r.logf("no parents for initial commit %v", c)
+		var pushRefs []string
+		for ref, hash := range local {
+			if !mirrorRefs.allows(ref) {
 				continue
 			}
-			// Find parent commit.
-			p, ok := r.commits[c.Parent]
-			if !ok {
-				return fmt.Errorf("can't find parent %q for %v", c.Parent, c)
+			if len(pending) > 0 && pending[ref] != hash {
+				continue
 			}
-			// Link parent Commit.
-			c.parent = p
-			// Link child Commits.
-			p.children = append(p.children, c)
+			if blockedCommits[hash] {
+				// Best effort: this won't stop the commit from
+				// being pushed if it's reachable from another ref.
+				r.logf("not mirroring ref %s at blocked commit %s", ref, hash)
+				continue
+			}
+			rh, ok := remote[ref]
+			if rh == hash {
+				continue
+			}
+			if ok && !r.isAncestor(rh, hash) {
+				msg := fmt.Sprintf("non-fast-forward update of %s on mirror from %s to %s", ref, rh, hash)
+				if !*allowForce {
+					r.logf("refusing %s; use -watcher.allowForcePush to allow", msg)
+					r.setStatus("refused " + msg)
+					continue
+				}
+				r.logf("warning: force-pushing %s", msg)
+				r.setStatus("warning: force-pushing " + msg)
+			}
+			pushRefs = append(pushRefs, ref)
 		}
-
-		// Update branch head, or add newly discovered branch.
-		head := log[0]
-		if b != nil {
-			// Known branch; update head.
-			b.Head = head
-			r.logf("updated branch head: %v", b)
-		} else {
-			// It's a new branch; add it.
-			seen, err := r.lastSeen(head.Hash)
+		// Push branch heads and tags first, so that they reach the
+		// mirror in the first batch even if a later one fails.
+		sort.Sort(refByPriority(pushRefs))
+		if len(pushRefs) == 0 {
+			if len(pending) > 0 {
+				r.removePushState(d.remote)
+			}
+			r.setStatus("nothing to sync")
+			return nil
+		}
+		if *mirrorDry {
+			r.dryRunPush(d, pushRefs, local)
+			return nil
+		}
+		pushed := append([]string(nil), pushRefs...)
+		for len(pushRefs) > 0 {
+			if *pushState {
+				if err := r.savePushState(d.remote, pushRefs, local); err != nil {
+					r.logf("failed to save push state: %v", err)
+				}
+			}
+			r.setStatus(fmt.Sprintf("%d refs to push; pushing batch", len(pushRefs)))
+			r.logf("%d refs remain to sync to %s", len(pushRefs), d.url)
+			args := []string{"push", "-f", d.remote}
+			n := 0
+			for _, ref := range pushRefs {
+				args = append(args, "+"+local[ref]+":"+ref)
+				n++
+				if n == *pushBatch {
+					break
+				}
+			}
+			pushRefs = pushRefs[n:]
+			ctx, cancel := context.WithTimeout(context.Background(), *gitTimeout)
+			var out bytes.Buffer
+			cmd := exec.Command("git", args...)
+			cmd.Dir = r.root
+			cmd.Stdout = &out
+			cmd.Stderr = os.Stderr
+			err := runCmd(ctx, cmd)
+			cancel()
 			if err != nil {
+				r.logf("git push failed, running git %s: %s", args, out.Bytes())
+				r.setStatus("git push failure")
 				return err
 			}
-			b = &Branch{Name: name, Head: head, LastSeen: seen}
-			r.branches[name] = b
-			r.logf("found branch: %v", b)
 		}
+		if *verifyPush {
+			if err := r.verifyPushed(d, pushed, local); err != nil {
+				return err
+			}
+		}
+		if *pushState {
+			r.removePushState(d.remote)
+		}
+		r.setStatus("sync complete")
+		return nil
+	}))
+}
+
+// dryRunPush logs the git pushes pushTo would run to push refs to d,
+// setting each to its hash in local, for -watcher.mirror.dryrun.
+func (r *Repo) dryRunPush(d mirrorDest, refs []string, local map[string]string) {
+	total := len(refs)
+	nBatches := (total + *pushBatch - 1) / *pushBatch
+	for i := 0; len(refs) > 0; i++ {
+		n := len(refs)
+		if n > *pushBatch {
+			n = *pushBatch
+		}
+		var specs []string
+		for _, ref := range refs[:n] {
+			specs = append(specs, "+"+local[ref]+":"+ref)
+		}
+		refs = refs[n:]
+		r.logf("dry run: batch %d of %d to %s: would run git push -f %s %s", i+1, nBatches, d.url, d.remote, strings.Join(specs, " "))
 	}
+	r.setStatus(fmt.Sprintf("dry run: would push %d refs to %s", total, d.url))
+}
 
+// verifyPushed checks that each of the given refs is at the hash in
+// want on the destination d, which they were just pushed to,
+// reporting any that aren't.
+func (r *Repo) verifyPushed(d mirrorDest, refs []string, want map[string]string) error {
+	r.setStatus("sync: verifying pushed refs")
+	remote, err := r.getRemoteRefs(d.remote)
+	if err != nil {
+		return fmt.Errorf("verifying push to %s: %v", d.url, err)
+	}
+	var bad []string
+	for _, ref := range refs {
+		if got := remote[ref]; got != want[ref] {
+			if got == "" {
+				got = "missing"
+			}
+			bad = append(bad, fmt.Sprintf("%s is %s, want %s", ref, got, want[ref]))
+		}
+	}
+	if len(bad) > 0 {
+		r.logf("push to %s not reflected on mirror: %s", d.url, strings.Join(bad, "; "))
+		r.setStatus(fmt.Sprintf("push verification failed: %d of %d pushed refs differ on %s", len(bad), len(refs), d.url))
+		return fmt.Errorf("%d of %d pushed refs differ on %s", len(bad), len(refs), d.url)
+	}
+	r.setStatus(fmt.Sprintf("verified %d pushed refs on %s", len(refs), d.url))
 	return nil
 }
 
-// lastSeen finds the most recent commit the dashboard has seen,
-// starting at the specified head. If the dashboard hasn't seen
-// any of the commits from head to the beginning, it returns nil.
-func (r *Repo) lastSeen(head string) (*Commit, error) {
-	h, ok := r.commits[head]
-	if !ok {
-		return nil, fmt.Errorf("lastSeen: can't find %q in commits", head)
+// isAncestor reports whether commit a is an ancestor of (or the
+// same as) commit b. It returns false if either is unknown locally.
+func (r *Repo) isAncestor(a, b string) bool {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", a, b)
+	cmd.Dir = r.root
+	return cmd.Run() == nil
+}
+
+// pushStateFile returns the name of the file recording the refs
+// that remain to be pushed to the named destination remote. It lives
+// in the git directory so that it is discarded along with a re-cloned
+// repo.
+func (r *Repo) pushStateFile(remote string) string {
+	if remote == "dest" {
+		return filepath.Join(r.root, "watcher-push-state.json")
 	}
+	return filepath.Join(r.root, "watcher-push-state-"+remote+".json")
+}
 
-	var s []*Commit
-	for c := h; c != nil; c = c.parent {
-		s = append(s, c)
+// savePushState records the refs (and the hashes they should be
+// pushed at) that remain to be pushed to the named destination remote.
+func (r *Repo) savePushState(remote string, refs []string, hash map[string]string) error {
+	pending := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		pending[ref] = hash[ref]
 	}
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	tmp := r.pushStateFile(remote) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.pushStateFile(remote))
+}
 
-	var err error
-	i := sort.Search(len(s), func(i int) bool {
-		if err != nil {
+// removePushState removes the record of the refs pending a push to
+// the named destination remote, once none remain.
+func (r *Repo) removePushState(remote string) {
+	if err := os.Remove(r.pushStateFile(remote)); err != nil && !os.IsNotExist(err) {
+		r.logf("failed to remove push state: %v", err)
+	}
+}
+
+// loadPushState returns the refs left pending by a previous push to
+// the named destination remote that did not complete, keyed by ref
+// name. It returns a nil map if there is no such push.
+func (r *Repo) loadPushState(remote string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(r.pushStateFile(remote))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending map[string]string
+	if err := json.Unmarshal(b, &pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (r *Repo) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/debug/watcher/") {
+		r.serveStatus(w, req)
+		return
+	}
+	rev := req.FormValue("rev")
+	if rev == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !r.validRev(rev) {
+		http.Error(w, "invalid rev "+strconv.Quote(rev), http.StatusBadRequest)
+		return
+	}
+	format := req.FormValue("format")
+	switch format {
+	case "", "tgz", "tar", "zip":
+	default:
+		http.Error(w, "unsupported archive format "+format, http.StatusBadRequest)
+		return
+	}
+	level := req.FormValue("level")
+	if level != "" {
+		if len(level) != 1 || level[0] < '0' || level[0] > '9' {
+			http.Error(w, "invalid compression level "+level+"; want 0-9", http.StatusBadRequest)
+			return
+		}
+		if format == "tar" {
+			http.Error(w, "compression level not supported for tar archives", http.StatusBadRequest)
+			return
+		}
+	}
+	if !r.archiveAllowed(rev) {
+		http.Error(w, "archives of "+rev+" are not allowed", http.StatusForbidden)
+		return
+	}
+	switch format {
+	case "tar":
+		r.serveTar(w, req, rev)
+		return
+	case "zip":
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", r.name()+"-"+path.Base(rev)+".zip"))
+		r.serveGitArchive(w, rev, "zip", level, "application/zip", false)
+		return
+	}
+	if level == "" && r.serveWorktreeArchive(w, rev) {
+		return
+	}
+	r.serveGitArchive(w, rev, "tgz", level, "application/x-compressed", false)
+}
+
+// An archiveKey identifies one variant of a cached archive.
+// Each format and compression level of a rev is cached separately,
+// so a request for one never gets another's bytes.
+type archiveKey struct {
+	repo, rev, format, level string
+}
+
+func (k archiveKey) String() string {
+	return k.repo + " " + k.format + " " + k.level + " " + k.rev
+}
+
+// isCommitHash reports whether s is a full commit hash.
+// Only archives of hashes are cached; branch and tag names move.
+func isCommitHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
 			return false
 		}
-		ok, err = r.dashSeen(s[i].Hash)
-		return ok
-	})
-	switch {
-	case err != nil:
-		return nil, fmt.Errorf("lastSeen: %v", err)
-	case i < len(s):
-		return s[i], nil
-	default:
-		// Dashboard saw no commits.
-		return nil, nil
 	}
+	return true
 }
 
-// dashSeen reports whether the build dashboard knows the specified commit.
-func (r *Repo) dashSeen(hash string) (bool, error) {
-	if !*network {
-		return networkSeen[hash], nil
+// validRev reports whether rev, from an archive request, is safe to
+// pass to git: either a full commit hash, or the full or short name
+// of an existing branch or tag (such as "refs/heads/master", "master",
+// "refs/tags/go1.10" or "go1.10"). Anything else, such as an option,
+// a revision expression like "HEAD~2", "master:path" or "a..b", or
+// some other kind of ref, is rejected.
+func (r *Repo) validRev(rev string) bool {
+	if isCommitHash(rev) {
+		return true
 	}
-	v := url.Values{"hash": {hash}, "packagePath": {r.path}}
-	u := *dashFlag + "commit?" + v.Encode()
-	resp, err := http.Get(u)
-	if err != nil {
-		return false, err
+	if rev == "" || rev[0] == '-' || rev[0] == '/' || rev[len(rev)-1] == '/' ||
+		strings.Contains(rev, "..") || strings.Contains(rev, "//") {
+		return false
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return false, fmt.Errorf("status: %v", resp.Status)
+	for _, c := range rev {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '_', c == '-', c == '/':
+		default:
+			return false
+		}
 	}
-	var s struct {
-		Error string
+	refs := []string{"refs/heads/" + rev, "refs/tags/" + rev}
+	if strings.HasPrefix(rev, "refs/") {
+		if !strings.HasPrefix(rev, "refs/heads/") && !strings.HasPrefix(rev, "refs/tags/") {
+			return false
+		}
+		refs = []string{rev}
 	}
-	err = json.NewDecoder(resp.Body).Decode(&s)
+	for _, ref := range refs {
+		cmd := exec.Command("git", "show-ref", "--verify", "--quiet", ref)
+		cmd.Dir = r.root
+		if cmd.Run() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// serveGitArchive streams the output of "git archive --format=format rev"
+// to w with the given Content-Type, gzip-encoding it if gzipEncoding is set.
+// If level is non-empty, it is passed to git archive as the compression level.
+// The archive's length isn't known up front, so no Content-Length is sent.
+// If git archive fails before producing any output (for instance, because
+// rev doesn't exist), an error status is sent instead.
+//
+// If rev is a commit hash, the archive is instead read in full by
+// serveBufferedArchive, so that concurrent requests for it can share one
+// git archive run and, if the archive cache is enabled, later requests
+// are served from the cache.
+func (r *Repo) serveGitArchive(w http.ResponseWriter, rev, format, level, contentType string, gzipEncoding bool) {
+	w.Header().Set("X-Watcher-Archive", "git-archive")
+	args := []string{"archive", "--format=" + format}
+	if level != "" {
+		args = append(args, "-"+level)
+	}
+	args = append(args, "--", rev)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.root
+	if isCommitHash(rev) {
+		r.serveBufferedArchive(w, cmd, archiveKey{r.name(), rev, format, level}, contentType, gzipEncoding)
+		return
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return false, err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	switch s.Error {
-	case "":
-		// Found one.
-		return true, nil
-	case "Commit not found":
-		// Commit not found, keep looking for earlier commits.
-		return false, nil
-	default:
-		return false, fmt.Errorf("dashboard: %v", s.Error)
+	if err := cmd.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	br := bufio.NewReader(stdout)
+	if _, err := br.Peek(1); err != nil {
+		err = cmd.Wait()
+		http.Error(w, fmt.Sprintf("git archive %s: %v\n%s", rev, err, stderr.Bytes()), http.StatusInternalServerError)
+		return
+	}
+	if err := r.writeArchive(w, br, rev, contentType, gzipEncoding); err != nil {
+		cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil {
+		// Too late to send an error status; the archive is truncated.
+		r.logf("git archive %s: %v\n%s", rev, err, stderr.Bytes())
+	}
+}
+
+// A cachedArchive is an archive in the archive cache.
+type cachedArchive struct {
+	data    []byte
+	expires time.Time // zero if never
+}
+
+// An archiveLRU is an LRU cache of archives, holding at most
+// maxBytes of them in total.
+type archiveLRU struct {
+	maxBytes int64
+
+	mu    sync.Mutex // guards size, keeping it in step with cache
+	cache *lru.Cache // of archiveKey to *cachedArchive
+	size  int64      // total bytes of the archives in cache
+}
+
+func newArchiveLRU(maxBytes int64) *archiveLRU {
+	// Archives are evicted by size before the
+	// lru.Cache's own entry limit is ever reached.
+	return &archiveLRU{maxBytes: maxBytes, cache: lru.New(math.MaxInt32)}
+}
+
+// get returns the archive cached for key, if any.
+func (c *archiveLRU) get(key archiveKey) (*cachedArchive, bool) {
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*cachedArchive), true
+}
+
+// add caches ca for key, evicting the least recently used archives
+// to make room for it. An archive bigger than maxBytes isn't cached.
+func (c *archiveLRU) add(key archiveKey, ca *cachedArchive) {
+	n := int64(len(ca.data))
+	if n > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.cache.Get(key); ok {
+		c.size -= int64(len(old.(*cachedArchive).data))
+	}
+	c.cache.Add(key, ca)
+	c.size += n
+	for c.size > c.maxBytes {
+		_, v := c.cache.RemoveOldest()
+		c.size -= int64(len(v.(*cachedArchive).data))
+	}
+}
+
+// len returns the number of cached archives.
+func (c *archiveLRU) len() int {
+	return c.cache.Len()
+}
+
+// serveBufferedArchive serves the archive identified by key from the
+// archive cache, if enabled, first running cmd to create (and cache)
+// it if needed (or if the cached archive has expired; see
+// -watcher.archivecachettl). The X-Watcher-Cache header reports
+// whether the cache was hit.
+//
+// Concurrent requests for the same archive, as when many builders
+// start on a new commit at once, share a single run of cmd through
+// archiveGroup; the X-Watcher-Shared header is set on the responses of
+// such requests. Sharing means buffering: the whole archive is held in
+// memory until every waiter has been sent it, and no bytes go out
+// before git archive finishes. The alternative, streaming each request
+// from its own git archive as serveGitArchive does for branch and tag
+// names, needs only constant memory per request but runs one git
+// process per request; for hashes, whose archives can be cached too,
+// one run per rev is the better trade.
+func (r *Repo) serveBufferedArchive(w http.ResponseWriter, cmd *exec.Cmd, key archiveKey, contentType string, gzipEncoding bool) {
+	var b []byte
+	if archiveCache != nil {
+		if ca, ok := archiveCache.get(key); ok {
+			if ca.expires.IsZero() || watcherNow().Before(ca.expires) {
+				b = ca.data
+			}
+		}
+	}
+	if b != nil {
+		w.Header().Set("X-Watcher-Cache", "hit")
+	} else {
+		if archiveCache != nil {
+			w.Header().Set("X-Watcher-Cache", "miss")
+		}
+		v, err, shared := archiveGroup.Do(key.String(), func() (interface{}, error) {
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				return nil, fmt.Errorf("git archive %s: %v\n%s", key.rev, err, stderr.Bytes())
+			}
+			if archiveCache != nil {
+				ca := &cachedArchive{data: out}
+				if *archiveTTL > 0 {
+					ca.expires = watcherNow().Add(*archiveTTL)
+				}
+				archiveCache.add(key, ca)
+			}
+			return out, nil
+		})
+		if shared {
+			w.Header().Set("X-Watcher-Shared", "true")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b = v.([]byte)
 	}
+	r.writeArchive(w, bytes.NewReader(b), key.rev, contentType, gzipEncoding)
 }
 
-// mergeBase returns the hash of the merge base for revspecs a and b.
-func (r *Repo) mergeBase(a, b string) (string, error) {
-	cmd := exec.Command("git", "merge-base", a, b)
-	cmd.Dir = r.root
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("git merge-base %s..%s: %v", a, b, err)
+// writeArchive copies the archive of rev from src to w with the given
+// Content-Type, gzip-encoding it if gzipEncoding is set. It logs and
+// returns any error writing to w.
+func (r *Repo) writeArchive(w http.ResponseWriter, src io.Reader, rev, contentType string, gzipEncoding bool) error {
+	w.Header().Set("Content-Type", contentType)
+	var dst io.Writer = w
+	var zw *gzip.Writer
+	if gzipEncoding {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw = gzip.NewWriter(w)
+		dst = zw
 	}
-	return string(bytes.TrimSpace(out)), nil
+	if _, err := io.Copy(dst, src); err != nil {
+		// Most likely the client went away.
+		r.logf("sending archive of %s: %v", rev, err)
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
 }
 
-// remotes returns a slice of remote branches known to the git repo.
-// It always puts "origin/master" first.
-func (r *Repo) remotes() ([]string, error) {
-	if *branches != "" {
-		return strings.Split(*branches, ","), nil
+// serveTar serves an uncompressed tar archive of rev. If the client
+// accepts gzip, the response is gzip-compressed with a
+// Content-Encoding header, leaving the archive format itself unchanged.
+func (r *Repo) serveTar(w http.ResponseWriter, req *http.Request, rev string) {
+	w.Header().Set("Vary", "Accept-Encoding")
+	r.serveGitArchive(w, rev, "tar", "", "application/x-tar", acceptsGzip(req))
+}
+
+// acceptsGzip reports whether req's Accept-Encoding header
+// allows a gzip-encoded response.
+func acceptsGzip(req *http.Request) bool {
+	for _, v := range req.Header["Accept-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			enc = strings.TrimSpace(enc)
+			q := ""
+			if i := strings.Index(enc, ";"); i >= 0 {
+				enc, q = strings.TrimSpace(enc[:i]), strings.Replace(enc[i+1:], " ", "", -1)
+			}
+			if (enc == "gzip" || enc == "*") && q != "q=0" && q != "q=0.0" {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	cmd := exec.Command("git", "branch")
-	cmd.Dir = r.root
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("git branch: %v", err)
+// serveArchives reports whether the archive endpoint
+// is enabled for the named repo, per -watcher.archiveRepos.
+func serveArchives(name string) bool {
+	if *archiveRepos == "" {
+		return true
 	}
-	bs := []string{master}
-	for _, b := range strings.Split(string(out), "\n") {
-		b = strings.TrimPrefix(b, "* ")
-		b = strings.TrimSpace(b)
-		// Ignore aliases, blank lines, and master (it's already in bs).
-		if b == "" || strings.Contains(b, "->") || b == master {
-			continue
-		}
-		// Ignore pre-go1 release branches; they are just noise.
-		if strings.HasPrefix(b, "release-branch.r") {
-			continue
+	for _, n := range strings.Split(*archiveRepos, ",") {
+		if strings.TrimSpace(n) == name {
+			return true
 		}
-		bs = append(bs, b)
 	}
-	return bs, nil
+	return false
 }
 
-const logFormat = `--format=format:` + logBoundary + `%H
-%P
-%an <%ae>
-%cD
-%B
-` + fileBoundary
+// archiveRevKinds holds the kinds of refs ("heads", "tags") whose
+// archives may be served, or nil to serve any rev.
+// See -watcher.archiveRevs.
+var archiveRevKinds map[string]bool
 
-const logBoundary = `_-_- magic boundary -_-_`
-const fileBoundary = `_-_- file boundary -_-_`
+// parseArchiveRevs parses the -watcher.archiveRevs flag value.
+func parseArchiveRevs(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	kinds := make(map[string]bool)
+	for _, k := range strings.Split(s, ",") {
+		switch k = strings.TrimSpace(k); k {
+		case "heads", "tags":
+			kinds[k] = true
+		default:
+			return nil, fmt.Errorf("invalid -watcher.archiveRevs kind %q; want heads or tags", k)
+		}
+	}
+	return kinds, nil
+}
 
-// log runs "git log" with the supplied arguments
-// and parses the output into Commit values.
-func (r *Repo) log(dir string, args ...string) ([]*Commit, error) {
-	args = append([]string{"log", "--date=rfc", "--name-only", "--parents", logFormat}, args...)
-	if r.path == "" && *filter != "" {
-		paths := strings.Split(*filter, ",")
-		args = append(args, "--")
-		args = append(args, paths...)
+// archiveAllowed reports whether ServeHTTP may serve an archive of rev,
+// according to archiveRevKinds. An allowed rev is the short or full
+// name of an existing branch or tag of an allowed kind.
+func (r *Repo) archiveAllowed(rev string) bool {
+	if archiveRevKinds == nil {
+		return true
 	}
-	cmd := exec.Command("git", args...)
+	if strings.HasPrefix(rev, "-") {
+		return false
+	}
+	for kind := range archiveRevKinds {
+		prefix := "refs/" + kind + "/"
+		ref := rev
+		if !strings.HasPrefix(ref, prefix) {
+			ref = prefix + rev
+		}
+		cmd := exec.Command("git", "show-ref", "--verify", "--quiet", ref)
+		cmd.Dir = r.root
+		if cmd.Run() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// worktreeDir returns the directory of r's worktree.
+// See -watcher.worktree.
+func (r *Repo) worktreeDir() string {
+	return r.root + ".worktree"
+}
+
+// updateWorktree checks out the head of the default branch
+// in r's worktree, creating the worktree if necessary.
+// Failures are logged; archives are then served by git archive.
+func (r *Repo) updateWorktree() {
+	cmd := exec.Command("git", "rev-parse", "refs/heads/"+r.defaultBranch)
 	cmd.Dir = r.root
-	out, err := cmd.CombinedOutput()
+	out, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("git %v: %v\n%s", strings.Join(args, " "), err, out)
+		r.logf("worktree: resolving %s: %v", r.defaultBranch, err)
+		return
 	}
+	rev := string(bytes.TrimSpace(out))
 
-	// We have a commit with description that contains 0x1b byte.
-	// Mercurial does not escape it, but xml.Unmarshal does not accept it.
-	// TODO(adg): do we still need to scrub this? Probably.
-	out = bytes.Replace(out, []byte{0x1b}, []byte{'?'}, -1)
+	r.wtMu.Lock()
+	defer r.wtMu.Unlock()
+	if rev == r.wtRev {
+		return
+	}
+	r.wtRev = ""
+	r.wtArchive = nil
+	dir := r.worktreeDir()
+	var args []string
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		args = []string{"-C", dir, "checkout", "-q", "--force", "--detach", rev}
+	} else {
+		os.RemoveAll(dir)
+		prune := exec.Command("git", "worktree", "prune")
+		prune.Dir = r.root
+		prune.Run()
+		args = []string{"worktree", "add", "--force", "--detach", dir, rev}
+	}
+	cmd = exec.Command("git", args...)
+	cmd.Dir = r.root
+	if out, err := cmd.CombinedOutput(); err != nil {
+		r.logf("worktree: git %s: %v\n%s", strings.Join(args, " "), err, out)
+		return
+	}
+	r.wtRev = rev
+	r.setStatus("checked out " + rev + " in worktree")
+}
 
-	var cs []*Commit
-	for _, text := range strings.Split(string(out), logBoundary) {
-		text = strings.TrimSpace(text)
-		if text == "" {
-			continue
-		}
-		p := strings.SplitN(text, "\n", 5)
-		if len(p) != 5 {
-			return nil, fmt.Errorf("git log %v: malformed commit: %q", strings.Join(args, " "), text)
+// serveWorktreeArchive serves a tgz archive of r's worktree if it has
+// rev checked out, and reports whether it did.
+//
+// The archive is built once per checkout, with wtMu held, and sent
+// after releasing it, so that a slow client can't hold up
+// updateWorktree (and with it, the Watch loop).
+func (r *Repo) serveWorktreeArchive(w http.ResponseWriter, rev string) bool {
+	r.wtMu.Lock()
+	if r.wtRev == "" || rev != r.wtRev {
+		r.wtMu.Unlock()
+		return false
+	}
+	if r.wtArchive == nil {
+		b, err := tgzDir(r.worktreeDir())
+		if err != nil {
+			r.wtMu.Unlock()
+			r.logf("worktree: archiving %s: %v", rev, err)
+			return false
 		}
+		r.wtArchive = b
+	}
+	b := r.wtArchive
+	r.wtMu.Unlock()
 
-		// The change summary contains the change description and files
-		// modified in this commit.  There is no way to directly refer
-		// to the modified files in the log formatting string, so we look
-		// for the file boundary after the description.
-		changeSummary := p[4]
-		descAndFiles := strings.SplitN(changeSummary, fileBoundary, 2)
-		desc := strings.TrimSpace(descAndFiles[0])
-
-		// For branch merges, the list of files can still be empty
-		// because there are no changed files.
-		files := strings.Replace(strings.TrimSpace(descAndFiles[1]), "\n", " ", -1)
+	w.Header().Set("Content-Type", "application/x-compressed")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Set("X-Watcher-Archive", "worktree")
+	w.Write(b)
+	return true
+}
 
-		cs = append(cs, &Commit{
-			Hash: p[0],
-			// TODO(adg): This may break with branch merges.
-			Parent: strings.Split(p[1], " ")[0],
-			Author: p[2],
-			Date:   p[3],
-			Desc:   desc,
-			Files:  files,
-		})
+// tgzDir returns a gzip-compressed tar archive of dir, as written
+// by tarDir.
+func tgzDir(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	if err := tarDir(tw, dir); err != nil {
+		return nil, err
 	}
-	return cs, nil
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-// fetch runs "git fetch" in the repository root.
-// It tries three times, just in case it failed because of a transient error.
-func (r *Repo) fetch() (err error) {
-	n := 0
-	r.setStatus("running git fetch origin")
-	defer func() {
+// tarDir writes the regular files, directories and symlinks under
+// dir, except for git metadata, to tw.
+func tarDir(tw *tar.Writer, dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
 		if err != nil {
-			r.setStatus("git fetch failed")
-		} else {
-			r.setStatus("ran git fetch")
-		}
-	}()
-	return try(3, func() error {
-		n++
-		if n > 1 {
-			r.setStatus(fmt.Sprintf("running git fetch origin, attempt %d", n))
+			return err
 		}
-		cmd := exec.Command("git", "fetch", "origin")
-		cmd.Dir = r.root
-		if out, err := cmd.CombinedOutput(); err != nil {
-			err = fmt.Errorf("%v\n\n%s", err, out)
-			r.logf("git fetch: %v", err)
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
 			return err
 		}
-		return nil
-	})
-}
-
-// push runs "git push -f --mirror dest" in the repository root.
-// It tries three times, just in case it failed because of a transient error.
-func (r *Repo) push() (err error) {
-	n := 0
-	r.setStatus("syncing to github")
-	defer func() {
-		if err != nil {
-			r.setStatus("sync to github failed")
-		} else {
-			r.setStatus("did sync to github")
+		if fi.Name() == ".git" {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-	}()
-	return try(3, func() error {
-		n++
-		if n > 1 {
-			r.setStatus(fmt.Sprintf("syncing to github, attempt %d", n))
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil
 		}
-		r.setStatus("sync: fetching local refs")
-		local, err := r.getLocalRefs()
+		h, err := tar.FileInfoHeader(fi, link)
 		if err != nil {
-			r.logf("failed to get local refs: %v", err)
 			return err
 		}
-		r.setStatus(fmt.Sprintf("sync: got %d local refs", len(local)))
-
-		r.setStatus("sync: fetching remote refs")
-		remote, err := r.getRemoteRefs("dest")
+		h.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
 		if err != nil {
-			r.logf("failed to get local refs: %v", err)
 			return err
 		}
-		r.setStatus(fmt.Sprintf("sync: got %d remote refs", len(remote)))
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
 
-		var pushRefs []string
-		for ref, hash := range local {
-			if remote[ref] != hash {
-				pushRefs = append(pushRefs, ref)
-			}
-		}
-		sort.Sort(refByPriority(pushRefs))
-		if len(pushRefs) == 0 {
-			r.setStatus("nothing to sync")
-			return nil
+// maxAuthorsWindow bounds how far back serveAuthors counts commits.
+const maxAuthorsWindow = 366 * 24 * time.Hour
+
+// debugWorkTimeout is how long the repost and resync endpoints
+// wait for the repo's watch to get around to their work.
+const debugWorkTimeout = time.Minute
+
+// checkDebugPost reports whether req may use the endpoint named
+// what, which changes the repo or the dashboard: only POST requests
+// may, and only if -watcher.http.token is set, so that requireToken
+// checks them. Otherwise it responds with an error.
+func checkDebugPost(w http.ResponseWriter, req *http.Request, what string) bool {
+	if *httpToken == "" {
+		http.Error(w, what+" requires -watcher.http.token", http.StatusForbidden)
+		return false
+	}
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, what+" requires POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// serveRepost serves POST requests to /debug/watcher/<name>/repost,
+// which post the commit with the full hash given by the "hash"
+// parameter to the dashboard again, for when the dashboard lost it.
+// Commits are only posted if -watcher.report is set; the response
+// reports the dashboard's result. See checkDebugPost.
+func (r *Repo) serveRepost(w http.ResponseWriter, req *http.Request) {
+	if !checkDebugPost(w, req, "repost") {
+		return
+	}
+	hash := req.FormValue("hash")
+	if !isCommitHash(hash) {
+		http.Error(w, "hash parameter must be a full commit hash", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), debugWorkTimeout)
+	defer cancel()
+	var (
+		c       *Commit
+		postErr error
+	)
+	err := r.do(ctx, func() {
+		c = r.commits[hash]
+		if c != nil {
+			r.logf("reposting commit %v on request", c)
+			postErr = r.postCommit(c)
 		}
-		for len(pushRefs) > 0 {
-			r.setStatus(fmt.Sprintf("%d refs to push; pushing batch", len(pushRefs)))
-			r.logf("%d refs remain to sync to github", len(pushRefs))
-			args := []string{"push", "-f", "dest"}
-			n := 0
-			for _, ref := range pushRefs {
-				args = append(args, "+"+local[ref]+":"+ref)
-				n++
-				if n == 200 {
-					break
-				}
-			}
-			pushRefs = pushRefs[n:]
-			cmd := exec.Command("git", args...)
-			cmd.Dir = r.root
-			cmd.Stderr = os.Stderr
-			out, err := cmd.Output()
-			if err != nil {
-				r.logf("git push failed, running git %s: %s", args, out)
-				r.setStatus("git push failure")
-				return err
+	})
+	switch {
+	case err != nil:
+		http.Error(w, fmt.Sprintf("repo busy: %v", err), http.StatusServiceUnavailable)
+	case c == nil:
+		http.Error(w, fmt.Sprintf("commit %q not found among the repo's %d commits", hash, r.snapshot().Commits), http.StatusNotFound)
+	case postErr != nil:
+		http.Error(w, fmt.Sprintf("reposting %v: %v", c, postErr), http.StatusBadGateway)
+	case !*report && r.dashClient == nil:
+		fmt.Fprintf(w, "dry-run mode (-watcher.report=false); did not post %v\n", c)
+	default:
+		fmt.Fprintf(w, "reposted %v\n", c)
+	}
+}
+
+// serveResync serves POST requests to /debug/watcher/<name>/resync,
+// which rebuild r's commit graph from scratch, as at startup, for
+// when it has drifted from the git directory (say, after manual
+// repairs). Each branch's LastSeen is looked up on the dashboard
+// again. The response summarizes the graph before and after. See
+// checkDebugPost.
+func (r *Repo) serveResync(w http.ResponseWriter, req *http.Request) {
+	if !checkDebugPost(w, req, "resync") {
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), debugWorkTimeout)
+	defer cancel()
+	var (
+		before, after [2]int // commits, branches
+		resyncErr     error
+	)
+	err := r.do(ctx, func() {
+		before = [2]int{len(r.commits), len(r.branches)}
+		r.logf("resyncing commit graph on request")
+		r.resetCommits()
+		resyncErr = r.update(false)
+		after = [2]int{len(r.commits), len(r.branches)}
+	})
+	switch {
+	case err != nil:
+		http.Error(w, fmt.Sprintf("repo busy: %v", err), http.StatusServiceUnavailable)
+	case resyncErr != nil:
+		r.setStatus("resync failed")
+		http.Error(w, fmt.Sprintf("resync: %v", resyncErr), http.StatusInternalServerError)
+	default:
+		r.setStatus("resynced")
+		fmt.Fprintf(w, "resynced: %d commits on %d branches (was %d commits on %d branches)\n", after[0], after[1], before[0], before[1])
+		for _, b := range r.snapshot().Branches {
+			last := b.LastSeen
+			if last == "" {
+				last = "none"
 			}
+			fmt.Fprintf(w, "branch %s: head %s, last seen %s\n", b.Name, b.Head, last)
 		}
-		r.setStatus("sync complete")
-		return nil
-	})
+	}
 }
 
-func (r *Repo) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" && req.Method != "HEAD" {
-		w.WriteHeader(http.StatusBadRequest)
+// serveAuthors serves a JSON object mapping author email addresses to
+// the number of r's commits they authored since the time given by the
+// "since" parameter (RFC 3339 or YYYY-MM-DD; default 30 days ago).
+func (r *Repo) serveAuthors(w http.ResponseWriter, req *http.Request) {
+	now := watcherNow()
+	since := now.Add(-30 * 24 * time.Hour)
+	if v := req.FormValue("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", v)
+		}
+		if err != nil {
+			http.Error(w, "invalid since parameter; want RFC 3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	if now.Sub(since) > maxAuthorsWindow {
+		http.Error(w, fmt.Sprintf("since must be within %v of now", maxAuthorsWindow), http.StatusBadRequest)
 		return
 	}
-	if strings.HasPrefix(req.URL.Path, "/debug/watcher/") {
-		r.serveStatus(w, req)
+	counts := make(map[string]int)
+	for _, a := range r.snapshot().Authors {
+		if a.Time.Before(since) {
+			break
+		}
+		counts[a.Email]++
+	}
+	b, err := json.MarshalIndent(counts, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	rev := req.FormValue("rev")
-	if rev == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// branchJSON is the JSON served by serveBranch.
+type branchJSON struct {
+	Branch    string         `json:"branch"`
+	Head      string         `json:"head"`
+	LastSeen  string         `json:"lastSeen"`
+	Commits   []branchCommit `json:"commits"`
+	Truncated bool           `json:"truncated"`
+}
+
+// serveBranch serves, as JSON, the commits of the named branch from
+// its head back to the last one posted to the dashboard (LastSeen),
+// as of the last update: those pending posting, newest first,
+// followed by LastSeen. At most maxBranchCommits are listed.
+func (r *Repo) serveBranch(w http.ResponseWriter, name string) {
+	for _, bh := range r.snapshot().Branches {
+		if bh.Name != name {
+			continue
+		}
+		b, err := json.MarshalIndent(branchJSON{
+			Branch:    bh.Name,
+			Head:      bh.Head,
+			LastSeen:  bh.LastSeen,
+			Commits:   bh.Commits,
+			Truncated: bh.Truncated,
+		}, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
 		return
 	}
-	cmd := exec.Command("git", "archive", "--format=tgz", rev)
-	cmd.Dir = r.root
-	tgz, err := cmd.Output()
+	http.Error(w, "unknown branch "+strconv.Quote(name), http.StatusNotFound)
+}
+
+// statusJSON is the JSON form of a statusEntry.
+type statusJSON struct {
+	Time       time.Time `json:"time"`
+	AgeSeconds float64   `json:"age_seconds"`
+	Status     string    `json:"status"`
+}
+
+// wantsJSON reports whether req asks for a JSON response, with a
+// format=json parameter or an Accept header allowing application/json.
+func wantsJSON(req *http.Request) bool {
+	if req.FormValue("format") == "json" {
+		return true
+	}
+	for _, v := range req.Header["Accept"] {
+		if strings.Contains(v, "application/json") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStatusJSON serves r's status ring as a JSON array, newest first.
+func (r *Repo) serveStatusJSON(w http.ResponseWriter) {
+	now := time.Now()
+	ents := []statusJSON{}
+	r.status.foreachDesc(func(ent statusEntry) {
+		ents = append(ents, statusJSON{
+			Time:       ent.t.In(time.UTC),
+			AgeSeconds: now.Sub(ent.t).Seconds(),
+			Status:     ent.status,
+		})
+	})
+	b, err := json.MarshalIndent(ents, "", "\t")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Length", strconv.Itoa(len(tgz)))
-	w.Header().Set("Content-Type", "application/x-compressed")
-	w.Write(tgz)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
 func (r *Repo) serveStatus(w http.ResponseWriter, req *http.Request) {
+	if prefix := "/debug/watcher/" + r.name() + "/branch/"; strings.HasPrefix(req.URL.Path, prefix) {
+		r.serveBranch(w, strings.TrimPrefix(req.URL.Path, prefix))
+		return
+	}
+	if wantsJSON(req) {
+		r.serveStatusJSON(w)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html")
 	fmt.Fprintf(w, "<html><head><title>watcher: %s</title><body><h1>watcher status for repo: %q</h1>\n",
 		r.name(), r.name())
+	if n := r.snapshot().Orphans; n > 0 {
+		fmt.Fprintf(w, "<p>orphaned commits (unknown parent): %d</p>\n", n)
+	}
+	if free, err := watcherDiskFree(r.root); err == nil {
+		fmt.Fprintf(w, "<p>free disk space: %d MB</p>\n", free>>20)
+	}
+	if r.postLag.count() > 0 {
+		fmt.Fprintf(w, "<p>commit to dashboard latency: %v</p>\n", &r.postLag)
+	}
+	if r.fetchLag.count() > 0 {
+		fmt.Fprintf(w, "<p>fetch latency: %v</p>\n", &r.fetchLag)
+	}
+	if held, total := r.status.count(); total > held {
+		fmt.Fprintf(w, "<p>showing last %d of %d entries</p>\n", held, total)
+	}
 	fmt.Fprintf(w, "<pre>\n")
 	nowRound := time.Now().Round(time.Second)
 	r.status.foreachDesc(func(ent statusEntry) {
@@ -1036,10 +4741,89 @@ func (r *Repo) serveStatus(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
-func try(n int, fn func() error) error {
+// maxBackoff caps the delay between try's attempts.
+const maxBackoff = 5 * time.Minute
+
+// trySleep is time.Sleep. It is a variable for testing.
+var trySleep = time.Sleep
+
+// A rateLimitError reports that the dashboard responded with
+// 429 Too Many Requests, asking to be retried after wait.
+type rateLimitError struct {
+	wait time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by dashboard; retry after %v", e.wait)
+}
+
+// checkRateLimit returns a *rateLimitError if resp is a 429 Too Many
+// Requests response, with the wait its Retry-After header asks for.
+func checkRateLimit(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	return &rateLimitError{wait: parseRetryAfter(resp.Header.Get("Retry-After"), watcherNow())}
+}
+
+// parseRetryAfter returns the wait asked for by the value of a
+// Retry-After header, which is either a number of seconds or an
+// HTTP date, at time now. If the header is missing or malformed,
+// it returns -watcher.backoff. The wait is capped at maxBackoff.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	d := *backoff
+	if secs, err := strconv.Atoi(strings.TrimSpace(h)); err == nil && secs >= 0 {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(h); err == nil {
+		d = t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// retryRateLimited calls fn, which makes a request to the dashboard,
+// until it succeeds or fails other than by being rate limited, or
+// has been called -watcher.retries times. Before each retry it waits
+// as long as the dashboard asked.
+func (r *Repo) retryRateLimited(fn func() error) error {
+	for tries := 1; ; tries++ {
+		err := fn()
+		rl, ok := err.(*rateLimitError)
+		if !ok || tries >= *retries {
+			return err
+		}
+		r.setStatus(fmt.Sprintf("rate limited by dashboard; retrying in %v", rl.wait))
+		r.logf("rate limited by dashboard; retrying in %v", rl.wait)
+		trySleep(rl.wait)
+	}
+}
+
+// try calls fn up to n times, until it succeeds, and returns its
+// last error. Between attempts it sleeps for an exponentially
+// increasing time, starting at backoff, plus up to 50% jitter,
+// but never more than maxBackoff.
+func try(n int, backoff time.Duration, fn func() error) error {
 	var err error
+	delay := backoff
 	for tries := 0; tries < n; tries++ {
-		time.Sleep(time.Duration(tries) * 5 * time.Second) // Linear back-off.
+		if tries > 0 {
+			d := delay
+			if d > 0 {
+				d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+			}
+			if d > maxBackoff {
+				d = maxBackoff
+			}
+			trySleep(d)
+			if delay *= 2; delay > maxBackoff {
+				delay = maxBackoff
+			}
+		}
 		if err = fn(); err == nil {
 			break
 		}
@@ -1062,15 +4846,84 @@ func (b *Branch) String() string {
 type Commit struct {
 	Hash   string
 	Author string
-	Date   string // Format: "Mon, 2 Jan 2006 15:04:05 -0700"
+	Date   string // Format: commitDateFormat
 	Desc   string // Plain text, first line is a short description.
 	Parent string
 	Branch string
 	Files  string
 
+	// Changed is the number of lines the commit inserts plus the
+	// number it deletes, and LargeChange reports whether that's
+	// more than -watcher.largeChange. Both are only set with
+	// -watcher.largeChange.
+	Changed     int
+	LargeChange bool
+
+	// Parents holds the hashes of all the commit's parents.
+	// The first is the same as Parent.
+	Parents []string
+
+	// SigStatus is git's status of the commit's signature
+	// (git log's %G?): "G" for a good and valid one,
+	// "N" for none. It is only set with -watcher.verifysig.
+	// See verifyCommit.
+	SigStatus string
+
+	// Branches lists all the branches the commit has been seen on.
+	Branches []string
+
+	// OriginalBranch is the branch the commit was first seen on.
+	// It differs from Branch for commits seen on another branch
+	// before being merged to the default branch.
+	OriginalBranch string
+
 	// For walking the graph.
-	parent   *Commit
-	children []*Commit
+	parent   *Commit   // first parent
+	parents  []*Commit // all known parents, starting with parent
+	children []*Commit // commits with this one as any of their parents
+}
+
+// firstChildOf reports whether p is c's first parent, or c is the
+// initial commit (with the dummy parent used by postNewCommits).
+func (c *Commit) firstChildOf(p *Commit) bool {
+	return c.parent == p || c.parent == nil
+}
+
+// commitDateFormat is the format of Commit.Date.
+const commitDateFormat = "Mon, 2 Jan 2006 15:04:05 -0700"
+
+// commitDateLayouts are the layouts parseCommitDate accepts, in the
+// order it tries them: commitDateFormat, then the RFC 1123 variants,
+// then the formats of git's --date=default, iso and iso-strict.
+var commitDateLayouts = []string{
+	commitDateFormat,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon Jan 2 15:04:05 2006 -0700",
+	"2006-01-02 15:04:05 -0700",
+	time.RFC3339,
+}
+
+// parseCommitDate parses a Commit.Date, which should be in
+// commitDateFormat but may be in any of commitDateLayouts.
+func parseCommitDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range commitDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized commit date %q", s)
+}
+
+// authorEmail returns the email address from c.Author,
+// which has the form "Name <email>".
+func (c *Commit) authorEmail() string {
+	a := c.Author
+	if i := strings.LastIndex(a, "<"); i >= 0 {
+		a = a[i+1:]
+	}
+	return strings.TrimSuffix(a, ">")
 }
 
 func (c *Commit) String() string {
@@ -1078,27 +4931,272 @@ func (c *Commit) String() string {
 	if c.Branch != "" {
 		s += fmt.Sprintf("[%v]", c.Branch)
 	}
-	s += fmt.Sprintf("(%q)", strings.SplitN(c.Desc, "\n", 2)[0])
+	s += fmt.Sprintf("(%q)", c.Subject())
 	return s
 }
 
-// NeedsBenchmarking reports whether the Commit needs benchmarking.
-func (c *Commit) NeedsBenchmarking() bool {
+// Subject returns the first line of the commit description.
+func (c *Commit) Subject() string {
+	return strings.SplitN(c.Desc, "\n", 2)[0]
+}
+
+// Body returns the commit description after its first line, without
+// the blank line separating them, or the empty string if there is
+// only the one line.
+func (c *Commit) Body() string {
+	p := strings.SplitN(c.Desc, "\n", 2)
+	if len(p) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(p[1])
+}
+
+// addBranch records that the commit is on the named branch.
+func (c *Commit) addBranch(name string) {
+	for _, b := range c.Branches {
+		if b == name {
+			return
+		}
+	}
+	c.Branches = append(c.Branches, name)
+}
+
+// NeedsBenchmarking reports whether the Commit needs benchmarking,
+// according to the rules in bc, the repo's config. If bc is nil, the
+// repo is never benchmarked. Only commits on the repo's default branch
+// (named defaultBranch) are benchmarked.
+func (c *Commit) NeedsBenchmarking(bc *benchConfig, defaultBranch string) bool {
 	// Do not benchmark branch commits, they are usually not interesting
 	// and fall out of the trunk succession.
-	if c.Branch != master {
+	if bc == nil || c.Branch != defaultBranch {
 		return false
 	}
 	// Do not benchmark commits that do not touch source files (e.g. CONTRIBUTORS).
-	for _, f := range strings.Split(c.Files, " ") {
-		if (strings.HasPrefix(f, "include") || strings.HasPrefix(f, "src")) &&
-			!strings.HasSuffix(f, "_test.go") && !strings.Contains(f, "testdata") {
+	for _, f := range c.files() {
+		if bc.isSource(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// A benchConfig describes which files are considered source files
+// for the purpose of deciding whether a commit needs benchmarking.
+type benchConfig struct {
+	prefixes []string // path prefixes of source files
+	exts     []string // file extensions of source files (e.g. ".go"); empty means any
+	excludes []string // path.Match patterns of path elements of files that aren't source files
+
+	// exclude, if non-nil, reports whether a file isn't a
+	// source file, in place of excludes.
+	exclude func(f string) bool
+}
+
+// defaultExcludes are the exclude patterns of a benchConfig
+// whose rule doesn't list any: test files and test data.
+var defaultExcludes = []string{"*_test.go", "testdata"}
+
+// defaultBenchConfig is the main Go repo's benchConfig,
+// if -watcher.bench has no rule for it. It excludes files
+// as the watcher always has: those ending in _test.go or
+// with testdata anywhere in their path.
+var defaultBenchConfig = &benchConfig{
+	prefixes: []string{"include", "src"},
+	exclude: func(f string) bool {
+		return strings.HasSuffix(f, "_test.go") || strings.Contains(f, "testdata")
+	},
+}
+
+// isSource reports whether the named file is a source file:
+// one with a listed prefix and extension that isn't excluded.
+func (bc *benchConfig) isSource(f string) bool {
+	if bc.exclude != nil {
+		if bc.exclude(f) {
+			return false
+		}
+	} else {
+		for _, elem := range strings.Split(f, "/") {
+			for _, pat := range bc.excludes {
+				if ok, _ := path.Match(pat, elem); ok {
+					return false
+				}
+			}
+		}
+	}
+	if !hasAnyPrefix(f, bc.prefixes) {
+		return false
+	}
+	if len(bc.exts) == 0 {
+		return true
+	}
+	ext := path.Ext(f)
+	for _, e := range bc.exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBenchRules parses the -watcher.bench flag value into a map
+// of benchmarking rules keyed by repo name.
+func parseBenchRules(s string) (map[string]*benchConfig, error) {
+	m := map[string]*benchConfig{}
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		i := strings.Index(rule, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad -watcher.bench rule %q: want name=prefix,prefix[:ext,ext[:exclude,exclude]]", rule)
+		}
+		name, spec := rule[:i], rule[i+1:]
+		bc := &benchConfig{excludes: defaultExcludes}
+		prefixes, exts := spec, ""
+		if j := strings.Index(spec, ":"); j >= 0 {
+			prefixes, exts = spec[:j], spec[j+1:]
+		}
+		if j := strings.Index(exts, ":"); j >= 0 {
+			var excludes string
+			exts, excludes = exts[:j], exts[j+1:]
+			bc.excludes = splitList(excludes)
+			for _, pat := range bc.excludes {
+				if _, err := path.Match(pat, ""); err != nil {
+					return nil, fmt.Errorf("bad -watcher.bench rule %q: exclude pattern %q: %v", rule, pat, err)
+				}
+			}
+		}
+		bc.prefixes = splitList(prefixes)
+		if len(bc.prefixes) == 0 {
+			// An empty prefix matches every file.
+			bc.prefixes = []string{""}
+		}
+		for _, e := range splitList(exts) {
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			bc.exts = append(bc.exts, e)
+		}
+		m[name] = bc
+	}
+	return m, nil
+}
+
+// splitList splits a comma-separated list, ignoring empty elements.
+func splitList(s string) []string {
+	var l []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			l = append(l, f)
+		}
+	}
+	return l
+}
+
+// files returns the list of files modified by the Commit.
+func (c *Commit) files() []string {
+	return strings.Fields(c.Files)
+}
+
+// Empty reports whether the Commit changes no files, such as one
+// made with "git commit --allow-empty". Initial commits and merges
+// (which list no changed files) are not considered empty.
+func (c *Commit) Empty() bool {
+	return len(c.Parents) == 1 && len(c.files()) == 0
+}
+
+// ReleaseRelevant reports whether the Commit touches any file under
+// one of the given path prefixes, such as release notes or API files.
+func (c *Commit) ReleaseRelevant(prefixes []string) bool {
+	for _, f := range c.files() {
+		if hasAnyPrefix(f, prefixes) {
 			return true
 		}
 	}
 	return false
 }
 
+// DependencyBump reports whether the Commit only touches go.mod and
+// go.sum files (in any directory), such as a dependency update.
+func (c *Commit) DependencyBump() bool {
+	files := c.files()
+	if len(files) == 0 {
+		return false
+	}
+	for _, f := range files {
+		if base := path.Base(f); base != "go.mod" && base != "go.sum" {
+			return false
+		}
+	}
+	return true
+}
+
+// trailer returns the value of the last trailer line in the
+// commit description with the given key (e.g. "Reviewed-on"),
+// or the empty string if there is none.
+func (c *Commit) trailer(key string) string {
+	var v string
+	for _, line := range strings.Split(c.Desc, "\n") {
+		if !strings.HasPrefix(line, key+":") {
+			continue
+		}
+		v = strings.TrimSpace(line[len(key)+1:])
+	}
+	return v
+}
+
+// GerritChangeNumber returns the number of the Gerrit change that
+// the commit was reviewed in, taken from its Reviewed-on trailer
+// (e.g. "Reviewed-on: https://go-review.googlesource.com/c/go/+/12345").
+// It returns zero if the commit has no such trailer.
+func (c *Commit) GerritChangeNumber() int {
+	u := strings.TrimRight(c.trailer("Reviewed-on"), "/")
+	if u == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(u[strings.LastIndex(u, "/")+1:])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Topic returns the Gerrit topic of the change the commit was
+// reviewed in, taken from its Topic trailer (e.g. "Topic: modules"),
+// or the empty string if it has none.
+func (c *Commit) Topic() string {
+	return c.trailer("Topic")
+}
+
+// CherryPickOf returns the hash of the commit that the commit was
+// cherry-picked from, taken from the last line of its description
+// of the form "(cherry picked from commit <hash>)" (as added by
+// "git cherry-pick -x"), or the empty string if it has none.
+func (c *Commit) CherryPickOf() string {
+	const prefix, suffix = "(cherry picked from commit ", ")"
+	var h string
+	for _, line := range strings.Split(c.Desc, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, suffix) {
+			continue
+		}
+		if v := line[len(prefix) : len(line)-len(suffix)]; isCommitHash(v) {
+			h = v
+		}
+	}
+	return h
+}
+
 func homeDir() string {
 	switch runtime.GOOS {
 	case "plan9":
@@ -1109,12 +5207,30 @@ func homeDir() string {
 	return os.Getenv("HOME")
 }
 
+// readKey reads the dashboard key from the first non-blank line of
+// -watcher.key, ignoring surrounding whitespace (including the \r of
+// CRLF line endings). The key must consist of printable ASCII
+// characters other than space.
 func readKey() (string, error) {
 	c, err := ioutil.ReadFile(*keyFile)
 	if err != nil {
 		return "", err
 	}
-	return string(bytes.TrimSpace(bytes.SplitN(c, []byte("\n"), 2)[0])), nil
+	var key []byte
+	for _, line := range bytes.Split(c, []byte("\n")) {
+		if key = bytes.TrimSpace(line); len(key) > 0 {
+			break
+		}
+	}
+	if len(key) == 0 {
+		return "", fmt.Errorf("dashboard key file %s is empty", *keyFile)
+	}
+	for i, b := range key {
+		if b <= ' ' || b > '~' {
+			return "", fmt.Errorf("dashboard key in %s has invalid byte %#x at offset %d", *keyFile, b, i)
+		}
+	}
+	return string(key), nil
 }
 
 // subrepoList fetches a list of sub-repositories from the dashboard
@@ -1125,7 +5241,7 @@ func subrepoList() ([]string, error) {
 		return nil, nil
 	}
 
-	r, err := http.Get(*dashFlag + "packages?kind=subrepo")
+	r, err := watcherClient.Get(*dashFlag + "packages?kind=subrepo")
 	if err != nil {
 		return nil, fmt.Errorf("subrepo list: %v", err)
 	}
@@ -1174,102 +5290,317 @@ func repoTickler(repo string) chan bool {
 // and their current branch heads.  When this sees that one has
 // changed, it tickles the channel for that repo and wakes up its
 // poller, if its poller is in a sleep.
+//
+// Failed polls are logged and counted in the watcher_gerrit_poll_*
+// metrics, and the poll interval backs off while they keep failing.
 func pollGerritAndTickle() {
-	last := map[string]string{} // repo -> last seen hash
+	last := map[string]string{} // repo -> signature of its last seen heads
+	failures := 0
 	for {
-		for repo, hash := range gerritMetaMap() {
-			if hash != last[repo] {
-				last[repo] = hash
-				select {
-				case repoTickler(repo) <- true:
-				default:
-				}
+		meta, err := gerritMetaMap()
+		incMetric("watcher_gerrit_poll_attempts_total", "")
+		if err != nil {
+			failures++
+			incMetric("watcher_gerrit_poll_failures_total", "")
+			watcherErrorf("Polling Gerrit for branch heads (%d consecutive failures): %v", failures, err)
+		} else {
+			if failures > 0 {
+				watcherLogf("Polling Gerrit for branch heads succeeded after %d consecutive failures", failures)
 			}
+			failures = 0
+			tickleChanged(last, meta)
 		}
-		time.Sleep(*pollInterval)
+		setMetric("watcher_gerrit_poll_consecutive_failures", "", float64(failures))
+		time.Sleep(gerritPollWait(failures))
 	}
 }
 
-// gerritMetaMap returns the map from repo name (e.g. "go") to its
-// latest master hash.
-// The returned map is nil on any transient error.
-func gerritMetaMap() map[string]string {
-	res, err := http.Get(metaURL)
+// gerritPollWait returns how long pollGerritAndTickle waits before
+// polling again after the given number of consecutive failures:
+// -watcher.poll, doubled for each failure, up to maxBackoff (or
+// -watcher.poll, if that's longer).
+func gerritPollWait(failures int) time.Duration {
+	d := *pollInterval
+	for i := 0; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff && *pollInterval < maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// tickleChanged tickles the channel of each repo in meta whose
+// branch heads differ from those recorded in last, and records
+// the new heads in last.
+func tickleChanged(last map[string]string, meta map[string]map[string]string) {
+	for repo, heads := range meta {
+		sig := headsSignature(heads)
+		if sig != last[repo] {
+			last[repo] = sig
+			select {
+			case repoTickler(repo) <- true:
+			default:
+			}
+		}
+	}
+}
+
+// headsSignature returns a string summarizing heads, a map from
+// branch name to head hash, that changes when any branch moves.
+func headsSignature(heads map[string]string) string {
+	names := make([]string, 0, len(heads))
+	for b := range heads {
+		names = append(names, b)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, b := range names {
+		fmt.Fprintf(&buf, "%s %s\n", b, heads[b])
+	}
+	return buf.String()
+}
+
+// gerritMetaMap returns the map from repo name (e.g. "go") to a map
+// from the name of each watched branch (see metaBranches) to its
+// latest hash. Repos with none of the watched branches are omitted.
+func gerritMetaMap() (map[string]map[string]string, error) {
+	meta, err := gerritMeta(gerritMetaURL(metaBranches()))
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	m := map[string]map[string]string{}
+	for repo, heads := range meta {
+		if len(heads) > 0 {
+			m[repo] = heads
+		}
+	}
+	return m, nil
+}
+
+// metaBranches returns the names of the branches whose heads
+// are requested from Gerrit: master, plus the branches named by
+// -watcher.branches or, if it's empty, the branches being watched
+// in any repo.
+func metaBranches() []string {
+	bs := []string{master}
+	seen := map[string]bool{master: true}
+	add := func(b string) {
+		if !seen[b] {
+			seen[b] = true
+			bs = append(bs, b)
+		}
+	}
+	if *branches != "" {
+		for _, b := range splitList(*branches) {
+			add(b)
+		}
+		return bs
+	}
+	var watched []string
+	for _, r := range allRepos() {
+		for _, b := range r.snapshot().Branches {
+			watched = append(watched, b.Name)
+		}
+	}
+	sort.Strings(watched)
+	for _, b := range watched {
+		add(b)
+	}
+	return bs
+}
+
+// gerritMetaURL returns the URL of Gerrit's JSON description of all
+// its repos and the heads of the named branches.
+func gerritMetaURL(names []string) string {
+	u := *metaFlag
+	if u == "" {
+		u = *gerritBase + "?format=JSON"
+	}
+	for _, b := range names {
+		u += "&b=" + url.QueryEscape(b)
+	}
+	return u
+}
+
+// gerritXSSIPrefix is the line preceding Gerrit's JSON responses.
+const gerritXSSIPrefix = ")]}'"
+
+// gerritMeta fetches the JSON meta URL u, which describes every repo
+// and the requested branches, and returns a map from repo name to a
+// map from branch name to head hash. Everything is fetched in a
+// single request, regardless of the number of repos and branches.
+func gerritMeta(u string) (map[string]map[string]string, error) {
+	res, err := watcherClient.Get(u)
+	if err != nil {
+		return nil, err
 	}
 	defer res.Body.Close()
 	defer io.Copy(ioutil.Discard, res.Body) // ensure EOF for keep-alive
 	if res.StatusCode != 200 {
-		return nil
+		return nil, fmt.Errorf("fetching %v: status %v", u, res.Status)
 	}
 	var meta map[string]struct {
 		Branches map[string]string
 	}
 	br := bufio.NewReader(res.Body)
-	// For security reasons or something, this URL starts with ")]}'\n" before
-	// the JSON object. So ignore that.
-	// Shawn Pearce says it's guaranteed to always be just one line, ending in '\n'.
-	for {
-		b, err := br.ReadByte()
-		if err != nil {
-			return nil
-		}
-		if b == '\n' {
-			break
+	// To defeat XSSI attacks, Gerrit's JSON responses start with a
+	// ")]}'" line before the JSON object. Anything else means u isn't
+	// Gerrit's JSON (a login page from a proxy, say), so say so.
+	line, err := br.ReadString('\n')
+	switch {
+	case err != nil && err != io.EOF:
+		return nil, fmt.Errorf("reading %v: %v", u, err)
+	case line == "":
+		return nil, fmt.Errorf("empty response from %v", u)
+	case strings.TrimRight(line, "\r\n") != gerritXSSIPrefix:
+		if len(line) > 40 {
+			line = line[:40] + "..."
 		}
+		return nil, fmt.Errorf("response from %v doesn't start with Gerrit's %s line; got %q", u, gerritXSSIPrefix, line)
+	case err == io.EOF:
+		return nil, fmt.Errorf("response from %v has nothing after its %s line", u, gerritXSSIPrefix)
 	}
-	if err := json.NewDecoder(br).Decode(&meta); err != nil {
-		log.Printf("JSON decoding error from %v: %s", metaURL, err)
-		return nil
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", u, err)
+	}
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, fmt.Errorf("JSON decoding error from %v: %v", u, err)
 	}
-	m := map[string]string{}
+	m := map[string]map[string]string{}
+	nbranch := 0
 	for repo, v := range meta {
-		if master, ok := v.Branches["master"]; ok {
-			m[repo] = master
-		}
+		m[repo] = v.Branches
+		nbranch += len(v.Branches)
 	}
-	return m
+	// An empty result from a non-empty response most likely means
+	// Gerrit changed the shape of its JSON; say so rather than
+	// letting every repo look like it has no branches.
+	if nbranch == 0 && !isEmptyJSONObject(body) {
+		watcherLogf("warning: no branches decoded from %d-byte Gerrit meta response from %v; has its JSON format changed?", len(body), u)
+	}
+	return m, nil
+}
+
+// isEmptyJSONObject reports whether b holds nothing but an empty
+// JSON object (or whitespace).
+func isEmptyJSONObject(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return true
+	}
+	if b[0] != '{' || b[len(b)-1] != '}' {
+		return false
+	}
+	return len(bytes.TrimSpace(b[1:len(b)-1])) == 0
 }
 
 func (r *Repo) getLocalRefs() (map[string]string, error) {
 	cmd := exec.Command("git", "show-ref")
 	cmd.Dir = r.root
-	return parseRefs(cmd)
+	return parseRefs(context.Background(), cmd)
 }
 
 func (r *Repo) getRemoteRefs(dest string) (map[string]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "git", "ls-remote", dest)
+	cmd := exec.Command("git", "ls-remote", dest)
 	cmd.Dir = r.root
-	return parseRefs(cmd)
+	return parseRefs(ctx, cmd)
 }
 
-func parseRefs(cmd *exec.Cmd) (map[string]string, error) {
-	refHash := map[string]string{}
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	bs := bufio.NewScanner(out)
-	if err := cmd.Start(); err != nil {
+// parseRefs runs cmd, which lists refs in the format of "git show-ref",
+// and returns a map from ref name to hash.
+func parseRefs(ctx context.Context, cmd *exec.Cmd) (map[string]string, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := runCmd(ctx, cmd); err != nil {
 		return nil, err
 	}
+	refHash := map[string]string{}
+	bs := bufio.NewScanner(&out)
 	for bs.Scan() {
 		f := strings.Fields(bs.Text())
+		if len(f) < 2 {
+			continue
+		}
 		refHash[f[1]] = f[0]
 	}
-	if err := bs.Err(); err != nil {
-		go cmd.Wait() // prevent zombies
-		return nil, err
+	return refHash, bs.Err()
+}
+
+// mirrorRefs holds the parsed -watcher.mirror.refglobs.
+var mirrorRefs = refFilter{exclude: []string{"refs/changes/*"}}
+
+// A refFilter decides which refs are mirrored, by globs of ref names.
+type refFilter struct {
+	include []string // if non-empty, only refs matching one of these
+	exclude []string // never refs matching one of these
+}
+
+// parseRefGlobs parses the -watcher.mirror.refglobs flag value.
+func parseRefGlobs(s string) (refFilter, error) {
+	var f refFilter
+	for _, g := range splitList(s) {
+		exclude := strings.HasPrefix(g, "!")
+		g = strings.TrimPrefix(g, "!")
+		if !strings.HasPrefix(g, "refs/") {
+			return refFilter{}, fmt.Errorf("invalid -watcher.mirror.refglobs glob %q; must start with refs/", g)
+		}
+		if _, err := path.Match(g, ""); err != nil {
+			return refFilter{}, fmt.Errorf("invalid -watcher.mirror.refglobs glob %q: %v", g, err)
+		}
+		if exclude {
+			f.exclude = append(f.exclude, g)
+		} else {
+			f.include = append(f.include, g)
+		}
 	}
-	if err := cmd.Wait(); err != nil {
-		return nil, err
+	return f, nil
+}
+
+// allows reports whether f lets ref be mirrored.
+func (f refFilter) allows(ref string) bool {
+	for _, g := range f.exclude {
+		if refGlobMatch(g, ref) {
+			return false
+		}
 	}
-	return refHash, bs.Err()
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, g := range f.include {
+		if refGlobMatch(g, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// refGlobMatch reports whether ref matches glob. A glob ending
+// in "/*" matches all refs under its prefix, however deep;
+// other globs are matched by path.Match.
+func refGlobMatch(glob, ref string) bool {
+	if !strings.HasSuffix(glob, "/*") {
+		ok, _ := path.Match(glob, ref)
+		return ok
+	}
+	dir := strings.TrimSuffix(glob, "/*")
+	n := strings.Count(dir, "/") + 1
+	elems := strings.SplitN(ref, "/", n+1)
+	if len(elems) <= n {
+		return false
+	}
+	ok, _ := path.Match(dir, strings.Join(elems[:n], "/"))
+	return ok
 }
 
+// refByPriority sorts refs by the priority of their type (see
+// priority), then by name. pushTo pushes refs in this order, in
+// batches of -watcher.pushbatch, so the first batch carries the
+// branch heads and tags and a failure partway through a push of many
+// refs/changes/* refs still propagates them.
 type refByPriority []string
 
 func (s refByPriority) Len() int      { return len(s) }
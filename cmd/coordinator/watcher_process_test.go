@@ -0,0 +1,5091 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// gitFixture is a local git repository used to exercise the watcher.
+type gitFixture struct {
+	t   *testing.T
+	dir string
+	n   int // number of commits made, for unique file contents
+}
+
+func newGitFixture(t *testing.T) *gitFixture {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in $PATH")
+	}
+	dir, err := ioutil.TempDir("", "watcher-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &gitFixture{t: t, dir: dir}
+	f.git("init", "-q")
+	f.git("checkout", "-q", "-b", master)
+	f.git("config", "user.name", "Gopher")
+	f.git("config", "user.email", "gopher@golang.org")
+	return f
+}
+
+// newBareGitDir returns a new, empty bare git repository,
+// suitable for use as a mirror destination.
+func newBareGitDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "watcher-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("git", "init", "-q", "--bare", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init --bare: %v\n%s", err, out)
+	}
+	return dir
+}
+
+func (f *gitFixture) cleanup() { os.RemoveAll(f.dir) }
+
+// git runs git with the given arguments in the fixture directory
+// and returns its trimmed output.
+func (f *gitFixture) git(args ...string) string {
+	f.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = f.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		f.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes a new version of file and commits it with the
+// given message, returning the new commit hash.
+func (f *gitFixture) commit(file, msg string) string {
+	f.t.Helper()
+	f.n++
+	name := filepath.Join(f.dir, file)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(fmt.Sprintf("version %d\n", f.n)), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+	f.git("add", file)
+	f.git("commit", "-q", "-m", msg)
+	return f.git("rev-parse", "HEAD")
+}
+
+// repo returns a Repo watching the fixture, as a subrepo named
+// after the fixture directory.
+func (f *gitFixture) repo() *Repo {
+	return &Repo{
+		root:     f.dir,
+		path:     "golang.org/x/" + filepath.Base(f.dir),
+		commits:  make(map[string]*Commit),
+		branches: make(map[string]*Branch),
+		dash:     true,
+		status:   newStatusRing(50),
+
+		defaultBranch: master,
+	}
+}
+
+// newRepo returns a Repo made by NewRepo from the fixture's git
+// directory as is, without cloning it, talking to the dashboard dc.
+func (f *gitFixture) newRepo(dc dashboardClient) *Repo {
+	f.t.Helper()
+	r, err := NewRepo(os.TempDir(), "", nil, "golang.org/x/"+filepath.Base(f.dir), true, repoOptions{gitDir: f.dir, dash: dc})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { unregisterRepo(r) })
+	return r
+}
+
+// fakeDashClient is a dashboardClient that records the commits
+// posted to it, which it has then seen.
+type fakeDashClient struct {
+	seen   map[string]bool // hashes of the commits the dashboard knows
+	posted []string        // hashes of the commits posted, in order
+
+	// postErr, if non-nil, is returned by PostCommit
+	// in place of posting the commit.
+	postErr error
+}
+
+func (d *fakeDashClient) PostCommit(method, endpoint string, body interface{}) error {
+	dc, ok := body.(*dashCommit)
+	if !ok {
+		return fmt.Errorf("posted a %T; want *dashCommit", body)
+	}
+	if d.postErr != nil {
+		return d.postErr
+	}
+	if d.seen[dc.Hash] {
+		return fmt.Errorf("posted %s twice", dc.Hash)
+	}
+	if dc.ParentHash != "" && !d.seen[dc.ParentHash] {
+		return fmt.Errorf("posted %s before its parent %s", dc.Hash, dc.ParentHash)
+	}
+	if d.seen == nil {
+		d.seen = make(map[string]bool)
+	}
+	d.seen[dc.Hash] = true
+	d.posted = append(d.posted, dc.Hash)
+	return nil
+}
+
+func (d *fakeDashClient) CommitSeen(hash, path string) (bool, error) {
+	return d.seen[hash], nil
+}
+
+// offline disables network access to the dashboard for the
+// duration of a test.
+func offline(t *testing.T) {
+	old := *network
+	*network = false
+	networkSeen = make(map[string]bool)
+	t.Cleanup(func() {
+		*network = old
+		networkSeen = make(map[string]bool)
+	})
+}
+
+func TestCommitDependencyBump(t *testing.T) {
+	tests := []struct {
+		files string
+		want  bool
+	}{
+		{"go.mod", true},
+		{"go.mod go.sum", true},
+		{"internal/foo/go.mod internal/foo/go.sum", true},
+		{"go.mod go.sum http2/transport.go", false},
+		{"src/cmd/go/main.go", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		c := &Commit{Files: tt.files}
+		if got := c.DependencyBump(); got != tt.want {
+			t.Errorf("DependencyBump(%q) = %v; want %v", tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestCommitReleaseRelevant(t *testing.T) {
+	tests := []struct {
+		files string
+		want  bool
+	}{
+		{"doc/go1.10.html", true},
+		{"api/next.txt", true},
+		{"src/net/http/server.go api/next/12345.txt", true},
+		{"src/net/http/server.go", false},
+		{"src/cmd/doc/main.go", false},
+		{"CONTRIBUTORS", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		c := &Commit{Files: tt.files, Branch: master}
+		if got := c.ReleaseRelevant(releasePrefix); got != tt.want {
+			t.Errorf("ReleaseRelevant(%q) = %v; want %v", tt.files, got, tt.want)
+		}
+		_, _, body := goDashFormat{}.commitRequest(&Repo{}, c, time.Time{})
+		if got := body.(*dashCommit).ReleaseRelevant; got != tt.want {
+			t.Errorf("posted ReleaseRelevant for %q = %v; want %v", tt.files, got, tt.want)
+		}
+	}
+	c := &Commit{Files: "design/notes.md"}
+	if !c.ReleaseRelevant(splitList("design/")) {
+		t.Errorf("ReleaseRelevant with custom prefix design/ = false; want true")
+	}
+}
+
+func TestCommitRequestFiles(t *testing.T) {
+	defer func(n int) { *postFiles = n }(*postFiles)
+	c := &Commit{Files: "a.go b.go c.go", Branch: master}
+	tests := []struct {
+		max       int
+		want      []string
+		truncated bool
+	}{
+		{0, nil, false},
+		{5, []string{"a.go", "b.go", "c.go"}, false},
+		{3, []string{"a.go", "b.go", "c.go"}, false},
+		{2, []string{"a.go", "b.go"}, true},
+	}
+	for _, tt := range tests {
+		*postFiles = tt.max
+		_, _, body := goDashFormat{}.commitRequest(&Repo{}, c, time.Time{})
+		buf, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			Files          []string
+			FilesTruncated bool
+		}
+		if err := json.Unmarshal(buf, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Files, tt.want) || got.FilesTruncated != tt.truncated {
+			t.Errorf("with -watcher.postFiles=%d, posted Files = %q, FilesTruncated = %v; want %q, %v", tt.max, got.Files, got.FilesTruncated, tt.want, tt.truncated)
+		}
+		if tt.max == 0 && strings.Contains(string(buf), "Files") {
+			t.Errorf("with -watcher.postFiles=0, payload includes files: %s", buf)
+		}
+	}
+}
+
+func TestParseCommitDate(t *testing.T) {
+	want := time.Date(2017, 3, 4, 15, 4, 5, 0, time.FixedZone("", -5*3600))
+	for _, s := range []string{
+		"Sat, 4 Mar 2017 15:04:05 -0500",
+		"Sat, 04 Mar 2017 15:04:05 -0500",
+		"Sat Mar 4 15:04:05 2017 -0500",
+		"2017-03-04 15:04:05 -0500",
+		"2017-03-04T15:04:05-05:00",
+		" Sat, 4 Mar 2017 15:04:05 -0500\n",
+	} {
+		got, err := parseCommitDate(s)
+		if err != nil {
+			t.Errorf("parseCommitDate(%q): %v", s, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("parseCommitDate(%q) = %v; want %v", s, got, want)
+		}
+	}
+	if got, err := parseCommitDate("Sat, 04 Mar 2017 20:04:05 UTC"); err != nil || !got.Equal(want) {
+		t.Errorf("parseCommitDate(RFC1123) = %v, %v; want %v", got, err, want)
+	}
+	for _, s := range []string{"", "yesterday", "2017-03-04"} {
+		if got, err := parseCommitDate(s); err == nil {
+			t.Errorf("parseCommitDate(%q) = %v; want error", s, got)
+		}
+	}
+}
+
+func TestPostCommitBadDate(t *testing.T) {
+	offline(t)
+	r := &Repo{path: "go", status: newStatusRing(50), commits: make(map[string]*Commit)}
+	c := &Commit{Hash: strings.Repeat("a", 40), Date: "not a date"}
+	if err := r.postCommit(c); err != nil {
+		t.Fatalf("postCommit with bad date: %v", err)
+	}
+	if networkSeen[c.Hash] {
+		t.Errorf("commit with bad date was posted")
+	}
+}
+
+func TestBadDatePolicy(t *testing.T) {
+	defer func(p string) { *badDates = p }(*badDates)
+	var posted []dashCommit
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		var dc dashCommit
+		if err := json.NewDecoder(req.Body).Decode(&dc); err != nil {
+			t.Errorf("decoding posted commit: %v", err)
+		}
+		posted = append(posted, dc)
+		fmt.Fprint(w, `{}`)
+	})
+	tests := []struct {
+		policy string
+		post   bool
+		check  func(time.Time) bool
+	}{
+		{"skip", false, nil},
+		{"zero", true, time.Time.IsZero},
+		{"now", true, func(t time.Time) bool { return time.Since(t) < time.Minute }},
+	}
+	for _, tt := range tests {
+		*badDates = tt.policy
+		posted = nil
+		r := &Repo{path: "golang.org/x/net", status: newStatusRing(50)}
+		c := &Commit{Hash: strings.Repeat("b", 40), Branch: master, Date: "the day before yesterday"}
+		if err := r.postCommit(c); err != nil {
+			t.Errorf("policy %q: postCommit: %v", tt.policy, err)
+			continue
+		}
+		if !tt.post {
+			if len(posted) != 0 {
+				t.Errorf("policy %q: posted %d commits; want none", tt.policy, len(posted))
+			}
+			continue
+		}
+		if len(posted) != 1 {
+			t.Errorf("policy %q: posted %d commits; want 1", tt.policy, len(posted))
+			continue
+		}
+		if got := posted[0].Time; !tt.check(got) {
+			t.Errorf("policy %q: posted time %v", tt.policy, got)
+		}
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	defer func(f string) { *keyFile = f }(*keyFile)
+	tests := []struct {
+		data string
+		want string // empty if an error is expected
+	}{
+		{"abc123\n", "abc123"},
+		{"abc123", "abc123"},
+		{"abc123\r\n", "abc123"},
+		{"  abc123 \t\r\nsecond line\r\n", "abc123"},
+		{"\r\n\nabc123\r\n", "abc123"},
+		{"", ""},
+		{" \r\n\t\n", ""},
+		{"abc 123\n", ""},
+		{"abc\x00123\n", ""},
+		{"\xef\xbb\xbfabc123\n", ""},
+	}
+	for _, tt := range tests {
+		f := filepath.Join(t.TempDir(), "key")
+		if err := ioutil.WriteFile(f, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		*keyFile = f
+		got, err := readKey()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("readKey of %q = %q; want error", tt.data, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("readKey of %q = %q, %v; want %q", tt.data, got, err, tt.want)
+		}
+	}
+}
+
+func TestNumstatPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"src/fmt/print.go", "src/fmt/print.go"},
+		{"a.go => b.go", "b.go"},
+		{"src/{old => new}/x.go", "src/new/x.go"},
+		{"src/fmt/{print.go => format.go}", "src/fmt/format.go"},
+		{"src/{ => internal}/x.go", "src/internal/x.go"},
+		{"{vendor => }/x.go", "x.go"},
+	}
+	for _, tt := range tests {
+		if got := numstatPath(tt.in); got != tt.want {
+			t.Errorf("numstatPath(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLogLargeChange(t *testing.T) {
+	defer func(n int) { *largeChange = n }(*largeChange)
+	*largeChange = 50
+	f := newGitFixture(t)
+	defer f.cleanup()
+	small := f.commit("a.txt", "small")
+	var big bytes.Buffer
+	for i := 0; i < 60; i++ {
+		fmt.Fprintf(&big, "line %d\n", i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(f.dir, "vendor.txt"), big.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(f.dir, "blob.bin"), []byte{0, 1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.git("add", ".")
+	f.git("commit", "-q", "-m", "big")
+	large := f.git("rev-parse", "HEAD")
+
+	r := f.repo()
+	cs, err := r.log("", master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*Commit{}
+	for _, c := range cs {
+		got[c.Hash] = c
+	}
+	if c := got[small]; c == nil || c.LargeChange || c.Changed != 1 || c.Files != "a.txt" {
+		t.Errorf("small commit = %+v; want 1 changed line in a.txt, not large", c)
+	}
+	if c := got[large]; c == nil || !c.LargeChange || c.Changed != 60 || c.Files != "blob.bin vendor.txt" {
+		t.Errorf("large commit = %+v; want 60 changed lines in blob.bin vendor.txt, large", c)
+	}
+	_, _, body := goDashFormat{}.commitRequest(r, got[large], time.Time{})
+	if !body.(*dashCommit).LargeChange {
+		t.Errorf("large commit not posted as LargeChange")
+	}
+}
+
+func TestCommitNeedsBenchmarking(t *testing.T) {
+	rules, err := parseBenchRules("tools=cmd/,go/:.go,s; net=:.go:*_test.go,*_windows.go,internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools, netRule := rules["tools"], rules["net"]
+	if tools == nil || netRule == nil {
+		t.Fatalf("no rule for tools or net in %v", rules)
+	}
+	goRule := defaultBenchConfig
+	tests := []struct {
+		bc     *benchConfig
+		files  string
+		branch string
+		want   bool
+	}{
+		// Default (main repo) rules.
+		{goRule, "src/runtime/proc.go", master, true},               // src commit
+		{goRule, "include/plan9/libc.h", master, true},              // src commit
+		{goRule, "src/runtime/proc_test.go", master, false},         // test-only commit
+		{goRule, "src/cmd/go/testdata/script/x.txt", master, false}, // test-only commit
+		{goRule, "CONTRIBUTORS doc/go1.9.html", master, false},      // doc-only commit
+		{goRule, "src/runtime/proc.go", "release-branch.go1.8", false},
+		{goRule, "src/runtime/proc.go src/runtime/proc_test.go", master, true},
+		{goRule, "src/cmd/xtestdata/x.go", master, false},      // testdata anywhere in the path
+		{goRule, "src/cmd/vet/foo_testdata.go", master, false}, // testdata anywhere in the path
+		{goRule, "src/foo_test.go/x.go", master, true},         // only a _test.go file is a test
+
+		// Subrepos without a rule are never benchmarked.
+		{nil, "http2/frame.go", master, false},
+		{nil, "README", master, false},
+
+		// Subrepo rules.
+		{tools, "go/ssa/func.go", master, true},
+		{tools, "cmd/guru/guru.go README", master, true},
+		{tools, "cmd/guru/asm_amd64.s", master, true},
+		{tools, "go/ssa/func_test.go", master, false},
+		{tools, "cmd/present/static/slides.js", master, false},
+		{tools, "src/foo.go", master, false},
+		{tools, "go/ssa/testdata/x.go", master, false},
+
+		// Subrepo rules with their own excludes.
+		{netRule, "http2/frame.go", master, true},
+		{netRule, "http2/frame_test.go", master, false},
+		{netRule, "http2/frame_windows.go", master, false},
+		{netRule, "internal/socket/sys.go", master, false},
+		{netRule, "http2/testdata/x.go", master, true}, // testdata isn't excluded
+		{netRule, "README", master, false},
+	}
+	for _, tt := range tests {
+		c := &Commit{Files: tt.files, Branch: tt.branch}
+		if got := c.NeedsBenchmarking(tt.bc, master); got != tt.want {
+			t.Errorf("NeedsBenchmarking(%q on %s, rule %+v) = %v; want %v", tt.files, tt.branch, tt.bc, got, tt.want)
+		}
+	}
+}
+
+func TestParseBenchRulesError(t *testing.T) {
+	if _, err := parseBenchRules("tools"); err == nil {
+		t.Error("parseBenchRules(\"tools\") succeeded; want error")
+	}
+	if _, err := parseBenchRules("tools=go/:.go:[x"); err == nil {
+		t.Error("parseBenchRules with a bad exclude pattern succeeded; want error")
+	}
+	m, err := parseBenchRules("")
+	if err != nil || len(m) != 0 {
+		t.Errorf("parseBenchRules(\"\") = %v, %v; want empty map, nil", m, err)
+	}
+}
+
+func TestUpdateHeadEvent(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+
+	var events []headEvent
+	old := emitHeadEvent
+	emitHeadEvent = func(ev headEvent) { events = append(events, ev) }
+	defer func() { emitHeadEvent = old }()
+
+	r := f.repo()
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("got events %+v for newly discovered branch; want none", events)
+	}
+
+	f.commit("a.txt", "second")
+	third := f.commit("b.txt", "third")
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	want := headEvent{Repo: r.name(), Branch: master, OldHead: first, NewHead: third, Commits: 2}
+	if len(events) != 1 || events[0] != want {
+		t.Fatalf("after advance, got events %+v; want [%+v]", events, want)
+	}
+
+	// No new commits; no new events.
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("after no-op update, got events %+v; want just one", events)
+	}
+}
+
+func TestPushResumesPendingRefs(t *testing.T) {
+	old := *pushState
+	*pushState = true
+	defer func() { *pushState = old }()
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	dest := newBareGitDir(t)
+	defer os.RemoveAll(dest)
+
+	f.commit("a.txt", "first")
+	f.git("tag", "v1")
+	second := f.commit("a.txt", "second")
+	f.git("tag", "v2")
+	f.git("remote", "add", "dest", dest)
+
+	r := f.repo()
+	r.dests = mirrorDests([]string{dest})
+
+	// Simulate a watcher that was restarted after pushing everything
+	// but refs/tags/v2.
+	if err := r.savePushState("dest", []string{"refs/tags/v2"}, map[string]string{"refs/tags/v2": second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := r.getRemoteRefs("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := remote["refs/tags/v2"]; got != second {
+		t.Errorf("after resumed push, dest has refs/tags/v2 = %q; want %q", got, second)
+	}
+	// Only the pending ref should have been pushed.
+	if _, ok := remote["refs/tags/v1"]; ok {
+		t.Errorf("resumed push re-diffed refs; dest has refs/tags/v1: %v", remote)
+	}
+	if _, err := os.Stat(r.pushStateFile("dest")); !os.IsNotExist(err) {
+		t.Errorf("push state file not removed after complete push: %v", err)
+	}
+
+	// With no pending state, the next push diffs all refs.
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	remote, err = r.getRemoteRefs("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := remote["refs/tags/v1"]; !ok {
+		t.Errorf("full push did not push refs/tags/v1: %v", remote)
+	}
+}
+
+func TestPushResumeStalePendingRefs(t *testing.T) {
+	old := *pushState
+	*pushState = true
+	defer func() { *pushState = old }()
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	dest := newBareGitDir(t)
+	defer os.RemoveAll(dest)
+
+	first := f.commit("a.txt", "first")
+	f.git("remote", "add", "dest", dest)
+	r := f.repo()
+	r.dests = mirrorDests([]string{dest})
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	second := f.commit("a.txt", "second")
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a watcher restarted during an old push of master at
+	// first, and of a branch since deleted. Local master has moved
+	// on, so resuming must not rewind the mirror to first.
+	pending := []string{"refs/heads/master", "refs/heads/gone"}
+	hash := map[string]string{"refs/heads/master": first, "refs/heads/gone": first}
+	if err := r.savePushState("dest", pending, hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := r.getRemoteRefs("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := remote["refs/heads/master"]; got != second {
+		t.Errorf("after resuming stale push, dest has refs/heads/master = %q; want %q", got, second)
+	}
+	if _, ok := remote["refs/heads/gone"]; ok {
+		t.Errorf("resumed push pushed deleted branch: %v", remote)
+	}
+	if _, err := os.Stat(r.pushStateFile("dest")); !os.IsNotExist(err) {
+		t.Errorf("stale push state file not removed: %v", err)
+	}
+}
+
+func TestCommitGerritChangeNumber(t *testing.T) {
+	tests := []struct {
+		desc string
+		want int
+	}{
+		{"runtime: fix a bug\n\nChange-Id: I123\nReviewed-on: https://go-review.googlesource.com/c/go/+/39712\nReviewed-by: Gopher <gopher@golang.org>", 39712},
+		{"net/http: old style\n\nReviewed-on: https://go-review.googlesource.com/12345", 12345},
+		{"x: trailing slash\n\nReviewed-on: https://go-review.googlesource.com/c/net/+/777/", 777},
+		{"cmd/go: no trailer\n\nChange-Id: I456", 0},
+		{"x: garbage\n\nReviewed-on: somewhere else", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		c := &Commit{Desc: tt.desc}
+		if got := c.GerritChangeNumber(); got != tt.want {
+			t.Errorf("GerritChangeNumber(%q) = %d; want %d", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestCommitSubjectBody(t *testing.T) {
+	tests := []struct {
+		desc          string
+		subject, body string
+	}{
+		{"net/http: fix a bug\n\nThe bug was bad.\n\nFixes #1234", "net/http: fix a bug", "The bug was bad.\n\nFixes #1234"},
+		{"runtime: no blank line\nbody", "runtime: no blank line", "body"},
+		{"cmd/go: one line", "cmd/go: one line", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		c := &Commit{Desc: tt.desc, Branch: master}
+		if got := c.Subject(); got != tt.subject {
+			t.Errorf("Subject(%q) = %q; want %q", tt.desc, got, tt.subject)
+		}
+		if got := c.Body(); got != tt.body {
+			t.Errorf("Body(%q) = %q; want %q", tt.desc, got, tt.body)
+		}
+		_, _, body := goDashFormat{}.commitRequest(&Repo{}, c, time.Time{})
+		dc := body.(*dashCommit)
+		if dc.Subject != tt.subject || dc.Body != tt.body || dc.Desc != tt.desc {
+			t.Errorf("posted Desc, Subject, Body for %q = %q, %q, %q; want %q, %q, %q", tt.desc, dc.Desc, dc.Subject, dc.Body, tt.desc, tt.subject, tt.body)
+		}
+	}
+}
+
+func TestCommitTopic(t *testing.T) {
+	tests := []struct {
+		desc string
+		want string
+	}{
+		{"cmd/go: add vendoring\n\nTopic: modules\nChange-Id: I123\nReviewed-on: https://go-review.googlesource.com/c/go/+/39712", "modules"},
+		{"cmd/go: retopic\n\nTopic: vgo\nTopic:  modules \n", "modules"},
+		{"cmd/go: no topic\n\nChange-Id: I456\nReviewed-on: https://go-review.googlesource.com/c/go/+/39713", ""},
+		{"x: mentions Topic: in the body, not as a trailer", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		c := &Commit{Desc: tt.desc, Branch: master}
+		if got := c.Topic(); got != tt.want {
+			t.Errorf("Topic(%q) = %q; want %q", tt.desc, got, tt.want)
+		}
+		_, _, body := goDashFormat{}.commitRequest(&Repo{}, c, time.Time{})
+		if got := body.(*dashCommit).Topic; got != tt.want {
+			t.Errorf("posted Topic for %q = %q; want %q", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestCommitCherryPickOf(t *testing.T) {
+	orig := "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		desc string
+		want string
+	}{
+		{"[release-branch.go1.9] net/http: fix a bug\n\nChange-Id: I123\nReviewed-on: https://go-review.googlesource.com/c/go/+/39712\n(cherry picked from commit " + orig + ")", orig},
+		{"[release-branch.go1.9] runtime: fix\n\n(cherry picked from commit " + orig + ")\nChange-Id: I456", orig},
+		{"net/http: fix a bug\n\nChange-Id: I123", ""},
+		{"x: abbreviated\n\n(cherry picked from commit 0123456)", ""},
+		{"x: mentions (cherry picked from commit " + orig + ") mid-line", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		c := &Commit{Desc: tt.desc, Branch: master}
+		if got := c.CherryPickOf(); got != tt.want {
+			t.Errorf("CherryPickOf(%q) = %q; want %q", tt.desc, got, tt.want)
+		}
+		_, _, body := goDashFormat{}.commitRequest(&Repo{}, c, time.Time{})
+		if got := body.(*dashCommit).CherryPickOf; got != tt.want {
+			t.Errorf("posted CherryPickOf for %q = %q; want %q", tt.desc, got, tt.want)
+		}
+	}
+}
+
+// fakeDashboard starts a test HTTP server standing in for the build
+// dashboard and points -watcher.dash at it for the duration of the test.
+func fakeDashboard(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	ts := httptest.NewServer(h)
+	oldDash, oldReport, oldNetwork := *dashFlag, *report, *network
+	*dashFlag, *report, *network = ts.URL+"/", true, true
+	t.Cleanup(func() {
+		ts.Close()
+		*dashFlag, *report, *network = oldDash, oldReport, oldNetwork
+	})
+	return ts
+}
+
+const testDate = "Mon, 2 Jan 2006 15:04:05 -0700"
+
+func TestPostCommitRequest(t *testing.T) {
+	var (
+		gotType string
+		got     dashCommit
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/commit" {
+			t.Errorf("got %s %s; want POST /commit", req.Method, req.URL.Path)
+		}
+		gotType = req.Header.Get("Content-Type")
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("decoding posted commit: %v", err)
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	r := &Repo{path: "golang.org/x/net", status: newStatusRing(50)}
+	c := &Commit{Hash: strings.Repeat("c", 40), Author: "Gopher <gopher@golang.org>", Desc: "http2: fix it", Branch: master, Date: testDate}
+	if err := r.postCommit(c); err != nil {
+		t.Fatal(err)
+	}
+	if gotType != "application/json" {
+		t.Errorf("Content-Type = %q; want application/json", gotType)
+	}
+	if got.PackagePath != "golang.org/x/net" || got.Hash != c.Hash || got.User != c.Author || got.Desc != c.Desc || got.Branch != master {
+		t.Errorf("posted %+v; want commit %v of golang.org/x/net", got, c)
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	})
+	defer close(done) // before ts.Close, which waits for the handlers
+	defer func(d time.Duration) { watcherClient.Timeout = d }(watcherClient.Timeout)
+	watcherClient.Timeout = 50 * time.Millisecond
+
+	r := &Repo{path: "golang.org/x/net", status: newStatusRing(50)}
+	calls := []struct {
+		name string
+		fn   func() error
+	}{
+		{"dashSeen", func() error { _, err := r.dashSeen(strings.Repeat("d", 40)); return err }},
+		{"dashSeenBatch", func() error { _, err := r.dashSeenBatch([]string{strings.Repeat("d", 40)}); return err }},
+		{"subrepoList", func() error { _, err := subrepoList(); return err }},
+		{"postCommit", func() error {
+			return r.postCommit(&Commit{Hash: strings.Repeat("d", 40), Branch: master, Date: testDate})
+		}},
+		{"gerritMeta", func() error { _, err := gerritMeta(ts.URL + "/?b=master"); return err }},
+	}
+	for _, c := range calls {
+		start := time.Now()
+		err := c.fn()
+		if err == nil {
+			t.Errorf("%s against a hung server succeeded", c.name)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s against a hung server took %v", c.name, d)
+		}
+	}
+}
+
+func TestPostCommitsBatch(t *testing.T) {
+	var (
+		batch   = true
+		abort   = false
+		batches [][]string // hashes posted in each batch
+		singles []string   // hashes posted one at a time
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/commits":
+			if !batch {
+				fmt.Fprint(w, `{"Error": "rejecting POST from commit watcher; need version 3 instead of 4"}`)
+				return
+			}
+			var dcs []dashCommit
+			if err := json.NewDecoder(req.Body).Decode(&dcs); err != nil {
+				t.Errorf("decoding posted batch: %v", err)
+			}
+			var hashes []string
+			var res []postResult
+			for _, dc := range dcs {
+				hashes = append(hashes, dc.Hash)
+				if abort {
+					res = append(res, postResult{Hash: dc.Hash, Error: "this package already has a first commit; aborting"})
+					break
+				}
+				res = append(res, postResult{Hash: dc.Hash})
+			}
+			batches = append(batches, hashes)
+			json.NewEncoder(w).Encode(map[string]interface{}{"Response": res})
+		case "/commit":
+			var dc dashCommit
+			if err := json.NewDecoder(req.Body).Decode(&dc); err != nil {
+				t.Errorf("decoding posted commit: %v", err)
+			}
+			singles = append(singles, dc.Hash)
+			fmt.Fprint(w, `{}`)
+		default:
+			t.Errorf("unexpected request for %s", req.URL)
+		}
+	})
+	var cs []*Commit
+	for i := 0; i < 250; i++ {
+		cs = append(cs, &Commit{Hash: fmt.Sprintf("%040x", i), Branch: master, Date: testDate})
+	}
+
+	r := &Repo{path: "golang.org/x/net", status: newStatusRing(50)}
+	if err := r.postCommits(cs); err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 3 || len(batches[0]) != 100 || len(batches[1]) != 100 || len(batches[2]) != 50 {
+		var sizes []int
+		for _, b := range batches {
+			sizes = append(sizes, len(b))
+		}
+		t.Fatalf("posted batches of %v commits; want [100 100 50]", sizes)
+	}
+	for i, c := range cs {
+		if got := batches[i/100][i%100]; got != c.Hash {
+			t.Fatalf("commit %d posted was %s; want %s", i, got, c.Hash)
+		}
+	}
+	if len(singles) != 0 {
+		t.Errorf("posted %d commits one at a time; want none", len(singles))
+	}
+
+	// The per-commit status of a batch is reported.
+	batches, abort = nil, true
+	err := r.postCommits(cs[:5])
+	if err == nil || !strings.Contains(err.Error(), "this package already has a first commit; aborting") {
+		t.Errorf("postCommits with aborted first commit = %v; want abort error", err)
+	}
+	if len(batches) != 1 {
+		t.Errorf("posted %d batches after the first commit was aborted; want 1", len(batches))
+	}
+
+	// An old dashboard gets the commits one at a time.
+	batches, abort, batch = nil, false, false
+	if err := r.postCommits(cs[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if !r.noPostBatch {
+		t.Errorf("noPostBatch = false after unsupported-version response")
+	}
+	if len(singles) != 5 {
+		t.Errorf("posted %d commits one at a time; want 5", len(singles))
+	}
+	for i, h := range singles {
+		if h != cs[i].Hash {
+			t.Errorf("single post %d was %s; want %s", i, h, cs[i].Hash)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	defer func(now func() time.Time) { watcherNow = now }(watcherNow)
+	now := processStartTime.Add(time.Minute)
+	watcherNow = func() time.Time { return now }
+	defer func() {
+		watchedMu.Lock()
+		watchedRepos = make(map[string]*Repo)
+		watchedMu.Unlock()
+	}()
+
+	// A repo polled every 5 minutes, and one from a bundle
+	// polled every -watcher.poll (10s).
+	xnet := &Repo{path: "golang.org/x/net", status: newStatusRing(50)}
+	offline := &Repo{path: "golang.org/x/offline", bundle: "offline.bundle", status: newStatusRing(50)}
+	registerRepo(xnet)
+	registerRepo(offline)
+
+	get := func() (int, string) {
+		w := httptest.NewRecorder()
+		handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code, w.Body.String()
+	}
+	// Not fetched yet, but still soon after startup for x/net.
+	if code, body := get(); code != http.StatusServiceUnavailable || strings.Contains(body, "x/net") || !strings.Contains(body, "offline: no successful fetch") {
+		t.Errorf("before fetches: %d %q; want 503 for offline only", code, body)
+	}
+	xnet.fetched()
+	offline.fetched()
+	if code, body := get(); code != 200 {
+		t.Errorf("after fetches: %d %q; want 200", code, body)
+	}
+	now = now.Add(45 * time.Second)
+	if code, body := get(); code != http.StatusServiceUnavailable || strings.Contains(body, "x/net") || !strings.Contains(body, "offline: last successful fetch 45s ago (want within 30s)") {
+		t.Errorf("after 45s: %d %q; want 503 for offline only", code, body)
+	}
+	offline.fetched()
+	now = now.Add(15 * time.Minute)
+	offline.fetched()
+	if code, body := get(); code != http.StatusServiceUnavailable || !strings.Contains(body, "1 stale repos") || !strings.Contains(body, "net: last successful fetch 15m45s ago") {
+		t.Errorf("after 15m: %d %q; want 503 for net only", code, body)
+	}
+}
+
+func TestDashboardRateLimit(t *testing.T) {
+	var slept []time.Duration
+	defer func(sleep func(time.Duration)) { trySleep = sleep }(trySleep)
+	trySleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 3
+
+	limited := 0 // number of requests left to refuse
+	var posts, gets int
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		if limited > 0 {
+			limited--
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		if req.Method == "GET" {
+			gets++
+		} else {
+			posts++
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	r := &Repo{path: "golang.org/x/net", status: newStatusRing(50)}
+	c := &Commit{Hash: strings.Repeat("e", 40), Branch: master, Date: testDate}
+
+	limited = 2
+	if err := r.postCommit(c); err != nil {
+		t.Fatalf("postCommit after 2 429s: %v", err)
+	}
+	if posts != 1 || !reflect.DeepEqual(slept, []time.Duration{7 * time.Second, 7 * time.Second}) {
+		t.Errorf("posted %d times after waiting %v; want 1 after 7s twice", posts, slept)
+	}
+	var found bool
+	r.status.foreachDesc(func(ent statusEntry) {
+		if ent.status == "rate limited by dashboard; retrying in 7s" {
+			found = true
+		}
+	})
+	if !found {
+		t.Errorf("status doesn't report the rate limiting")
+	}
+
+	slept = nil
+	limited = 1
+	if seen, err := r.dashSeen(c.Hash); err == nil {
+		t.Errorf("dashSeen with a 429 = %v, nil; want a rate limit error", seen)
+	}
+	limited = 1
+	err := r.retryRateLimited(func() (err error) {
+		_, err = r.dashSeen(c.Hash)
+		return err
+	})
+	if err != nil || gets != 1 || !reflect.DeepEqual(slept, []time.Duration{7 * time.Second}) {
+		t.Errorf("dashSeen with retries = %v after %d gets and waiting %v; want success after 1 get and 7s", err, gets, slept)
+	}
+
+	// Giving up after -watcher.retries attempts.
+	slept = nil
+	limited = 5
+	if err := r.postCommit(c); err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Errorf("postCommit after 5 429s = %v; want rate limit error", err)
+	}
+	if len(slept) != 2 {
+		t.Errorf("waited %d times before giving up; want 2", len(slept))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	defer func(d time.Duration) { *backoff = d }(*backoff)
+	*backoff = 5 * time.Second
+	now := time.Date(2017, 3, 4, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		h    string
+		want time.Duration
+	}{
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+		{"", 5 * time.Second},
+		{"soon", 5 * time.Second},
+		{"-3", 5 * time.Second},
+		{"86400", maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.h, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v; want %v", tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestPostCommitConcurrencyLimit(t *testing.T) {
+	const limit = 2
+	var (
+		mu       sync.Mutex
+		inFlight int
+		max      int
+		posts    int
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		posts++
+		if inFlight > max {
+			max = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, `{}`)
+	})
+	oldSem := postSem
+	postSem = newSemaphore(limit)
+	defer func() { postSem = oldSem }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		r := &Repo{path: fmt.Sprintf("golang.org/x/repo%d", i), status: newStatusRing(50)}
+		for j := 0; j < 3; j++ {
+			c := &Commit{Hash: fmt.Sprintf("%040d", i*10+j), Branch: master, Date: testDate}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := r.postCommit(c); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if posts != 15 {
+		t.Errorf("dashboard got %d posts; want 15", posts)
+	}
+	if max > limit {
+		t.Errorf("saw %d concurrent posts; want at most %d", max, limit)
+	}
+}
+
+func TestWaitForDiskSpace(t *testing.T) {
+	oldMin, oldFree, oldInterval := *minFreeMB, watcherDiskFree, diskRetryInterval
+	defer func() { *minFreeMB, watcherDiskFree, diskRetryInterval = oldMin, oldFree, oldInterval }()
+	*minFreeMB = 100
+	diskRetryInterval = time.Millisecond
+
+	free := uint64(10 << 20)
+	calls := 0
+	watcherDiskFree = func(dir string) (uint64, error) {
+		calls++
+		if calls == 3 {
+			free = 200 << 20
+		}
+		return free, nil
+	}
+
+	if err := checkDiskSpace("/cache"); err == nil || !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Fatalf("checkDiskSpace with 10 MB free = %v; want insufficient disk space error", err)
+	}
+	r := &Repo{path: "golang.org/x/tools", status: newStatusRing(50)}
+	if err := r.waitForDiskSpace(context.Background(), "/cache"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("watcherDiskFree called %d times; want 3 (paused until space was freed)", calls)
+	}
+	var paused bool
+	r.status.foreachDesc(func(ent statusEntry) {
+		if strings.Contains(ent.status, "insufficient disk space") {
+			paused = true
+		}
+	})
+	if !paused {
+		t.Error("status ring doesn't mention insufficient disk space")
+	}
+
+	// Canceling the context stops the wait.
+	free = 10 << 20
+	diskRetryInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.waitForDiskSpace(ctx, "/cache") }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("waitForDiskSpace after cancel = %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("waitForDiskSpace didn't return after its context was canceled")
+	}
+}
+
+func TestPostBranchDeleted(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		deleted []string
+		fail    bool
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/branch-deleted" {
+			var body struct{ PackagePath, Branch string }
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			deleted = append(deleted, body.Branch)
+			if fail {
+				fmt.Fprint(w, `{"Error": "datastore unavailable"}`)
+				return
+			}
+		}
+		if req.URL.Path == "/commits-seen" {
+			http.NotFound(w, req)
+			return
+		}
+		// Every commit is already known to the dashboard.
+		fmt.Fprint(w, `{}`)
+	})
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	f.git("branch", "dev")
+	f.git("branch", "unreported")
+
+	r := f.repo()
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	// Pretend the dashboard has never seen the unreported branch.
+	r.branches["unreported"].LastSeen = nil
+	r.branches["unreported"].Head = r.branches[master].Head
+
+	f.git("branch", "-D", "dev")
+	f.git("branch", "-D", "unreported")
+	for i := 0; i < 2; i++ {
+		if err := r.updateDashboard(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deleted) != 1 || deleted[0] != "dev" {
+		t.Errorf("dashboard got deletions %q; want [dev]", deleted)
+	}
+	if _, ok := r.branches["dev"]; ok {
+		t.Error("deleted branch dev still in r.branches")
+	}
+
+	// A deletion the dashboard fails to record is counted,
+	// but neither fails the update nor is sent again.
+	errorCount := func() uint64 {
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		return counters[metricKey{"watcher_dashboard_errors_total", r.name()}]
+	}
+	f.git("branch", "gone")
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	f.git("branch", "-D", "gone")
+	mu.Lock()
+	fail, deleted = true, nil
+	mu.Unlock()
+	errs := errorCount()
+	for i := 0; i < 2; i++ {
+		if err := r.updateDashboard(); err != nil {
+			t.Fatalf("updateDashboard after failed deletion: %v", err)
+		}
+	}
+	if len(deleted) != 1 || deleted[0] != "gone" {
+		t.Errorf("dashboard got deletions %q; want [gone]", deleted)
+	}
+	if n := errorCount(); n != errs+1 {
+		t.Errorf("watcher_dashboard_errors_total went from %d to %d; want one more", errs, n)
+	}
+
+	// Branches listed in -watcher.branches are noticed
+	// deleted too.
+	defer func(v string) { *branches = v }(*branches)
+	*branches = master + ",listed"
+	f.git("branch", "listed")
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	f.git("branch", "-D", "listed")
+	mu.Lock()
+	fail, deleted = false, nil
+	mu.Unlock()
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "listed" {
+		t.Errorf("with -watcher.branches, dashboard got deletions %q; want [listed]", deleted)
+	}
+}
+
+func TestReadBlockedCommitsInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher-blocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash := strings.Repeat("ab", 20)
+	for _, tt := range []struct {
+		content, err string
+	}{
+		{"# ok\n" + hash + "\nHEAD\n", ":3: \"HEAD\" is not"},
+		{hash[:7] + "\n", ":1: \"" + hash[:7] + "\" is not"},
+		{"\n" + strings.ToUpper(hash) + " # shouting\n", ":2: \"" + strings.ToUpper(hash) + "\" is not"},
+	} {
+		file := filepath.Join(dir, "blocked")
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readBlockedCommits(file)
+		if err == nil || !strings.Contains(err.Error(), file+tt.err) {
+			t.Errorf("readBlockedCommits(%q) error = %v; want one containing %q", tt.content, err, file+tt.err)
+		}
+	}
+}
+
+func TestBlockedCommitNotPosted(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	secret := f.commit("secret.txt", "oops")
+	third := f.commit("secret.txt", "purge the secret")
+	fourth := f.commit("a.txt", "fourth")
+
+	file := filepath.Join(f.dir, "blocked")
+	if err := ioutil.WriteFile(file, []byte("# purged secrets\n"+secret+"  # CVE-XXXX\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := readBlockedCommits(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := blockedCommits
+	blockedCommits = blocked
+	defer func() { blockedCommits = old }()
+
+	r := f.repo()
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.postNewCommits(r.branches[master]); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{first, third, fourth} {
+		if !networkSeen[h] {
+			t.Errorf("commit %v not posted", r.commits[h])
+		}
+	}
+	if networkSeen[secret] {
+		t.Errorf("blocked commit %v was posted", r.commits[secret])
+	}
+	if got := r.dashParent(r.commits[third]); got != first {
+		t.Errorf("dashboard parent of %v = %v; want %v", r.commits[third], got, first)
+	}
+}
+
+func TestUpdateOrphans(t *testing.T) {
+	offline(t)
+	old := *allowOrphans
+	defer func() { *allowOrphans = old }()
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	second := f.commit("a.txt", "second")
+
+	// loseHead loads the repo and then forgets its head commit,
+	// as if it were outside a shallow clone.
+	loseHead := func(lost string) *Repo {
+		r := f.repo()
+		if err := r.update(false); err != nil {
+			t.Fatal(err)
+		}
+		delete(r.commits, lost)
+		return r
+	}
+
+	*allowOrphans = false
+	r := loseHead(second)
+	third := f.commit("a.txt", "third")
+	if err := r.update(false); err == nil || !strings.Contains(err.Error(), "can't find parent") {
+		t.Fatalf("update without -watcher.allowOrphans = %v; want can't find parent error", err)
+	}
+
+	*allowOrphans = true
+	r = loseHead(third)
+	fourth := f.commit("a.txt", "fourth")
+	if err := r.update(false); err != nil {
+		t.Fatalf("update with -watcher.allowOrphans: %v", err)
+	}
+	if len(r.orphans) != 1 || r.orphans[fourth] == nil {
+		t.Errorf("orphans = %v; want just %v", r.orphans, fourth)
+	}
+	if got := r.branches[master].Head.Hash; got != fourth {
+		t.Errorf("head = %v; want %v", got, fourth)
+	}
+	w := httptest.NewRecorder()
+	r.serveStatus(w, httptest.NewRequest("GET", "/debug/watcher/"+r.name(), nil))
+	if want := "orphaned commits (unknown parent): 1"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("status page doesn't contain %q:\n%s", want, w.Body)
+	}
+}
+
+// altFormat is a commitFormat for a hypothetical dashboard API.
+type altFormat struct{}
+
+func (altFormat) commitRequest(r *Repo, c *Commit, t time.Time) (method, endpoint string, body interface{}) {
+	return "PUT", "api/v2/commits/" + c.Hash, map[string]interface{}{
+		"repo":      r.name(),
+		"sha":       c.Hash,
+		"timestamp": t.Unix(),
+	}
+}
+
+func TestPostCommitFormat(t *testing.T) {
+	var method, path, body string
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		method, path, body = req.Method, req.URL.Path, string(b)
+		fmt.Fprint(w, `{}`)
+	})
+	r := &Repo{path: "golang.org/x/net", status: newStatusRing(50)}
+	c := &Commit{Hash: "abc", Parent: "def", Branch: master, Date: testDate, Desc: "net: fix"}
+
+	if err := r.postCommit(c); err != nil {
+		t.Fatal(err)
+	}
+	if method != "POST" || path != "/commit" {
+		t.Errorf("default format sent %s %s; want POST /commit", method, path)
+	}
+	var dc dashCommit
+	if err := json.Unmarshal([]byte(body), &dc); err != nil {
+		t.Fatal(err)
+	}
+	if dc.PackagePath != "golang.org/x/net" || dc.Hash != "abc" || dc.ParentHash != "def" {
+		t.Errorf("default format sent %s", body)
+	}
+
+	old := dashCommitFormat
+	dashCommitFormat = altFormat{}
+	defer func() { dashCommitFormat = old }()
+	if err := r.postCommit(c); err != nil {
+		t.Fatal(err)
+	}
+	if method != "PUT" || path != "/api/v2/commits/abc" {
+		t.Errorf("alternative format sent %s %s; want PUT /api/v2/commits/abc", method, path)
+	}
+	if want := `{"repo":"net","sha":"abc","timestamp":1136239445}`; body != want {
+		t.Errorf("alternative format sent body %s; want %s", body, want)
+	}
+}
+
+func TestCommitOnMultipleBranches(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	f.git("checkout", "-q", "-b", "release-branch.go1.9")
+	fix := f.commit("a.txt", "release fix")
+	f.git("checkout", "-q", master)
+
+	r := f.repo()
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	f.git("merge", "-q", "--ff-only", "release-branch.go1.9")
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		first: master + " release-branch.go1.9",
+		fix:   "release-branch.go1.9 " + master,
+	}
+	for hash, branches := range want {
+		c := r.commits[hash]
+		if got := strings.Join(c.Branches, " "); got != branches {
+			t.Errorf("%v.Branches = %q; want %q", c, got, branches)
+		}
+		_, _, body := goDashFormat{}.commitRequest(r, c, time.Now())
+		if got := strings.Join(body.(*dashCommit).Branches, " "); got != branches {
+			t.Errorf("posted Branches for %v = %q; want %q", c, got, branches)
+		}
+	}
+}
+
+func TestHandleWatcherAll(t *testing.T) {
+	offline(t)
+	var want []string
+	for i := 0; i < 3; i++ {
+		f := newGitFixture(t)
+		defer f.cleanup()
+		head := f.commit("a.txt", "first")
+		r := f.repo()
+		if err := r.update(false); err != nil {
+			t.Fatal(err)
+		}
+		r.setStatus(fmt.Sprintf("status of repo %d", i))
+		registerRepo(r)
+		want = append(want, "/debug/watcher/"+r.name(), fmt.Sprintf("status of repo %d", i), head)
+	}
+	defer func() {
+		watchedMu.Lock()
+		watchedRepos = make(map[string]*Repo)
+		watchedMu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	handleWatcherAll(w, httptest.NewRequest("GET", "/debug/watcher/all", nil))
+	for _, s := range want {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("/debug/watcher/all doesn't contain %q:\n%s", s, w.Body)
+		}
+	}
+}
+
+func TestHandleWatcherIndex(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	r := f.repo()
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	r.dests = mirrorDests([]string{"git@github.com:golang/example.git"})
+	r.fetched()
+	registerRepo(r)
+	defer unregisterRepo(r)
+
+	w := httptest.NewRecorder()
+	handleWatcherIndex(w, httptest.NewRequest("GET", "/debug/watcher/", nil))
+	for _, s := range []string{
+		"<a href='/debug/watcher/" + r.name() + "'>",
+		"<a href='/debug/watcher/" + r.name() + "/branch/master'>master</a>: " + head + " / -",
+		"git@github.com:golang/example.git",
+		" ago)",
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("/debug/watcher/ doesn't contain %q:\n%s", s, w.Body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handleWatcherIndex(w, httptest.NewRequest("GET", "/debug/watcher/nosuchrepo", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/watcher/nosuchrepo = %d; want 404", w.Code)
+	}
+}
+
+func TestFetchPrune(t *testing.T) {
+	old := *prune
+	defer func() { *prune = old }()
+
+	*prune = false
+	if got := strings.Join(fetchArgs(), " "); got != "fetch origin" {
+		t.Errorf("fetchArgs() = %q; want %q", got, "fetch origin")
+	}
+	*prune = true
+	if got := strings.Join(fetchArgs(), " "); got != "fetch --prune origin" {
+		t.Errorf("with -watcher.prune, fetchArgs() = %q; want %q", got, "fetch --prune origin")
+	}
+
+	upstream := newGitFixture(t)
+	defer upstream.cleanup()
+	upstream.commit("a.txt", "first")
+	upstream.git("branch", "dev")
+
+	tmp, err := ioutil.TempDir("", "watcher-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	mirror := filepath.Join(tmp, "dev")
+	if out, err := exec.Command("git", "clone", "-q", "--mirror", upstream.dir, mirror).CombinedOutput(); err != nil {
+		t.Fatalf("git clone --mirror: %v\n%s", err, out)
+	}
+	r := &Repo{root: mirror, path: "golang.org/x/dev", status: newStatusRing(50), defaultBranch: master}
+	branches := func() string {
+		bs, err := r.remotes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(bs, " ")
+	}
+	if got, want := branches(), master+" dev"; got != want {
+		t.Fatalf("before deletion, remotes() = %q; want %q", got, want)
+	}
+
+	upstream.git("branch", "-D", "dev")
+	if err := r.fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := branches(), master; got != want {
+		t.Errorf("after pruning fetch, remotes() = %q; want %q", got, want)
+	}
+}
+
+func TestCommitEmpty(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	initial := f.commit("a.txt", "initial")
+	normal := f.commit("a.txt", "normal")
+	f.git("commit", "-q", "--allow-empty", "-m", "empty")
+	empty := f.git("rev-parse", "HEAD")
+	f.git("checkout", "-q", "-b", "dev", initial)
+	f.commit("b.txt", "on dev")
+	f.git("checkout", "-q", master)
+	f.git("merge", "-q", "--no-ff", "-m", "merge", "dev")
+	merge := f.git("rev-parse", "HEAD")
+
+	r := f.repo()
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, hash string
+		want       bool
+	}{
+		{"initial", initial, false},
+		{"normal", normal, false},
+		{"empty", empty, true},
+		{"merge", merge, false},
+	}
+	for _, tt := range tests {
+		c := r.commits[tt.hash]
+		if c == nil {
+			t.Fatalf("%s commit %s not found", tt.name, tt.hash)
+		}
+		if got := c.Empty(); got != tt.want {
+			t.Errorf("%s commit: Empty() = %v; want %v (files %q, parents %q)", tt.name, got, tt.want, c.Files, c.Parents)
+		}
+	}
+	if got := len(r.commits[merge].Parents); got != 2 {
+		t.Errorf("merge commit has %d parents; want 2", got)
+	}
+}
+
+func TestHandleWatcherVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleWatcherVersion(w, httptest.NewRequest("GET", "/debug/watcher/version", nil))
+	var bi watcherBuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &bi); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if bi.WatcherVersion != watcherVersion {
+		t.Errorf("WatcherVersion = %d; want %d", bi.WatcherVersion, watcherVersion)
+	}
+	if bi.GoVersion == "" {
+		t.Error("GoVersion is empty")
+	}
+}
+
+func TestHandleWatcherVersionUptime(t *testing.T) {
+	defer func(now func() time.Time) { watcherNow = now }(watcherNow)
+	defer func(n *int) { watcherRestarts = n }(watcherRestarts)
+
+	dir, err := ioutil.TempDir("", "watcher-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for want := 0; want < 3; want++ {
+		n, err := recordWatcherStart(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("recordWatcherStart = %d; want %d", n, want)
+		}
+		watcherRestarts = &n
+	}
+
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    string
+	}{
+		{time.Hour, "1h0m0s"},
+		{2*time.Hour + 1500*time.Millisecond, "2h0m2s"},
+	} {
+		watcherNow = func() time.Time { return processStartTime.Add(tt.elapsed) }
+		w := httptest.NewRecorder()
+		handleWatcherVersion(w, httptest.NewRequest("GET", "/debug/watcher/version", nil))
+		var bi watcherBuildInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &bi); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		if bi.Uptime != tt.want {
+			t.Errorf("after %v, Uptime = %q; want %q", tt.elapsed, bi.Uptime, tt.want)
+		}
+		if !bi.StartTime.Equal(processStartTime) {
+			t.Errorf("StartTime = %v; want %v", bi.StartTime, processStartTime)
+		}
+		if bi.Restarts == nil || *bi.Restarts != 2 {
+			t.Errorf("Restarts = %v; want 2", bi.Restarts)
+		}
+	}
+}
+
+func TestNewRepoDashPath(t *testing.T) {
+	const dashPath = "example.com/custom/widgets"
+	var (
+		mu        sync.Mutex
+		seenPaths []string
+		posted    []dashCommit
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.URL.Path == "/commits-seen" || req.URL.Path == "/commits" {
+			// An old dashboard, without batch lookups or posts.
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method == "GET" {
+			seenPaths = append(seenPaths, req.FormValue("packagePath"))
+			fmt.Fprint(w, `{"Error": "Commit not found"}`)
+			return
+		}
+		var dc dashCommit
+		if err := json.NewDecoder(req.Body).Decode(&dc); err != nil {
+			t.Error(err)
+		}
+		posted = append(posted, dc)
+		fmt.Fprint(w, `{}`)
+	})
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	f.commit("a.txt", "second")
+	dir, err := ioutil.TempDir("", "watcher-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepo(dir, f.dir, nil, "golang.org/x/"+filepath.Base(f.dir), true, repoOptions{dashPath: dashPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.postNewCommits(r.branches[master]); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 2 {
+		t.Fatalf("posted %d commits; want 2", len(posted))
+	}
+	for _, dc := range posted {
+		if dc.PackagePath != dashPath {
+			t.Errorf("posted PackagePath %q; want %q", dc.PackagePath, dashPath)
+		}
+	}
+	for _, p := range seenPaths {
+		if p != dashPath {
+			t.Errorf("queried dashboard with packagePath %q; want %q", p, dashPath)
+		}
+	}
+}
+
+func TestRunCmdKillsStuckProcess(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("no process groups on %s", runtime.GOOS)
+	}
+	dir, err := ioutil.TempDir("", "watcher-fakegit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A fake git that ignores SIGTERM, as does its child.
+	fakeGit := filepath.Join(dir, "git")
+	script := "#!/bin/sh\ntrap '' TERM\nsleep 60 &\nwait\nwait\n"
+	if err := ioutil.WriteFile(fakeGit, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldGrace := gitKillGrace
+	gitKillGrace = 100 * time.Millisecond
+	defer func() { gitKillGrace = oldGrace }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	cmd := exec.Command(fakeGit, "fetch", "origin")
+	var out bytes.Buffer
+	cmd.Stdout = &out // not an *os.File, so Wait also waits for sleep to exit
+	t0 := time.Now()
+	err = runCmd(ctx, cmd)
+	if err != context.DeadlineExceeded {
+		t.Errorf("runCmd = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(t0); d > 10*time.Second {
+		t.Errorf("runCmd took %v to kill the stuck process", d)
+	}
+	if cmd.ProcessState == nil {
+		t.Fatal("process wasn't reaped")
+	}
+	if got := cmd.ProcessState.String(); !strings.Contains(got, "killed") {
+		t.Errorf("process state = %q; want killed", got)
+	}
+}
+
+func TestPostCommitLatency(t *testing.T) {
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{}`)
+	})
+	r := &Repo{path: "golang.org/x/postlag", status: newStatusRing(50)}
+	committed := time.Now().Add(-3 * time.Second)
+	c := &Commit{Hash: "abc", Branch: master, Date: committed.Format(time.RFC1123Z)}
+	if err := r.postCommit(c); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.postLag.count(); n != 1 {
+		t.Fatalf("recorded %d latencies; want 1", n)
+	}
+	if lag := r.postLag.percentile(50); lag < 2*time.Second || lag > time.Minute {
+		t.Errorf("recorded latency %v; want about 3s", lag)
+	}
+	ent, _ := r.status.latest()
+	if !strings.Contains(ent.status, "after commit") {
+		t.Errorf("latest status = %q; want note of latency", ent.status)
+	}
+
+	w := httptest.NewRecorder()
+	handleWatcherMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"# TYPE watcher_post_lag_seconds histogram\n",
+		`watcher_post_lag_seconds_bucket{repo="postlag",le="1"} 0` + "\n",
+		`watcher_post_lag_seconds_bucket{repo="postlag",le="5"} 1` + "\n",
+		`watcher_post_lag_seconds_count{repo="postlag"} 1` + "\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestDurationSamplesPercentile(t *testing.T) {
+	var s durationSamples
+	if got := s.percentile(50); got != 0 {
+		t.Errorf("empty percentile = %v; want 0", got)
+	}
+	for i := 100; i >= 1; i-- {
+		s.add(time.Duration(i) * time.Millisecond)
+	}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{50, 50 * time.Millisecond},
+		{95, 95 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	} {
+		if got := s.percentile(tt.p); got != tt.want {
+			t.Errorf("p%v = %v; want %v", tt.p, got, tt.want)
+		}
+	}
+	// Old samples fall out of the window.
+	for i := 0; i < len(s.ring); i++ {
+		s.add(time.Second)
+	}
+	if got := s.percentile(50); got != time.Second {
+		t.Errorf("after refill, p50 = %v; want 1s", got)
+	}
+}
+
+func TestRemotesBranchMode(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	for _, b := range []string{"dev.ssa", "release-branch.go1.9", "release-branch.r60", "release-branch.go1.8"} {
+		f.git("branch", b)
+	}
+	r := f.repo()
+
+	old := *branchMode
+	defer func() { *branchMode = old }()
+	for _, tt := range []struct {
+		mode, want string
+	}{
+		{"all", "master dev.ssa release-branch.go1.8 release-branch.go1.9"},
+		{"default-only", "master"},
+		{"default-plus-release", "master release-branch.go1.8 release-branch.go1.9"},
+	} {
+		*branchMode = tt.mode
+		bs, err := r.remotes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(bs, " "); got != tt.want {
+			t.Errorf("-watcher.branchmode=%s: remotes() = %q; want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestPushNonFastForward(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	dest := newBareGitDir(t)
+	defer os.RemoveAll(dest)
+
+	first := f.commit("a.txt", "first")
+	pushed := f.commit("a.txt", "second")
+	f.git("remote", "add", "dest", dest)
+	r := f.repo()
+	r.dests = mirrorDests([]string{dest})
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite history upstream.
+	f.git("reset", "-q", "--hard", first)
+	rewritten := f.commit("a.txt", "rewritten second")
+
+	destHead := func() string {
+		remote, err := r.getRemoteRefs("dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return remote["refs/heads/master"]
+	}
+
+	old := *allowForce
+	defer func() { *allowForce = old }()
+
+	*allowForce = false
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	if got := destHead(); got != pushed {
+		t.Errorf("without -watcher.allowForcePush, dest master = %s; want unchanged %s", got, pushed)
+	}
+	var warned bool
+	r.status.foreachDesc(func(ent statusEntry) {
+		if strings.Contains(ent.status, "refused non-fast-forward update of refs/heads/master") {
+			warned = true
+		}
+	})
+	if !warned {
+		t.Error("no status noting the refused non-fast-forward update")
+	}
+
+	*allowForce = true
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	if got := destHead(); got != rewritten {
+		t.Errorf("with -watcher.allowForcePush, dest master = %s; want %s", got, rewritten)
+	}
+}
+
+const testGerritMeta = `)]}'
+{
+  "go": {
+    "name": "go",
+    "clone_url": "https://go.googlesource.com/go",
+    "branches": {
+      "master": "1111111111111111111111111111111111111111",
+      "release-branch.go1.9": "2222222222222222222222222222222222222222"
+    }
+  },
+  "net": {
+    "name": "net",
+    "branches": {
+      "master": "3333333333333333333333333333333333333333"
+    }
+  }
+}
+`
+
+func TestGerritMetaSingleFetch(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req.URL.RawQuery)
+		mu.Unlock()
+		fmt.Fprint(w, testGerritMeta)
+	}))
+	defer ts.Close()
+
+	u := strings.Replace(gerritMetaURL([]string{master, "release-branch.go1.9"}), *gerritBase, ts.URL+"/", 1)
+	meta, err := gerritMeta(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("gerritMeta made %d requests; want 1", len(requests))
+	}
+	if want := "format=JSON&b=master&b=release-branch.go1.9"; requests[0] != want {
+		t.Errorf("query = %q; want %q", requests[0], want)
+	}
+	want := map[string]map[string]string{
+		"go": {
+			"master":               "1111111111111111111111111111111111111111",
+			"release-branch.go1.9": "2222222222222222222222222222222222222222",
+		},
+		"net": {"master": "3333333333333333333333333333333333333333"},
+	}
+	if fmt.Sprint(meta) != fmt.Sprint(want) {
+		t.Errorf("gerritMeta = %v; want %v", meta, want)
+	}
+}
+
+// cloneMirror makes a mirror clone of the fixture, as NewRepo would,
+// and returns a Repo watching it.
+func (f *gitFixture) cloneMirror() *Repo {
+	f.t.Helper()
+	tmp, err := ioutil.TempDir("", "watcher-mirror")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { os.RemoveAll(tmp) })
+	r := f.repo()
+	r.root = filepath.Join(tmp, r.name())
+	if out, err := exec.Command("git", "clone", "-q", "--mirror", f.dir, r.root).CombinedOutput(); err != nil {
+		f.t.Fatalf("git clone --mirror: %v\n%s", err, out)
+	}
+	return r
+}
+
+// tgzFiles returns the names and contents of the regular files in a tgz archive.
+func tgzFiles(t *testing.T, b []byte) map[string]string {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tarFiles(t, zr)
+}
+
+// tarFiles returns the names and contents of the regular files in a tar archive.
+func tarFiles(t *testing.T, r io.Reader) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(b)
+	}
+}
+
+func TestWorktreeArchive(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	old := f.commit("a.txt", "first")
+	head := f.commit("dir/b.txt", "second")
+	r := f.cloneMirror()
+	r.updateWorktree()
+
+	for _, tt := range []struct {
+		rev, source string
+		files       string
+	}{
+		{head, "worktree", "a.txt dir/b.txt"},
+		{old, "git-archive", "a.txt"},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+tt.rev, nil))
+		if w.Code != 200 {
+			t.Fatalf("archive of %s: status %d: %s", tt.rev, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Watcher-Archive"); got != tt.source {
+			t.Errorf("archive of %s served from %q; want %q", tt.rev, got, tt.source)
+		}
+		var names []string
+		for name := range tgzFiles(t, w.Body.Bytes()) {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != tt.files {
+			t.Errorf("archive of %s has files %q; want %q", tt.rev, got, tt.files)
+		}
+	}
+}
+
+// blockingWriter is an http.ResponseWriter whose Write signals
+// started and then blocks until release is closed.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	started, release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	close(w.started)
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestWorktreeArchiveSlowClient(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	r := f.cloneMirror()
+	r.updateWorktree()
+
+	w := &blockingWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	done := make(chan bool)
+	go func() { done <- r.serveWorktreeArchive(w, first) }()
+	<-w.started
+
+	// While the client is stalled, the worktree can still move on.
+	second := f.commit("b.txt", "second")
+	if err := r.fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	updated := make(chan struct{})
+	go func() {
+		r.updateWorktree()
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(10 * time.Second):
+		t.Fatal("updateWorktree blocked by a slow archive download")
+	}
+	close(w.release)
+	if !<-done {
+		t.Fatalf("archive of %s not served from the worktree", first)
+	}
+	if got := tgzFiles(t, w.Body.Bytes()); len(got) != 1 {
+		t.Errorf("archive of %s has files %v; want just a.txt", first, got)
+	}
+
+	w2 := httptest.NewRecorder()
+	if !r.serveWorktreeArchive(w2, second) {
+		t.Fatalf("archive of %s not served from the worktree", second)
+	}
+	if got := tgzFiles(t, w2.Body.Bytes()); len(got) != 2 {
+		t.Errorf("archive of %s has files %v; want a.txt and b.txt", second, got)
+	}
+}
+
+func TestFetchLatency(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	r := f.cloneMirror()
+
+	for i := 0; i < 3; i++ {
+		if err := r.fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.fetchLag.count(); n != 3 {
+		t.Errorf("recorded %d fetch durations; want 3", n)
+	}
+
+	w := httptest.NewRecorder()
+	r.serveStatus(w, httptest.NewRequest("GET", "/debug/watcher/"+r.name(), nil))
+	if !strings.Contains(w.Body.String(), "fetch latency: p50 ") {
+		t.Errorf("status page lacks fetch latency:\n%s", w.Body)
+	}
+
+	// The metrics report the same percentiles, of known durations.
+	registerRepo(r)
+	defer unregisterRepo(r)
+	r.fetchLag = durationSamples{}
+	for i := 1; i <= 100; i++ {
+		r.fetchLag.add(time.Duration(i) * 10 * time.Millisecond)
+	}
+	w = httptest.NewRecorder()
+	handleWatcherMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	repo := `{repo="` + r.name() + `"`
+	for _, want := range []string{
+		"# TYPE watcher_fetch_latency_seconds summary\n",
+		"watcher_fetch_latency_seconds" + repo + `,quantile="0.5"} 0.5` + "\n",
+		"watcher_fetch_latency_seconds" + repo + `,quantile="0.95"} 0.95` + "\n",
+		"watcher_fetch_latency_seconds" + repo + `,quantile="0.99"} 0.99` + "\n",
+		"watcher_fetch_latency_seconds_sum" + repo + "} 50.5\n",
+		"watcher_fetch_latency_seconds_count" + repo + "} 100\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestArchiveRevs(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	hash := f.commit("a.txt", "first")
+	f.git("tag", "v1.0")
+	f.git("update-ref", "refs/changes/01/1/1", hash)
+	r := f.cloneMirror()
+
+	kinds, err := parseArchiveRevs("heads, tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := archiveRevKinds
+	defer func() { archiveRevKinds = old }()
+	archiveRevKinds = kinds
+
+	for _, tt := range []struct {
+		rev  string
+		want int
+	}{
+		{"master", 200},
+		{"refs/heads/master", 200},
+		{"v1.0", 200},
+		{hash, 403},
+		{"changes/01/1/1", 400},      // invalid rev
+		{"refs/changes/01/1/1", 400}, // invalid rev
+		{"--output=/tmp/x", 400},     // invalid rev
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+tt.rev, nil))
+		if w.Code != tt.want {
+			t.Errorf("archive of %q: status %d; want %d", tt.rev, w.Code, tt.want)
+		}
+	}
+
+	if _, err := parseArchiveRevs("heads,changes"); err == nil {
+		t.Error("parseArchiveRevs accepted unknown kind")
+	}
+}
+
+func TestServeAuthors(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	defer func(now func() time.Time) { watcherNow = now }(watcherNow)
+	watcherNow = func() time.Time { return now }
+	r := &Repo{
+		path:     "golang.org/x/fake",
+		commits:  make(map[string]*Commit),
+		branches: make(map[string]*Branch),
+	}
+	add := func(author string, age time.Duration) {
+		hash := fmt.Sprintf("%040x", len(r.commits))
+		c := &Commit{Hash: hash, Author: author, Date: now.Add(-age).Format(commitDateFormat)}
+		r.commits[hash] = c
+		r.addAuthor(c)
+	}
+	for _, c := range []struct {
+		author string
+		age    time.Duration
+	}{
+		{"Alice <alice@example.com>", time.Hour},
+		{"Carol <carol@example.com>", 10 * 24 * time.Hour},
+		{"Alice <alice@example.com>", 2 * 24 * time.Hour},
+		{"Dave <dave@example.com>", 400 * 24 * time.Hour}, // outside maxAuthorsWindow
+		{"Bob <bob@example.com>", 3 * 24 * time.Hour},
+		{"Alice <alice@example.com>", 40 * 24 * time.Hour},
+	} {
+		add(c.author, c.age)
+	}
+	r.recordSnapshot()
+
+	for _, tt := range []struct {
+		since string
+		want  map[string]int
+	}{
+		{"", map[string]int{"alice@example.com": 2, "bob@example.com": 1, "carol@example.com": 1}},
+		{now.Add(-5 * 24 * time.Hour).Format(time.RFC3339), map[string]int{"alice@example.com": 2, "bob@example.com": 1}},
+		{now.Add(-60 * 24 * time.Hour).Format("2006-01-02"), map[string]int{"alice@example.com": 3, "bob@example.com": 1, "carol@example.com": 1}},
+	} {
+		w := httptest.NewRecorder()
+		r.serveAuthors(w, httptest.NewRequest("GET", "/debug/watcher/fake/authors?since="+tt.since, nil))
+		if w.Code != 200 {
+			t.Fatalf("since=%q: status %d: %s", tt.since, w.Code, w.Body)
+		}
+		var got map[string]int
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("since=%q: counts = %v; want %v", tt.since, got, tt.want)
+		}
+	}
+
+	for _, since := range []string{"yesterday", "2000-01-01"} {
+		w := httptest.NewRecorder()
+		r.serveAuthors(w, httptest.NewRequest("GET", "/debug/watcher/fake/authors?since="+since, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("since=%q: status %d; want %d", since, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Only commits within maxAuthorsWindow are kept, newest first,
+	// and later ones are merged in as they're added.
+	authors := func() (s []string) {
+		for _, a := range r.snapshot().Authors {
+			s = append(s, a.Email)
+		}
+		return s
+	}
+	if got, want := authors(), []string{"alice@example.com", "alice@example.com", "bob@example.com", "carol@example.com", "alice@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("authors = %q; want %q", got, want)
+	}
+	add("Bob <bob@example.com>", 5*24*time.Hour)
+	r.recordSnapshot()
+	if got, want := authors(), []string{"alice@example.com", "alice@example.com", "bob@example.com", "bob@example.com", "carol@example.com", "alice@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after adding a commit, authors = %q; want %q", got, want)
+	}
+
+	// As time passes, commits fall out of the window.
+	now = now.Add(maxAuthorsWindow - 20*24*time.Hour)
+	r.recordSnapshot()
+	if got, want := authors(), []string{"alice@example.com", "alice@example.com", "bob@example.com", "bob@example.com", "carol@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%v later, authors = %q; want %q", maxAuthorsWindow-20*24*time.Hour, got, want)
+	}
+}
+
+func TestGerritMetaSchemaChange(t *testing.T) {
+	for _, tt := range []struct {
+		name, body string
+		warn       bool
+	}{
+		{"ok", testGerritMeta, false},
+		{"empty", ")]}'\n{}\n", false},
+		{"renamed", ")]}'\n{\"go\": {\"name\": \"go\", \"refs\": {\"heads/master\": \"1111111111111111111111111111111111111111\"}}}\n", true},
+		{"nested", ")]}'\n{\"projects\": {\"go\": {\"branches\": {\"master\": \"1111111111111111111111111111111111111111\"}}}}\n", true},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, tt.body)
+		}))
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		meta, err := gerritMeta(ts.URL + "/?format=JSON")
+		log.SetOutput(os.Stderr)
+		ts.Close()
+
+		if err != nil || meta == nil {
+			t.Errorf("%s: gerritMeta = %v, %v; want a map", tt.name, meta, err)
+		}
+		if got := strings.Contains(buf.String(), "warning: no branches decoded"); got != tt.warn {
+			t.Errorf("%s: warned = %v; want %v; log:\n%s", tt.name, got, tt.warn, buf.String())
+		}
+	}
+}
+
+func TestServeTarAcceptEncoding(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	r := f.cloneMirror()
+
+	for _, tt := range []struct {
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"gzip;q=0", false},
+		{"identity", false},
+	} {
+		req := httptest.NewRequest("GET", "/"+r.name()+".tar.gz?format=tar&rev="+head, nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Accept-Encoding %q: status %d: %s", tt.acceptEncoding, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/x-tar" {
+			t.Errorf("Accept-Encoding %q: Content-Type = %q; want application/x-tar", tt.acceptEncoding, got)
+		}
+		body := w.Body.Bytes()
+		if got := w.Header().Get("Content-Encoding"); (got == "gzip") != tt.gzipped {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q; want gzip = %v", tt.acceptEncoding, got, tt.gzipped)
+		}
+		if tt.gzipped {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if files := tarFiles(t, bytes.NewReader(body)); files["a.txt"] != "version 1\n" {
+			t.Errorf("Accept-Encoding %q: archive files = %q; want a.txt", tt.acceptEncoding, files)
+		}
+	}
+}
+
+func TestCheckRepoRoots(t *testing.T) {
+	if err := checkRepoRoots("/cache", []string{"", "golang.org/x/net", "golang.org/x/tools"}); err != nil {
+		t.Errorf("distinct repos: %v", err)
+	}
+	err := checkRepoRoots("/cache", []string{"", "golang.org/x/net", "example.com/net", "golang.org/x/go"})
+	if err == nil {
+		t.Fatal("aliased repos: no error")
+	}
+	for _, want := range []string{
+		filepath.Join("/cache", "net") + " (golang.org/x/net, example.com/net)",
+		filepath.Join("/cache", "go") + " (go, golang.org/x/go)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestWatchCancel(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	r := f.cloneMirror()
+	r.dash = false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- r.Watch(ctx) }()
+
+	// Wait for Watch to finish its first cycle and sleep.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if ent, ok := r.status.latest(); ok && ent.status == "waiting" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Watch never started waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Watch = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return after cancellation")
+	}
+	if ent, _ := r.status.latest(); ent.status != "stopped" {
+		t.Errorf("final status = %q; want stopped", ent.status)
+	}
+}
+
+func TestNewRepoCloneRetry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git is a shell script")
+	}
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found")
+	}
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+
+	// Install a fake git whose first clone leaves a partial
+	// directory behind and fails.
+	bin, err := ioutil.TempDir("", "watcher-fakegit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	marker := filepath.Join(bin, "failed")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = clone ] && [ ! -e %q ]; then
+	touch %q
+	mkdir -p "$4" && echo partial > "$4/junk"
+	echo "fatal: the remote end hung up unexpectedly" >&2
+	exit 128
+fi
+exec %q "$@"
+`, marker, marker, realGit)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	defer func(sleep func(time.Duration)) { trySleep = sleep }(trySleep)
+	trySleep = func(time.Duration) {}
+
+	dir, err := ioutil.TempDir("", "watcher-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRepo(dir, f.dir, nil, "golang.org/x/"+filepath.Base(f.dir), false, repoOptions{})
+	if err != nil {
+		t.Fatalf("NewRepo: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatal("fake git clone never failed")
+	}
+	if _, err := os.Stat(filepath.Join(r.root, "junk")); err == nil {
+		t.Error("partial clone not cleaned up before retry")
+	}
+	var attempts []string
+	r.status.foreachDesc(func(ent statusEntry) {
+		if strings.HasPrefix(ent.status, "running fresh git clone") {
+			attempts = append(attempts, ent.status)
+		}
+	})
+	if len(attempts) != 2 || !strings.Contains(attempts[0], "attempt 2 of 3") {
+		t.Errorf("clone attempt statuses = %q; want 2, the latest attempt 2 of 3", attempts)
+	}
+}
+
+func TestServeGitArchiveStreaming(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	r := f.cloneMirror()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+head, nil))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Length"); got != "" {
+		t.Errorf("streamed archive has Content-Length %s", got)
+	}
+	if files := tgzFiles(t, w.Body.Bytes()); files["a.txt"] != "version 1\n" {
+		t.Errorf("archive files = %q; want a.txt", files)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+strings.Repeat("0", 40), nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("bad rev: status %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	if ct := w.Header().Get("Content-Type"); ct == "application/x-compressed" {
+		t.Errorf("bad rev: Content-Type = %q", ct)
+	}
+}
+
+func TestNewRepoNameOverride(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	dir, err := ioutil.TempDir("", "watcher-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Base(f.dir) + "-v2"
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	r, err := NewRepo(dir, f.dir, nil, "golang.org/x/"+filepath.Base(f.dir), false, repoOptions{name: name})
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.name() != name {
+		t.Errorf("name() = %q; want %q", r.name(), name)
+	}
+	if want := filepath.Join(dir, name); r.root != want {
+		t.Errorf("root = %q; want %q", r.root, want)
+	}
+	if !strings.Contains(buf.String(), name+": cloning ") {
+		t.Errorf("log lacks %q prefix:\n%s", name+": ", buf.String())
+	}
+
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/"+name+".tar.gz?rev="+head, nil))
+	if w.Code != 200 {
+		t.Errorf("GET /%s.tar.gz: status %d: %s", name, w.Code, w.Body)
+	}
+}
+
+func TestArchiveZipFormat(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	r := f.cloneMirror()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?format=zip&rev="+head, nil))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/zip" {
+		t.Errorf("Content-Type = %q; want application/zip", got)
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="`+r.name()+"-"+head+`.zip"`; got != want {
+		t.Errorf("Content-Disposition = %q; want %q", got, want)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "a.txt" {
+		t.Errorf("zip has files %v; want a.txt", zr.File)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?format=rar&rev="+head, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("format=rar: status %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		beats []time.Time
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/heartbeat" {
+			var body struct {
+				PackagePath string
+				Time        time.Time
+			}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			beats = append(beats, body.Time)
+			mu.Unlock()
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	defer func(d time.Duration) { *heartbeat = d }(*heartbeat)
+	*heartbeat = time.Minute
+	defer func(now func() time.Time) { watcherNow = now }(watcherNow)
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	var now time.Time
+	watcherNow = func() time.Time { return now }
+
+	r := &Repo{path: "golang.org/x/fake", dash: true, status: newStatusRing(50)}
+	for _, elapsed := range []time.Duration{0, 30 * time.Second, 59 * time.Second, time.Minute, 90 * time.Second, 2*time.Minute + time.Second} {
+		now = start.Add(elapsed)
+		r.maybeHeartbeat()
+	}
+	want := []time.Time{start, start.Add(time.Minute), start.Add(2*time.Minute + time.Second)}
+	if fmt.Sprint(beats) != fmt.Sprint(want) {
+		t.Errorf("heartbeats at %v; want %v", beats, want)
+	}
+}
+
+func TestLastSeenBatch(t *testing.T) {
+	const n, known = 3000, 1234 // commits on the branch; oldest known to the dashboard
+	r := &Repo{path: "golang.org/x/fake", commits: make(map[string]*Commit), status: newStatusRing(50)}
+	var parent *Commit
+	for i := 0; i < n; i++ {
+		c := &Commit{Hash: fmt.Sprintf("%040x", i), parent: parent}
+		r.commits[c.Hash] = c
+		parent = c
+	}
+	head := parent.Hash
+	want := fmt.Sprintf("%040x", known-1)
+
+	for _, batch := range []bool{true, false} {
+		var (
+			mu               sync.Mutex
+			batches, singles int
+		)
+		fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			isKnown := func(h string) bool {
+				var i int
+				fmt.Sscanf(h, "%x", &i)
+				return i < known
+			}
+			switch req.URL.Path {
+			case "/commits-seen":
+				if !batch {
+					fmt.Fprint(w, `{"Error": "unsupported version"}`)
+					return
+				}
+				batches++
+				var body struct {
+					PackagePath string
+					Hashes      []string
+				}
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					t.Error(err)
+				}
+				if len(body.Hashes) > seenBatchSize {
+					t.Errorf("batch of %d hashes; want at most %d", len(body.Hashes), seenBatchSize)
+				}
+				seen := make(map[string]bool)
+				for _, h := range body.Hashes {
+					if isKnown(h) {
+						seen[h] = true
+					}
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"Response": seen})
+			case "/commit":
+				singles++
+				if isKnown(req.FormValue("hash")) {
+					fmt.Fprint(w, `{}`)
+				} else {
+					fmt.Fprint(w, `{"Error": "Commit not found"}`)
+				}
+			}
+		})
+		r.noSeenBatch = false
+
+		c, err := r.lastSeen(head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == nil || c.Hash != want {
+			t.Errorf("batch=%v: lastSeen = %v; want %v", batch, c, want)
+		}
+		if batch {
+			// 3000 -> 47 -> 1 candidates.
+			if batches != 2 || singles != 0 {
+				t.Errorf("made %d batch and %d single lookups; want 2 and 0", batches, singles)
+			}
+		} else if !r.noSeenBatch || singles == 0 {
+			t.Errorf("noSeenBatch = %v after %d single lookups; want fallback", r.noSeenBatch, singles)
+		}
+	}
+}
+
+func TestBootstrapDepth(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		posted []dashCommit
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req.URL.Path == "/commits-seen":
+			fmt.Fprint(w, `{"Response": {}}`)
+		case req.URL.Path == "/commits":
+			http.NotFound(w, req)
+		case req.Method == "GET":
+			fmt.Fprint(w, `{"Error": "Commit not found"}`)
+		default:
+			var dc dashCommit
+			if err := json.NewDecoder(req.Body).Decode(&dc); err != nil {
+				t.Error(err)
+			}
+			posted = append(posted, dc)
+			fmt.Fprint(w, `{}`)
+		}
+	})
+	defer func(n int) { *maxBootstrap = n }(*maxBootstrap)
+	*maxBootstrap = 10
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	var hashes []string
+	for i := 0; i < 50; i++ {
+		hashes = append(hashes, f.commit("a.txt", fmt.Sprintf("commit %d", i)))
+	}
+	r := f.repo()
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 10 {
+		t.Fatalf("posted %d commits; want 10", len(posted))
+	}
+	for i, dc := range posted {
+		if want := hashes[40+i]; dc.Hash != want {
+			t.Errorf("post %d is %s; want %s", i, dc.Hash, want)
+		}
+	}
+	if posted[0].ParentHash != "" {
+		t.Errorf("first post has parent %s; want none", posted[0].ParentHash)
+	}
+	if posted[1].ParentHash != hashes[40] {
+		t.Errorf("second post has parent %s; want %s", posted[1].ParentHash, hashes[40])
+	}
+}
+
+func TestTryBackoff(t *testing.T) {
+	var sleeps []time.Duration
+	defer func(sleep func(time.Duration)) { trySleep = sleep }(trySleep)
+	trySleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	const n, backoff = 5, time.Second
+	calls := 0
+	err := try(n, backoff, func() error {
+		calls++
+		if calls < n {
+			return fmt.Errorf("failure %d", calls)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("try = %v; want success on attempt %d", err, n)
+	}
+	if calls != n {
+		t.Errorf("fn called %d times; want %d", calls, n)
+	}
+	if len(sleeps) != n-1 {
+		t.Fatalf("slept %d times; want %d", len(sleeps), n-1)
+	}
+	for i, d := range sleeps {
+		min := backoff << uint(i)
+		if d < min || d > min+min/2 {
+			t.Errorf("sleep %d = %v; want in [%v, %v]", i, d, min, min+min/2)
+		}
+		if i > 0 && d <= sleeps[i-1] {
+			t.Errorf("sleep %d = %v; not longer than previous %v", i, d, sleeps[i-1])
+		}
+	}
+
+	// Giving up returns the last error, and sleeps are capped.
+	sleeps, calls = nil, 0
+	err = try(12, time.Minute, func() error {
+		calls++
+		return fmt.Errorf("failure %d", calls)
+	})
+	if err == nil || err.Error() != "failure 12" {
+		t.Errorf("try = %v; want failure 12", err)
+	}
+	for _, d := range sleeps {
+		if d > maxBackoff {
+			t.Errorf("slept %v; want at most %v", d, maxBackoff)
+		}
+	}
+}
+
+func TestUpdateManyBranches(t *testing.T) {
+	offline(t)
+	defer func(n int) { *logWorkers = n }(*logWorkers)
+	*logWorkers = 3
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	base := f.commit("a.txt", "first")
+	heads := map[string]string{}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("dev.b%d", i)
+		f.git("checkout", "-q", "-b", name, base)
+		for j := 0; j <= i; j++ {
+			heads[name] = f.commit(fmt.Sprintf("b%d.txt", i), fmt.Sprintf("%s change %d", name, j))
+		}
+	}
+	f.git("checkout", "-q", master)
+	heads[master] = f.commit("a.txt", "second")
+
+	r := f.repo()
+	for round := 0; round < 2; round++ {
+		if err := r.update(false); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.branches) != len(heads) {
+			t.Fatalf("found %d branches; want %d", len(r.branches), len(heads))
+		}
+		for name, head := range heads {
+			b := r.branches[name]
+			if b == nil || b.Head.Hash != head {
+				t.Errorf("round %d: branch %s = %v; want head %s", round, name, b, head)
+			}
+		}
+		// 1 + 2 + ... + 8 branch commits, plus 2 on master,
+		// plus 2 more each round.
+		if want := 36 + 2 + 2*round; len(r.commits) != want {
+			t.Errorf("round %d: %d commits; want %d", round, len(r.commits), want)
+		}
+		for _, c := range r.commits {
+			if c.Hash == base {
+				if c.Branch != master {
+					t.Errorf("shared commit %v attributed to %q; want master", c, c.Branch)
+				}
+				continue
+			}
+			if c.parent == nil || c.parent.Hash != c.Parent {
+				t.Errorf("round %d: %v not linked to parent %s", round, c, c.Parent)
+			}
+		}
+		// Advance a few branches for the next round.
+		f.git("checkout", "-q", "dev.b3")
+		heads["dev.b3"] = f.commit("b3.txt", "more")
+		f.git("checkout", "-q", "dev.b7")
+		heads["dev.b7"] = f.commit("b7.txt", "more")
+		f.git("checkout", "-q", master)
+	}
+}
+
+func TestUpdateMergeParents(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		posted []string
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req.URL.Path == "/commits-seen", req.URL.Path == "/commits":
+			http.NotFound(w, req)
+		case req.Method == "GET":
+			for _, h := range posted {
+				if h == req.FormValue("hash") {
+					fmt.Fprint(w, `{}`)
+					return
+				}
+			}
+			fmt.Fprint(w, `{"Error": "Commit not found"}`)
+		default:
+			var dc dashCommit
+			if err := json.NewDecoder(req.Body).Decode(&dc); err != nil {
+				t.Error(err)
+			}
+			posted = append(posted, dc.Hash)
+			fmt.Fprint(w, `{}`)
+		}
+	})
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	f.git("checkout", "-q", "-b", "release-branch.go1.9")
+	fix := f.commit("b.txt", "release fix")
+	f.git("checkout", "-q", master)
+	second := f.commit("a.txt", "second")
+	f.git("merge", "-q", "--no-ff", "-m", "merge release-branch.go1.9", "release-branch.go1.9")
+	merge := f.git("rev-parse", "HEAD")
+
+	r := f.repo()
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	m := r.commits[merge]
+	if got := strings.Join(m.Parents, " "); got != second+" "+fix {
+		t.Errorf("merge Parents = %q; want %q", got, second+" "+fix)
+	}
+	if m.Parent != second || m.parent != r.commits[second] {
+		t.Errorf("merge first parent = %s; want %s", m.Parent, second)
+	}
+	if len(m.parents) != 2 || m.parents[1] != r.commits[fix] {
+		t.Errorf("merge not linked to both parents: %v", m.parents)
+	}
+	var isChild bool
+	for _, c := range r.commits[fix].children {
+		isChild = isChild || c == m
+	}
+	if !isChild {
+		t.Errorf("merge not among children of second parent %s", fix)
+	}
+
+	// Each commit on master is posted once, after its first parent.
+	order := map[string]int{}
+	for i, h := range posted {
+		if _, dup := order[h]; dup {
+			t.Errorf("commit %s posted twice", h)
+		}
+		order[h] = i
+	}
+	for _, h := range []string{first, fix, second, merge} {
+		if _, ok := order[h]; !ok {
+			t.Errorf("commit %s not posted", h)
+		}
+	}
+	if order[merge] < order[second] || order[second] < order[first] {
+		t.Errorf("posted in order %v; want each commit after its first parent", posted)
+	}
+}
+
+func TestCommitOriginalBranch(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	f.git("checkout", "-q", "-b", "dev.feature")
+	feature := f.commit("b.txt", "feature")
+	f.git("checkout", "-q", master)
+
+	r := f.repo()
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	if c := r.commits[feature]; c.Branch != "dev.feature" || c.OriginalBranch != "dev.feature" {
+		t.Errorf("before merge, Branch, OriginalBranch = %q, %q; want dev.feature, dev.feature", c.Branch, c.OriginalBranch)
+	}
+	f.git("merge", "-q", "--ff-only", "dev.feature")
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		hash, branch, original string
+	}{
+		{first, master, master},
+		{feature, master, "dev.feature"},
+	} {
+		c := r.commits[tt.hash]
+		_, _, body := goDashFormat{}.commitRequest(r, c, time.Now())
+		dc := body.(*dashCommit)
+		if dc.Branch != tt.branch || dc.OriginalBranch != tt.original {
+			t.Errorf("%v posted with Branch, OriginalBranch = %q, %q; want %q, %q",
+				c, dc.Branch, dc.OriginalBranch, tt.branch, tt.original)
+		}
+	}
+}
+
+func TestWatcherMetrics(t *testing.T) {
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{}`)
+	})
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	r := f.cloneMirror()
+	if err := r.fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c := &Commit{Hash: "abc", Branch: master, Date: testDate}
+	for i := 0; i < 2; i++ {
+		if err := r.postCommit(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleWatcherMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	repo := `{repo="` + r.name() + `"`
+	for _, want := range []string{
+		"# TYPE watcher_fetch_duration_seconds histogram\n",
+		"watcher_fetch_attempts_total" + repo + "} 1\n",
+		"watcher_fetch_duration_seconds_bucket" + repo + `,le="+Inf"} 1` + "\n",
+		"watcher_fetch_duration_seconds_count" + repo + "} 1\n",
+		"# TYPE watcher_commits_posted_total counter\n",
+		"watcher_commits_posted_total" + repo + "} 2\n",
+		"watcher_post_duration_seconds_count" + repo + "} 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "watcher_fetch_failures_total"+repo) {
+		t.Errorf("metrics report fetch failures:\n%s", body)
+	}
+}
+
+func TestServeStatusJSON(t *testing.T) {
+	r := &Repo{path: "golang.org/x/fake", status: newStatusRing(50)}
+	for _, s := range []string{"first", "second", "third"} {
+		r.setStatus(s)
+	}
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/debug/watcher/fake?format=json", nil),
+		func() *http.Request {
+			req := httptest.NewRequest("GET", "/debug/watcher/fake", nil)
+			req.Header.Set("Accept", "application/json, text/plain")
+			return req
+		}(),
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%v: Content-Type = %q; want application/json", req.URL, ct)
+		}
+		var ents []struct {
+			Time       time.Time `json:"time"`
+			AgeSeconds float64   `json:"age_seconds"`
+			Status     string    `json:"status"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &ents); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		var got []string
+		for _, e := range ents {
+			got = append(got, e.Status)
+			if e.Time.IsZero() || e.AgeSeconds < 0 {
+				t.Errorf("entry %+v lacks time or has negative age", e)
+			}
+		}
+		if want := "third second first"; strings.Join(got, " ") != want {
+			t.Errorf("statuses = %q; want %q", got, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/debug/watcher/fake", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/html" {
+		t.Errorf("default Content-Type = %q; want text/html", ct)
+	}
+}
+
+func TestArchiveRepos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var names, heads []string
+	for i := 0; i < 2; i++ {
+		f := newGitFixture(t)
+		defer f.cleanup()
+		heads = append(heads, f.commit("a.txt", "first"))
+		names = append(names, filepath.Base(f.dir))
+		if i == 0 {
+			defer func(s string) { *archiveRepos = s }(*archiveRepos)
+			*archiveRepos = "other," + names[0]
+		}
+		if _, err := NewRepo(dir, f.dir, nil, "golang.org/x/"+names[i], false, repoOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []int{200, 404} {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/"+names[i]+".tar.gz?rev="+heads[i], nil))
+		if w.Code != want {
+			t.Errorf("GET /%s.tar.gz: status %d; want %d", names[i], w.Code, want)
+		}
+	}
+}
+
+func TestArchiveCacheLevels(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	var big bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&big, "line %d %x\n", i, uint32(i*i)*2654435761)
+	}
+	if err := ioutil.WriteFile(filepath.Join(f.dir, "big.txt"), big.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.git("add", "big.txt")
+	head := f.commit("a.txt", "first")
+	r := f.cloneMirror()
+
+	old := archiveCache
+	defer func() { archiveCache = old }()
+	archiveCache = newArchiveLRU(1 << 30)
+
+	get := func(query, wantCache string) []byte {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+head+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: status %d: %s", query, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Watcher-Cache"); got != wantCache {
+			t.Errorf("%s: X-Watcher-Cache = %q; want %q", query, got, wantCache)
+		}
+		return w.Body.Bytes()
+	}
+	fast := get("&level=1", "miss")
+	best := get("&level=9", "miss")
+	if bytes.Equal(fast, best) {
+		t.Errorf("level 1 and level 9 archives are identical")
+	}
+	if n := archiveCache.len(); n != 2 {
+		t.Errorf("cache has %d entries; want 2", n)
+	}
+	if got := get("&level=1", "hit"); !bytes.Equal(got, fast) {
+		t.Errorf("cached level 1 archive differs from the original")
+	}
+	if got := get("&level=9", "hit"); !bytes.Equal(got, best) {
+		t.Errorf("cached level 9 archive differs from the original")
+	}
+	if got := tgzFiles(t, best); len(got) != 2 {
+		t.Errorf("level 9 archive has files %v; want a.txt and big.txt", got)
+	}
+
+	// Branch names are mutable, so their archives aren't cached.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev=master&level=1", nil))
+	if got := w.Header().Get("X-Watcher-Cache"); got != "" {
+		t.Errorf("rev=master: X-Watcher-Cache = %q; want none", got)
+	}
+
+	for _, q := range []string{"&level=10", "&level=x", "&format=tar&level=1"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+head+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d; want %d", q, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestServeHTTPInvalidRev(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	f.git("tag", "v1")
+	f.git("update-ref", "refs/changes/01/1/1", head)
+	r := f.cloneMirror()
+
+	get := func(rev string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+url.QueryEscape(rev), nil))
+		return w
+	}
+	for _, rev := range []string{head, "master", "refs/heads/master", "refs/tags/v1", "v1"} {
+		if w := get(rev); w.Code != 200 {
+			t.Errorf("rev %q: status %d: %s", rev, w.Code, w.Body)
+		}
+	}
+	for _, rev := range []string{
+		"--output=/tmp/x",
+		"-o",
+		"master..v1",
+		"refs/heads/../tags/v1",
+		"master~1",
+		"master^",
+		"master:a.txt",
+		"HEAD@{1}",
+		"/refs/heads/master",
+		"refs/heads/",
+		"refs//heads/master",
+		"master v1",
+		"HEAD",
+		"HEAD^",
+		"heads/master",
+		"refs/changes/01/1/1",
+		"refs/remotes/origin/master",
+		"no-such-branch",
+		head[:12],
+	} {
+		if w := get(rev); w.Code != http.StatusBadRequest {
+			t.Errorf("rev %q: status %d; want %d", rev, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestArchiveCacheHitMiss(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	second := f.commit("a.txt", "second")
+	r := f.cloneMirror()
+
+	old := archiveCache
+	defer func() { archiveCache = old }()
+	defer func(d time.Duration) { *archiveTTL = d }(*archiveTTL)
+	*archiveTTL = time.Hour
+	now := time.Now()
+	defer func(now func() time.Time) { watcherNow = now }(watcherNow)
+	watcherNow = func() time.Time { return now }
+
+	get := func(rev, format, wantCache string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+rev+"&format="+format, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s %s: status %d: %s", format, rev, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Watcher-Cache"); got != wantCache {
+			t.Errorf("%s %s: X-Watcher-Cache = %q; want %q", format, rev, got, wantCache)
+		}
+		return w.Body.Len()
+	}
+
+	// Size the cache to hold the zip and either tgz, but not all three.
+	archiveCache = nil
+	tgz1, zip1, tgz2 := get(first, "tgz", ""), get(first, "zip", ""), get(second, "tgz", "")
+	if tgz2 > tgz1 {
+		tgz1 = tgz2
+	}
+	archiveCache = newArchiveLRU(int64(zip1 + tgz1))
+
+	get(first, "tgz", "miss")
+	get(first, "tgz", "hit")
+	get(first, "zip", "miss") // same rev, different format
+	get(first, "zip", "hit")
+	get(second, "tgz", "miss") // evicts the least recently used, first's tgz
+	get(first, "zip", "hit")
+	get(first, "tgz", "miss")
+
+	// Expired archives are made afresh.
+	now = now.Add(30 * time.Minute)
+	get(first, "tgz", "hit")
+	now = now.Add(time.Hour)
+	get(first, "tgz", "miss")
+	get(first, "tgz", "hit")
+
+	// Archives bigger than the whole cache aren't cached.
+	archiveCache = newArchiveLRU(int64(zip1 - 1))
+	get(first, "zip", "miss")
+	get(first, "zip", "miss")
+	if n := archiveCache.len(); n != 0 {
+		t.Errorf("cache has %d entries; want none", n)
+	}
+}
+
+func TestArchiveShared(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	rev := f.commit("a.txt", "first")
+	r := f.cloneMirror()
+
+	old := archiveCache
+	defer func() { archiveCache = old }()
+	archiveCache = nil // sharing doesn't depend on the cache
+
+	// Install a fake git that logs each git archive run and
+	// slows it down, so the requests below overlap.
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := ioutil.TempDir("", "watcher-fakegit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	runs := filepath.Join(bin, "runs")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = archive ]; then echo run >>%q; sleep 1; fi\nexec %q \"$@\"\n", runs, realGit)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	const n = 5
+	var wg sync.WaitGroup
+	ws := make([]*httptest.ResponseRecorder, n)
+	for i := range ws {
+		ws[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/"+r.name()+".tar.gz?rev="+rev, nil))
+		}(ws[i])
+	}
+	wg.Wait()
+	for i, w := range ws {
+		if w.Code != 200 {
+			t.Fatalf("request %d: status %d: %s", i, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Watcher-Shared"); got != "true" {
+			t.Errorf("request %d: X-Watcher-Shared = %q; want \"true\"", i, got)
+		}
+		if !bytes.Equal(w.Body.Bytes(), ws[0].Body.Bytes()) {
+			t.Errorf("request %d got a different archive than request 0", i)
+		}
+	}
+	ran, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(ran), "run\n"); got != 1 {
+		t.Errorf("git archive ran %d times for %d concurrent requests; want 1", got, n)
+	}
+}
+
+func TestStatusRingWraparound(t *testing.T) {
+	r := newStatusRing(3)
+	if _, ok := r.latest(); ok {
+		t.Errorf("latest of empty ring ok")
+	}
+	descs := func() []string {
+		var got []string
+		r.foreachDesc(func(ent statusEntry) { got = append(got, ent.status) })
+		return got
+	}
+	for i, want := range [][]string{
+		{"s0"},
+		{"s1", "s0"},
+		{"s2", "s1", "s0"},
+		{"s3", "s2", "s1"},
+		{"s4", "s3", "s2"},
+		{"s5", "s4", "s3"},
+		{"s6", "s5", "s4"},
+	} {
+		r.add(fmt.Sprintf("s%d", i))
+		if got := descs(); !reflect.DeepEqual(got, want) {
+			t.Errorf("after %d adds: foreachDesc = %q; want %q", i+1, got, want)
+		}
+		if ent, ok := r.latest(); !ok || ent.status != want[0] {
+			t.Errorf("after %d adds: latest = %q, %v; want %q", i+1, ent.status, ok, want[0])
+		}
+		held, total := r.count()
+		if held != len(want) || total != i+1 {
+			t.Errorf("after %d adds: count = %d, %d; want %d, %d", i+1, held, total, len(want), i+1)
+		}
+	}
+
+	repo := &Repo{path: "golang.org/x/fake", status: r}
+	w := httptest.NewRecorder()
+	repo.serveStatus(w, httptest.NewRequest("GET", "/debug/watcher/fake", nil))
+	if !strings.Contains(w.Body.String(), "showing last 3 of 7 entries") {
+		t.Errorf("status page lacks entry count:\n%s", w.Body)
+	}
+}
+
+func TestDefaultBranchMain(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.git("symbolic-ref", "HEAD", "refs/heads/main")
+	initial := f.commit("a.txt", "initial")
+	f.commit("a.txt", "second")
+	f.git("checkout", "-q", "-b", "dev", initial)
+	onDev := f.commit("b.txt", "on dev")
+	f.git("checkout", "-q", "main")
+
+	dir, err := ioutil.TempDir("", "watcher-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRepo(dir, f.dir, nil, "golang.org/x/"+filepath.Base(f.dir), false, repoOptions{})
+	if err != nil {
+		t.Fatalf("NewRepo: %v", err)
+	}
+	if r.defaultBranch != "main" {
+		t.Fatalf("defaultBranch = %q; want main", r.defaultBranch)
+	}
+	bs, err := r.remotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 2 || bs[0] != "main" {
+		t.Errorf("remotes = %q; want main first, then dev", bs)
+	}
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	if c := r.commits[initial]; c == nil || c.Branch != "main" {
+		t.Errorf("initial commit = %v; want it on main", c)
+	}
+	for _, name := range bs {
+		if err := r.postNewCommits(r.branches[name]); err != nil {
+			t.Errorf("postNewCommits(%s): %v", name, err)
+		}
+	}
+	if !networkSeen[onDev] {
+		t.Errorf("commit on dev not posted")
+	}
+	if c := r.commits[onDev]; c.NeedsBenchmarking(nil, r.defaultBranch) {
+		t.Errorf("commit on dev needs benchmarking")
+	}
+
+	old := *defBranch
+	defer func() { *defBranch = old }()
+	*defBranch = "dev"
+	if got := r.findDefaultBranch(); got != "dev" {
+		t.Errorf("with -watcher.defaultbranch=dev, findDefaultBranch = %q", got)
+	}
+}
+
+func TestNewRepoFromBundle(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	dir, err := ioutil.TempDir("", "watcher-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "repo.bundle")
+	f.git("bundle", "create", bundle, "--all")
+
+	r, err := NewRepo(dir, "bundle://"+bundle, nil, "golang.org/x/offline", false, repoOptions{})
+	if err != nil {
+		t.Fatalf("NewRepo: %v", err)
+	}
+	if r.bundle != bundle {
+		t.Errorf("bundle = %q; want %q", r.bundle, bundle)
+	}
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	if r.commits[first] == nil {
+		t.Errorf("commit %s from bundle not found", first)
+	}
+
+	// Replace the bundle with a refreshed one, and fetch from it.
+	second := f.commit("a.txt", "second")
+	f.git("bundle", "create", bundle+".new", "--all")
+	if err := os.Rename(bundle+".new", bundle); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.fetch(context.Background()); err != nil {
+		t.Fatalf("fetch from refreshed bundle: %v", err)
+	}
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	if c := r.commits[second]; c == nil || c.Branch != master {
+		t.Errorf("commit %s from refreshed bundle = %v; want it on master", second, c)
+	}
+}
+
+func TestFetchConcurrencyLimit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git is a shell script")
+	}
+	const limit = 2
+
+	// Install a fake git whose fetches record how many
+	// fetches are running at once.
+	bin, err := ioutil.TempDir("", "watcher-fakegit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	running := filepath.Join(bin, "running")
+	if err := os.Mkdir(running, 0755); err != nil {
+		t.Fatal(err)
+	}
+	counts := filepath.Join(bin, "counts")
+	script := fmt.Sprintf(`#!/bin/sh
+[ "$1" = fetch ] || exit 1
+mkdir %[1]q/$$
+ls %[1]q | wc -l >> %[2]q
+sleep 0.1
+rmdir %[1]q/$$
+`, running, counts)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	oldSem := fetchSem
+	fetchSem = newSemaphore(limit)
+	defer func() { fetchSem = oldSem }()
+
+	var repos []*Repo
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		r := &Repo{root: bin, path: fmt.Sprintf("golang.org/x/repo%d", i), status: newStatusRing(50)}
+		repos = append(repos, r)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.fetch(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	b, err := ioutil.ReadFile(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(b))
+	if len(lines) != len(repos) {
+		t.Errorf("ran %d fetches; want %d", len(lines), len(repos))
+	}
+	for _, l := range lines {
+		if n, _ := strconv.Atoi(l); n > limit {
+			t.Errorf("saw %d concurrent fetches; want at most %d", n, limit)
+		}
+	}
+	waited := 0
+	for _, r := range repos {
+		r.status.foreachDesc(func(ent statusEntry) {
+			if ent.status == "waiting for a git fetch slot" {
+				waited++
+			}
+		})
+	}
+	if waited == 0 {
+		t.Errorf("no repo reported waiting for a git fetch slot")
+	}
+}
+
+func TestTickleChangedBranches(t *testing.T) {
+	const repo = "tickle-test"
+	c := repoTickler(repo)
+	tickled := func() bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+	last := map[string]string{}
+	meta := func(master, release string) map[string]map[string]string {
+		return map[string]map[string]string{
+			repo: {"master": master, "release-branch.go1.9": release},
+		}
+	}
+
+	tickleChanged(last, meta("aaa", "bbb"))
+	if !tickled() {
+		t.Errorf("new repo not tickled")
+	}
+	tickleChanged(last, meta("aaa", "bbb"))
+	if tickled() {
+		t.Errorf("repo tickled with no branch changes")
+	}
+	tickleChanged(last, meta("aaa", "ccc"))
+	if !tickled() {
+		t.Errorf("repo not tickled when only its release branch moved")
+	}
+	tickleChanged(last, meta("ddd", "ccc"))
+	tickleChanged(last, meta("eee", "ccc"))
+	if !tickled() {
+		t.Errorf("repo not tickled when master moved")
+	}
+	if tickled() {
+		t.Errorf("tickle channel holds more than one tickle")
+	}
+}
+
+func TestMetaBranches(t *testing.T) {
+	old := *branches
+	defer func() { *branches = old }()
+	*branches = "release-branch.go1.9,master,dev.ssa"
+	if got, want := strings.Join(metaBranches(), ","), "master,release-branch.go1.9,dev.ssa"; got != want {
+		t.Errorf("with -watcher.branches, metaBranches() = %q; want %q", got, want)
+	}
+
+	*branches = ""
+	r := &Repo{path: "golang.org/x/metabranches", status: newStatusRing(50)}
+	r.snap.Branches = []branchHead{{Name: "master"}, {Name: "release-branch.go1.10"}}
+	registerRepo(r)
+	defer func() {
+		watchedMu.Lock()
+		delete(watchedRepos, r.name())
+		watchedMu.Unlock()
+	}()
+	bs := metaBranches()
+	if bs[0] != master {
+		t.Errorf("metaBranches() = %q; want master first", bs)
+	}
+	n := 0
+	for _, b := range bs {
+		if b == "release-branch.go1.10" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("metaBranches() = %q; want release-branch.go1.10 once", bs)
+	}
+}
+
+func TestRegisterWatcher(t *testing.T) {
+	var (
+		n     int
+		repos []string
+	)
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/watcher-register" || req.Method != "POST" {
+			t.Errorf("unexpected dashboard request %s %s", req.Method, req.URL.Path)
+		}
+		var body struct {
+			Host  string
+			Repos []string
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		n++
+		repos = body.Repos
+		fmt.Fprint(w, `{}`)
+	})
+	if err := registerWatcher(true, []string{"golang.org/x/net", "golang.org/x/tools"}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("dashboard got %d registrations; want 1", n)
+	}
+	if got, want := strings.Join(repos, ","), "go,net,tools"; got != want {
+		t.Errorf("registered repos %q; want %q", got, want)
+	}
+
+	*report = false
+	if err := registerWatcher(true, nil); err != nil || n != 1 {
+		t.Errorf("with -watcher.report=false: err = %v, %d registrations; want nil, 1", err, n)
+	}
+}
+
+func TestShouldMirror(t *testing.T) {
+	var probed []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		probed = append(probed, req.URL.Path)
+		if req.URL.Path != "/newrepo" {
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	defer func(u string) { mirrorProbeURL = u }(mirrorProbeURL)
+	mirrorProbeURL = ts.URL + "/"
+	defer func(mc *mirrorConfig) { mirrorCfg = mc }(mirrorCfg)
+
+	dir, err := ioutil.TempDir("", "watcher-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mirror-repos")
+	if err := ioutil.WriteFile(file, []byte("# extra repos\nvulndb\n\n  pkgsite # the site\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		list, file string
+		probe      bool
+		mirrored   string // comma-separated names that should be mirrored
+		probes     int
+	}{
+		{defaultMirrorRepos, "", false, "go,net,tools", 0},
+		{"net", file, false, "net,vulndb,pkgsite", 0},
+		{"net", "", true, "net,newrepo", 5},
+		{"", "", false, "newrepo", 6},
+	}
+	for _, tt := range tests {
+		mc, err := loadMirrorConfig(tt.list, tt.file, tt.probe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirrorCfg = mc
+		probed = nil
+		want := map[string]bool{}
+		for _, name := range splitList(tt.mirrored) {
+			want[name] = true
+		}
+		for _, name := range []string{"go", "net", "tools", "vulndb", "pkgsite", "newrepo"} {
+			if got := shouldMirror(name); got != want[name] {
+				t.Errorf("loadMirrorConfig(%q, %q, %v): shouldMirror(%q) = %v; want %v", tt.list, tt.file, tt.probe, name, got, want[name])
+			}
+		}
+		if len(probed) != tt.probes {
+			t.Errorf("loadMirrorConfig(%q, %q, %v): probed %q; want %d probes", tt.list, tt.file, tt.probe, probed, tt.probes)
+		}
+	}
+	if _, err := loadMirrorConfig("", file+".missing", false); err == nil {
+		t.Errorf("loadMirrorConfig with missing file succeeded")
+	}
+}
+
+func TestMirrorTemplates(t *testing.T) {
+	defer func(tmpls []*template.Template) { mirrorTemplates = tmpls }(mirrorTemplates)
+	tests := []struct {
+		flag string
+		want []string // URLs for repo "net"; nil means the flag is invalid
+	}{
+		{"git@github.com:golang/{{.Name}}.git", []string{"git@github.com:golang/net.git"}},
+		{"https://gitlab.internal/mirrors/{{.Name}} ssh://git@backup.example.com/go/{{.Name}}.git", []string{
+			"https://gitlab.internal/mirrors/net",
+			"ssh://git@backup.example.com/go/net.git",
+		}},
+		{"", []string{}},
+		{"git@github.com:golang/{{.Nmae}}.git", nil},
+		{"{{.Name}}", nil},
+		{"ftp://example.com/{{.Name}}", nil},
+		{"https:///{{.Name}}", nil},
+		{"git@github.com:golang/{{.Name", nil},
+	}
+	for _, tt := range tests {
+		tmpls, err := parseMirrorTemplates(tt.flag)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseMirrorTemplates(%q) succeeded; want error", tt.flag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMirrorTemplates(%q): %v", tt.flag, err)
+			continue
+		}
+		mirrorTemplates = tmpls
+		got, err := mirrorURLs("net")
+		if err != nil {
+			t.Errorf("%q: mirrorURLs(net): %v", tt.flag, err)
+			continue
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%q: mirrorURLs(net) = %q; want %q", tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestShardPaths(t *testing.T) {
+	defer func(i, n int) { *shardIndex, *shardCount = i, n }(*shardIndex, *shardCount)
+	names := strings.Fields("arch benchmarks blog build crypto debug exp image mobile net oauth2 sync sys term text time tools tour")
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, "golang.org/x/"+name)
+	}
+
+	*shardIndex, *shardCount = 0, 1
+	if got := shardPaths(paths); len(got) != len(paths) || !inShard("go") {
+		t.Errorf("with one shard, shardPaths kept %d of %d repos (go: %v); want all", len(got), len(paths), inShard("go"))
+	}
+
+	want := []string{
+		0: "arch benchmarks blog mobile net oauth2 sync tools tour",
+		1: "go crypto debug term text",
+		2: "build exp image sys time",
+	}
+	seen := map[string]int{}
+	for i := range want {
+		*shardIndex, *shardCount = i, len(want)
+		var got []string
+		if inShard("go") {
+			got = append(got, "go")
+		}
+		for _, path := range shardPaths(paths) {
+			name := strings.TrimPrefix(path, "golang.org/x/")
+			got = append(got, name)
+			seen[name]++
+		}
+		if strings.Join(got, " ") != want[i] {
+			t.Errorf("shard %d of %d has repos %q; want %q", i, len(want), got, want[i])
+		}
+	}
+	for _, name := range names {
+		if seen[name] != 1 {
+			t.Errorf("repo %s is in %d shards; want 1", name, seen[name])
+		}
+	}
+}
+
+func TestPostBranchFromUnseenBase(t *testing.T) {
+	offline(t)
+	defer func(n int) { *maxBootstrap = n }(*maxBootstrap)
+	*maxBootstrap = 3
+
+	f := newGitFixture(t)
+	defer f.cleanup()
+	var hashes []string
+	for i := 0; i < 10; i++ {
+		hashes = append(hashes, f.commit("a.txt", fmt.Sprintf("commit %d", i)))
+	}
+	// The dev branch forks from a commit below master's
+	// bootstrap cutoff, so posting master doesn't post it.
+	f.git("checkout", "-q", "-b", "dev", hashes[2])
+	onDev := f.commit("b.txt", "on dev")
+	f.git("checkout", "-q", master)
+
+	r := f.repo()
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range hashes {
+		if want := i <= 2 || i >= 7; networkSeen[h] != want {
+			t.Errorf("commit %d posted = %v; want %v", i, networkSeen[h], want)
+		}
+	}
+	if !networkSeen[onDev] {
+		t.Errorf("dev commit not posted")
+	}
+}
+
+func TestVerifyPush(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git is a shell script")
+	}
+	defer func(n int, v bool) { *retries, *verifyPush = n, v }(*retries, *verifyPush)
+	*retries = 1
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	dest := newBareGitDir(t)
+	defer os.RemoveAll(dest)
+	r := f.repo()
+	r.dests = mirrorDests([]string{dest})
+	f.git("remote", "add", "dest", dest)
+
+	// Install a fake git whose pushes claim to succeed
+	// without doing anything.
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := ioutil.TempDir("", "watcher-fakegit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	script := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = push ] && exit 0\nexec %q \"$@\"\n", realGit)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	*verifyPush = false
+	if err := r.push(); err != nil {
+		t.Fatalf("unverified push: %v", err)
+	}
+	*verifyPush = true
+	err = r.push()
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 pushed refs differ") {
+		t.Errorf("verified push error = %v; want one reporting 1 differing ref", err)
+	}
+	var found bool
+	r.status.foreachDesc(func(ent statusEntry) {
+		if strings.Contains(ent.status, "push verification failed") {
+			found = true
+		}
+	})
+	if !found {
+		t.Errorf("status doesn't report the failed verification")
+	}
+
+	// With the real git, the push is verified.
+	os.Setenv("PATH", strings.TrimPrefix(os.Getenv("PATH"), bin+string(os.PathListSeparator)))
+	if err := r.push(); err != nil {
+		t.Errorf("verified push with real git: %v", err)
+	}
+	remote, err := r.getRemoteRefs("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := remote["refs/heads/master"]; got != head {
+		t.Errorf("dest has master at %q; want %q", got, head)
+	}
+}
+
+func TestPushMultipleDests(t *testing.T) {
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 1
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	var urls []string
+	for i := 0; i < 2; i++ {
+		dest := newBareGitDir(t)
+		defer os.RemoveAll(dest)
+		urls = append(urls, dest)
+	}
+	missing := filepath.Join(urls[0], "missing")
+	urls = append(urls, missing)
+	r := f.repo()
+	r.dests = mirrorDests(urls)
+	for _, d := range r.dests {
+		f.git("remote", "add", d.remote, d.url)
+	}
+	if got := r.dests[2].remote; got != "dest3" {
+		t.Errorf("third remote is named %q; want dest3", got)
+	}
+
+	// Pushing to the missing destination fails, but
+	// doesn't stop the pushes to the others.
+	err := r.push()
+	if err == nil || !strings.Contains(err.Error(), "dest3 ("+missing+")") || strings.Contains(err.Error(), "pushing to dest2 ") {
+		t.Errorf("push error = %v; want one mentioning only dest3", err)
+	}
+	for _, d := range r.dests[:2] {
+		remote, err := r.getRemoteRefs(d.remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := remote["refs/heads/master"]; got != head {
+			t.Errorf("%s has master at %q; want %q", d.remote, got, head)
+		}
+	}
+
+	// The git dir is reused only if every destination matches.
+	if err := ioutil.WriteFile(filepath.Join(r.root, "FETCH_HEAD"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !r.shouldTryReuseGitDir() {
+		t.Errorf("shouldTryReuseGitDir = false with all destinations matching")
+	}
+	r.dests[1].url += ".moved"
+	if r.shouldTryReuseGitDir() {
+		t.Errorf("shouldTryReuseGitDir = true with dest2 URL changed")
+	}
+	r.dests = mirrorDests(append(urls, urls[0]+".new"))
+	if r.shouldTryReuseGitDir() {
+		t.Errorf("shouldTryReuseGitDir = true with new dest4 unconfigured")
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	if _, err := newWatcherLogger("xml", nil); err == nil {
+		t.Errorf("newWatcherLogger(\"xml\") succeeded; want error")
+	}
+	var buf bytes.Buffer
+	l, err := newWatcherLogger("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(l watcherLogger) { watcherLog = l }(watcherLog)
+	watcherLog = l
+	defer func(now func() time.Time) { watcherNow = now }(watcherNow)
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	watcherNow = func() time.Time { return now }
+
+	r := &Repo{nameOpt: "net"}
+	r.logf("fetched %d refs", 3)
+	r.logf("warning: commit %s changes %d lines", "abc", 5000)
+	watcherLogf("Starting watch of repo %s", "net")
+	watcherErrorf("Watcher exiting after failure: %v", "boom")
+
+	want := []jsonLogEntry{
+		{TS: now, Level: "info", Repo: "net", Msg: "fetched 3 refs"},
+		{TS: now, Level: "warning", Repo: "net", Msg: "commit abc changes 5000 lines"},
+		{TS: now, Level: "info", Msg: "Starting watch of repo net"},
+		{TS: now, Level: "error", Msg: "Watcher exiting after failure: boom"},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines; want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var got jsonLogEntry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d: %v: %s", i, err, line)
+		}
+		if !got.TS.Equal(want[i].TS) || got.Level != want[i].Level || got.Repo != want[i].Repo || got.Msg != want[i].Msg {
+			t.Errorf("line %d = %+v; want %+v", i, got, want[i])
+		}
+	}
+	if strings.Contains(lines[2], `"repo"`) {
+		t.Errorf("watcher-wide line has a repo field: %s", lines[2])
+	}
+}
+
+func TestRecoverCorrupt(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	r := f.cloneMirror()
+	r.srcURL = f.dir
+	r.cacheDir = filepath.Dir(r.root)
+
+	fetchErr := fmt.Errorf("git fetch failed")
+	if err := r.recoverCorrupt(context.Background(), fetchErr); err != fetchErr {
+		t.Fatalf("recoverCorrupt of intact repo = %v; want the fetch error", err)
+	}
+	if r.reclones != 0 {
+		t.Fatalf("intact repo re-cloned %d times", r.reclones)
+	}
+
+	corrupt := func() {
+		t.Helper()
+		objs := filepath.Join(r.root, "objects")
+		if err := os.RemoveAll(objs); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(objs, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= maxReclones; i++ {
+		corrupt()
+		if err := r.recoverCorrupt(context.Background(), fetchErr); err != nil {
+			t.Fatalf("recoverCorrupt %d: %v", i, err)
+		}
+		if r.reclones != i {
+			t.Errorf("after recovery %d, reclones = %d", i, r.reclones)
+		}
+		if r.corrupt() {
+			t.Fatalf("repo still corrupt after recovery %d", i)
+		}
+		if err := r.fetch(context.Background()); err != nil {
+			t.Fatalf("fetch after recovery %d: %v", i, err)
+		}
+	}
+	corrupt()
+	if err := r.recoverCorrupt(context.Background(), fetchErr); err == nil || !strings.Contains(err.Error(), "still corrupt") {
+		t.Errorf("recoverCorrupt after %d re-clones = %v; want an error giving up", maxReclones, err)
+	}
+}
+
+func TestShallowDeepen(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	var hashes []string
+	for i := 1; i <= 5; i++ {
+		hashes = append(hashes, f.commit("a.txt", fmt.Sprint(i)))
+	}
+	tmp, err := ioutil.TempDir("", "watcher-shallow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	r := f.repo()
+	r.root = filepath.Join(tmp, r.name())
+	r.srcURL = "file://" + f.dir // git ignores --depth in local clones otherwise
+	r.cacheDir = tmp
+	r.depth = 2
+	if err := r.clone(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b := r.shallowBoundary(); !b[hashes[3]] {
+		t.Fatalf("shallow boundary = %v; want %s", b, hashes[3])
+	}
+
+	// The dashboard has seen the second commit, which is
+	// outside the shallow clone's history.
+	networkSeen[hashes[1]] = true
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+	b := r.branches[master]
+	if b == nil || b.LastSeen == nil || b.LastSeen.Hash != hashes[1] {
+		t.Fatalf("branch after update = %v; want last seen %s", b, hashes[1])
+	}
+	if r.depth != 4 {
+		t.Errorf("depth after deepening = %d; want 4", r.depth)
+	}
+	if c := r.commits[hashes[2]]; c == nil || c.parent == nil || c.parent.Hash != hashes[1] {
+		t.Errorf("commit %s not linked to its parent %s after deepening", hashes[2], hashes[1])
+	}
+	if err := r.postNewCommits(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hashes[2:] {
+		if !networkSeen[h] {
+			t.Errorf("commit %s not posted", h)
+		}
+	}
+}
+
+func TestPushBatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git is a shell script")
+	}
+	defer func(n int) { *pushBatch = n }(*pushBatch)
+	*pushBatch = 2
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	for _, tag := range []string{"v1", "v2", "v3", "v4"} {
+		f.git("tag", tag)
+	}
+	dest := newBareGitDir(t)
+	defer os.RemoveAll(dest)
+	r := f.repo()
+	r.dests = mirrorDests([]string{dest})
+	f.git("remote", "add", "dest", dest)
+
+	// Install a fake git that logs the refs of each push.
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := ioutil.TempDir("", "watcher-fakegit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	pushes := filepath.Join(bin, "pushes")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = push ]; then shift 3; echo \"$@\" >>%q; set -- push -f dest \"$@\"; fi\nexec %q \"$@\"\n", pushes, realGit)
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(pushes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d pushes of 5 refs in batches of 2; want 3:\n%s", len(lines), b)
+	}
+	for i, line := range lines {
+		if n := len(strings.Fields(line)); n > *pushBatch {
+			t.Errorf("push %d has %d refs; want at most %d", i, n, *pushBatch)
+		}
+	}
+	if !strings.Contains(lines[0], ":refs/heads/"+master) {
+		t.Errorf("first push %q doesn't include the branch head", lines[0])
+	}
+	remote, err := r.getRemoteRefs("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"refs/heads/" + master, "refs/tags/v1", "refs/tags/v2", "refs/tags/v3", "refs/tags/v4"} {
+		if remote[ref] == "" {
+			t.Errorf("mirror lacks %s after push", ref)
+		}
+	}
+}
+
+func TestRefGlobs(t *testing.T) {
+	tests := []struct {
+		globs string
+		ref   string
+		want  bool
+	}{
+		{"!refs/changes/*", "refs/heads/master", true},
+		{"!refs/changes/*", "refs/tags/go1.10", true},
+		{"!refs/changes/*", "refs/changes/34/1234/5", false},
+		{"!refs/changes/*", "refs/changesets/x", true},
+		{"", "refs/changes/34/1234/5", true},
+		{"refs/heads/*,refs/tags/*", "refs/heads/release-branch.go1.10", true},
+		{"refs/heads/*,refs/tags/*", "refs/notes/commits", false},
+		{"refs/heads/*,!refs/heads/dev.*", "refs/heads/dev.boringcrypto", false},
+		{"refs/heads/*,!refs/heads/dev.*", "refs/heads/master", true},
+		{"refs/*/master", "refs/heads/master", true},
+		{"refs/*/master", "refs/heads/x/master", false},
+	}
+	for _, tt := range tests {
+		f, err := parseRefGlobs(tt.globs)
+		if err != nil {
+			t.Errorf("parseRefGlobs(%q): %v", tt.globs, err)
+			continue
+		}
+		if got := f.allows(tt.ref); got != tt.want {
+			t.Errorf("with globs %q, allows(%q) = %v; want %v", tt.globs, tt.ref, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"heads/*", "!changes/*", "refs/[heads"} {
+		if _, err := parseRefGlobs(bad); err == nil {
+			t.Errorf("parseRefGlobs(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestPushSkipsChangeRefs(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	f.git("update-ref", "refs/changes/01/1/1", head)
+	f.git("tag", "v1")
+	dest := newBareGitDir(t)
+	defer os.RemoveAll(dest)
+	r := f.repo()
+	r.dests = mirrorDests([]string{dest})
+	f.git("remote", "add", "dest", dest)
+
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := r.getRemoteRefs("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"refs/heads/" + master, "refs/tags/v1"} {
+		if remote[ref] != head {
+			t.Errorf("mirror has %s at %q; want %s", ref, remote[ref], head)
+		}
+	}
+	if h, ok := remote["refs/changes/01/1/1"]; ok {
+		t.Errorf("mirror has refs/changes/01/1/1 at %s; want it excluded", h)
+	}
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	defer func(dry bool, n int) { *mirrorDry, *pushBatch = dry, n }(*mirrorDry, *pushBatch)
+	*mirrorDry, *pushBatch = true, 1
+	f := newGitFixture(t)
+	defer f.cleanup()
+	head := f.commit("a.txt", "first")
+	f.git("tag", "v1")
+	dest := newBareGitDir(t)
+	defer os.RemoveAll(dest)
+	r := f.repo()
+	r.dests = mirrorDests([]string{dest})
+	f.git("remote", "add", "dest", dest)
+
+	var buf bytes.Buffer
+	defer func(l watcherLogger) { watcherLog = l }(watcherLog)
+	watcherLog = &jsonLogger{w: &buf}
+	if err := r.push(); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := r.getRemoteRefs("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remote) != 0 {
+		t.Errorf("dry run pushed refs: %v", remote)
+	}
+	for _, want := range []string{
+		"dry run: batch 1 of 2 to " + dest + ": would run git push -f dest +" + head + ":refs/heads/" + master,
+		"dry run: batch 2 of 2 to " + dest + ": would run git push -f dest +" + head + ":refs/tags/v1",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, buf.String())
+		}
+	}
+	var found bool
+	r.status.foreachDesc(func(ent statusEntry) {
+		if strings.Contains(ent.status, "dry run: would push 2 refs") {
+			found = true
+		}
+	})
+	if !found {
+		t.Errorf("status doesn't report the 2 refs that would be pushed")
+	}
+}
+
+func TestVerifySig(t *testing.T) {
+	defer func(v bool, u string) { *verifySig, *unsignedPol = v, u }(*verifySig, *unsignedPol)
+	tests := []struct {
+		verify   bool
+		unsigned string
+		sig      string
+		want     bool // posted
+	}{
+		{false, "skip", "B", true},
+		{true, "skip", "G", true},
+		{true, "skip", "N", false},
+		{true, "allow", "N", true},
+		{true, "allow", "B", false},
+		{true, "allow", "U", false},
+		{true, "allow", "E", false},
+		{true, "allow", "X", false},
+		{true, "allow", "R", false},
+	}
+	for _, tt := range tests {
+		*verifySig, *unsignedPol = tt.verify, tt.unsigned
+		err := verifyCommit(&Commit{SigStatus: tt.sig})
+		if got := err == nil; got != tt.want {
+			t.Errorf("verifysig=%v unsigned=%s: verifyCommit of %q = %v; want posted=%v", tt.verify, tt.unsigned, tt.sig, err, tt.want)
+		}
+	}
+
+	// git log reports the fixture's unsigned commits as such.
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	second := f.commit("a.txt", "second")
+	third := f.commit("a.txt", "third")
+	r := f.repo()
+	*verifySig = false
+	cs, err := r.log("", "heads/"+master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cs {
+		if c.SigStatus != "" {
+			t.Errorf("without -watcher.verifysig, commit %v has SigStatus %q; want none", c, c.SigStatus)
+		}
+	}
+	*verifySig = true
+	cs, err = r.log("", "heads/"+master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cs {
+		if c.SigStatus != "N" {
+			t.Errorf("commit %v has SigStatus %q; want N", c, c.SigStatus)
+		}
+		r.commits[c.Hash] = c
+	}
+
+	// A commit failing verification is skipped as a parent.
+	*verifySig, *unsignedPol = true, "allow"
+	r.commits[second].SigStatus = "B"
+	if got := r.dashParent(r.commits[third]); got != first {
+		t.Errorf("dashParent skipping a badly signed commit = %s; want %s", got, first)
+	}
+}
+
+func TestLogBoundaryInMessage(t *testing.T) {
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	msg := "all: confuse the watcher\n\n_-_- magic boundary -_-_\nnot a commit\n_-_- file boundary -_-_\nnot/a/file.go"
+	second := f.commit("b.txt", msg)
+	r := f.repo()
+	cs, err := r.log("", "heads/"+master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2 {
+		t.Fatalf("got %d commits; want 2: %v", len(cs), cs)
+	}
+	c := cs[0]
+	if c.Hash != second || c.Parent != first {
+		t.Errorf("commit = %s with parent %s; want %s with parent %s", c.Hash, c.Parent, second, first)
+	}
+	if c.Desc != msg {
+		t.Errorf("Desc = %q; want %q", c.Desc, msg)
+	}
+	if c.Files != "b.txt" {
+		t.Errorf("Files = %q; want b.txt", c.Files)
+	}
+
+	l1, f1 := logBoundaries()
+	l2, f2 := logBoundaries()
+	if l1 == l2 || f1 == f2 {
+		t.Errorf("logBoundaries returned %q, %q twice", l1, f1)
+	}
+}
+
+func TestPostCommitEscByte(t *testing.T) {
+	var raw []byte
+	fakeDashboard(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/commit" {
+			raw, _ = ioutil.ReadAll(req.Body)
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	f := newGitFixture(t)
+	defer f.cleanup()
+	msg := "cmd/go: color the output\n\nPrints \x1b[31mred\x1b[0m."
+	f.commit("a.txt", msg)
+	r := f.repo()
+	cs, err := r.log("", "heads/"+master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cs[0]
+	if c.Desc != msg {
+		t.Fatalf("Desc = %q; want %q", c.Desc, msg)
+	}
+	c.Branch = master
+	if err := r.postCommit(c); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte(`\u001b[31mred`)) {
+		t.Errorf("posted body doesn't escape the ESC byte as \\u001b: %s", raw)
+	}
+	var got dashCommit
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Desc != msg {
+		t.Errorf("posted Desc = %q; want %q", got.Desc, msg)
+	}
+}
+
+func TestServeBranch(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	first := f.commit("a.txt", "first")
+	second := f.commit("a.txt", "second")
+	third := f.commit("a.txt", "third")
+	r := f.cloneMirror()
+	networkSeen[first] = true
+	if err := r.update(false); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/debug/watcher/"+r.name()+"/branch/"+master, nil))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var got branchJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Branch != master || got.Head != third || got.LastSeen != first || got.Truncated {
+		t.Errorf("got branch %q head %s last seen %s truncated %v; want %q, %s, %s, false", got.Branch, got.Head, got.LastSeen, got.Truncated, master, third, first)
+	}
+	want := []struct {
+		hash, parent, desc string
+		posted             bool
+	}{
+		{third, second, "third", false},
+		{second, first, "second", false},
+		{first, "", "first", true},
+	}
+	if len(got.Commits) != len(want) {
+		t.Fatalf("got %d commits; want %d: %+v", len(got.Commits), len(want), got.Commits)
+	}
+	for i, c := range got.Commits {
+		if c.Hash != want[i].hash || c.Parent != want[i].parent || c.Desc != want[i].desc || c.Posted != want[i].posted || c.Branch != master {
+			t.Errorf("commit %d = %+v; want %+v on %s", i, c, want[i], master)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/debug/watcher/"+r.name()+"/branch/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown branch: status %d; want 404", w.Code)
+	}
+}
+
+func TestPollTimer(t *testing.T) {
+	defer func(p, i, h time.Duration) { *pollTimer, *pollInterval, *heartbeat = p, i, h }(*pollTimer, *pollInterval, *heartbeat)
+	*pollTimer, *pollInterval, *heartbeat = 90*time.Second, 10*time.Second, 0
+	if got := (&Repo{}).pollWait(); got != 90*time.Second {
+		t.Errorf("pollWait = %v; want -watcher.polltimer's 90s", got)
+	}
+	if got := (&Repo{bundle: "x.bundle"}).pollWait(); got != 10*time.Second {
+		t.Errorf("pollWait of bundle repo = %v; want -watcher.poll's 10s", got)
+	}
+	*heartbeat = 30 * time.Second
+	if got := (&Repo{dash: true}).pollWait(); got != 30*time.Second {
+		t.Errorf("pollWait with heartbeat = %v; want 30s", got)
+	}
+
+	// Watch fetches again each time the timer fires.
+	*pollTimer, *heartbeat = 20*time.Millisecond, 0
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	r := f.cloneMirror()
+	r.dash = false
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := r.Watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fired := 0
+	r.status.foreachDesc(func(ent statusEntry) {
+		if ent.status == "poll timer fired" {
+			fired++
+		}
+	})
+	if fired < 2 {
+		t.Errorf("poll timer fired %d times in 500ms with -watcher.polltimer=20ms; want several", fired)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	tests := []struct {
+		path, auth string
+		want       int
+	}{
+		{"/net.tar.gz", "", http.StatusUnauthorized},
+		{"/debug/watcher/net", "Bearer wrong", http.StatusUnauthorized},
+		{"/debug/watcher/net", "s3cret", http.StatusUnauthorized},
+		{"/debug/watcher/net", "Bearer s3cret", 200},
+		{"/net.tar.gz", "Bearer s3cret", 200},
+		{"/healthz", "", 200},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("GET %s with Authorization %q: status %d; want %d", tt.path, tt.auth, w.Code, tt.want)
+		}
+	}
+}
+
+func TestDiffSubrepos(t *testing.T) {
+	watched := map[string]bool{"golang.org/x/net": true, "golang.org/x/tools": true}
+	added, removed := diffSubrepos(watched, []string{"golang.org/x/tools", "golang.org/x/sys", "golang.org/x/exp"})
+	if want := []string{"golang.org/x/exp", "golang.org/x/sys"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added = %q; want %q", added, want)
+	}
+	if want := []string{"golang.org/x/net"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed = %q; want %q", removed, want)
+	}
+	if added, removed := diffSubrepos(watched, []string{"golang.org/x/net", "golang.org/x/tools"}); added != nil || removed != nil {
+		t.Errorf("diff of unchanged list = %q, %q; want none", added, removed)
+	}
+}
+
+func TestHandleRepoReregister(t *testing.T) {
+	const pattern = "/debug/watcher/handlerepo-test"
+	serve := func(r *Repo, w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, r.name())
+	}
+	get := func() (int, string) {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", pattern, nil))
+		return w.Code, w.Body.String()
+	}
+
+	old := &Repo{nameOpt: "old"}
+	handleRepo(pattern, old, serve)
+	if code, body := get(); code != 200 || body != "old" {
+		t.Fatalf("GET = %d %q; want 200 \"old\"", code, body)
+	}
+	unregisterRepo(old)
+	if code, _ := get(); code != http.StatusNotFound {
+		t.Errorf("GET after unregisterRepo = %d; want 404", code)
+	}
+
+	// Registering the route again, as a restarted watch does,
+	// must not panic, and serves the new repo.
+	handleRepo(pattern, &Repo{nameOpt: "new"}, serve)
+	if code, body := get(); code != 200 || body != "new" {
+		t.Errorf("GET after re-registering = %d %q; want 200 \"new\"", code, body)
+	}
+}
+
+// fireNow is a supervisor's after func that doesn't wait,
+// recording the requested delays.
+func fireNow(delays *[]time.Duration) func(time.Duration) <-chan time.Time {
+	return func(d time.Duration) <-chan time.Time {
+		*delays = append(*delays, d)
+		c := make(chan time.Time, 1)
+		c <- time.Time{}
+		return c
+	}
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runs := 0
+	var delays []time.Duration
+	s := &supervisor{
+		path: "golang.org/x/flaky",
+		run: func(ctx context.Context) error {
+			runs++
+			if runs <= 3 {
+				return errors.New("flaky fetch")
+			}
+			// Recovered: watch until stopped.
+			cancel()
+			<-ctx.Done()
+			return nil
+		},
+		maxRestarts: 5,
+		backoff:     time.Second,
+		after:       fireNow(&delays),
+	}
+	if err := s.supervise(ctx); err != nil {
+		t.Fatalf("supervise = %v; want nil once stopped", err)
+	}
+	if runs != 4 {
+		t.Errorf("ran watch %d times; want 4", runs)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("backoff delays = %v; want %v", delays, want)
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	runs := 0
+	var delays []time.Duration
+	s := &supervisor{
+		path: "golang.org/x/broken",
+		run: func(ctx context.Context) error {
+			runs++
+			return errors.New("corrupt beyond repair")
+		},
+		maxRestarts: 3,
+		backoff:     time.Minute,
+		after:       fireNow(&delays),
+	}
+	err := s.supervise(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "golang.org/x/broken: giving up after 4 consecutive failures: corrupt beyond repair") {
+		t.Fatalf("supervise = %v; want give-up error", err)
+	}
+	if runs != 4 {
+		t.Errorf("ran watch %d times; want 4 (1 + 3 restarts)", runs)
+	}
+	if want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("backoff delays = %v; want %v (capped at %v)", delays, want, maxBackoff)
+	}
+}
+
+func TestSupervisorResetsAfterHealthyRun(t *testing.T) {
+	defer func(now func() time.Time) { watcherNow = now }(watcherNow)
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	watcherNow = func() time.Time { return now }
+
+	// Runs 2, 4, 6 and 8 stay up long enough to count as recovered,
+	// so until run 9 there are never more than 2 failures in a row.
+	runs := 0
+	var delays []time.Duration
+	s := &supervisor{
+		run: func(ctx context.Context) error {
+			runs++
+			if runs <= 8 && runs%2 == 0 {
+				now = now.Add(supervisorReset)
+			}
+			return errors.New("transient")
+		},
+		maxRestarts: 2,
+		backoff:     time.Second,
+		after:       fireNow(&delays),
+	}
+	err := s.supervise(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "main repo: giving up after 3 consecutive failures") {
+		t.Fatalf("supervise = %v; want give-up error", err)
+	}
+	if runs != 10 {
+		t.Errorf("ran watch %d times; want 10", runs)
+	}
+	for i, d := range delays {
+		if d > 2*time.Second {
+			t.Errorf("delay %d = %v; want the backoff reset by each healthy run", i, d)
+		}
+	}
+}
+
+func TestNewRepoLocalGitDir(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	c1 := f.commit("a.txt", "first")
+	c2 := f.commit("a.txt", "second")
+	f.git("checkout", "-q", "-b", "dev")
+	d1 := f.commit("b.txt", "dev first")
+	d2 := f.commit("b.txt", "dev second")
+	f.git("checkout", "-q", master)
+	c3 := f.commit("a.txt", "third")
+
+	dc := new(fakeDashClient)
+	r := f.newRepo(dc)
+	if r.root != f.dir {
+		t.Errorf("root = %q; want the fixture's %q", r.root, f.dir)
+	}
+	if len(r.commits) != 5 {
+		t.Errorf("found %d commits; want 5", len(r.commits))
+	}
+	for name, head := range map[string]string{master: c3, "dev": d2} {
+		if b := r.branches[name]; b == nil || b.Head.Hash != head {
+			t.Errorf("branch %q = %v; want head %s", name, b, head)
+		}
+	}
+	if c := r.commits[d1]; c == nil || c.Branch != "dev" || c.parent != r.commits[c2] {
+		t.Errorf("commit %s = %+v; want on dev, child of %s", d1, c, c2)
+	}
+
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	// The default branch first, then dev from its fork base.
+	if want := []string{c1, c2, c3, d1, d2}; !reflect.DeepEqual(dc.posted, want) {
+		t.Errorf("posted %q; want %q", dc.posted, want)
+	}
+
+	// Once posted, new commits are posted alone.
+	dc.posted = nil
+	c4 := f.commit("a.txt", "fourth")
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{c4}; !reflect.DeepEqual(dc.posted, want) {
+		t.Errorf("after a new commit, posted %q; want %q", dc.posted, want)
+	}
+}
+
+func TestPostNewCommitsSeen(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	c1 := f.commit("a.txt", "first")
+	c2 := f.commit("a.txt", "second")
+	c3 := f.commit("a.txt", "third")
+	f.git("checkout", "-q", "-b", "dev", c2)
+	d1 := f.commit("b.txt", "dev first")
+
+	// The dashboard already knows the first two commits, so only
+	// those after them are posted, on each branch.
+	dc := &fakeDashClient{seen: map[string]bool{c1: true, c2: true}}
+	r := f.newRepo(dc)
+	if b := r.branches[master]; b.LastSeen == nil || b.LastSeen.Hash != c2 {
+		t.Errorf("master's LastSeen = %v; want %s", b.LastSeen, c2)
+	}
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	// fakeDashClient checks that each is posted after its parent;
+	// the branches may be updated in either order.
+	sort.Strings(dc.posted)
+	want := []string{c3, d1}
+	sort.Strings(want)
+	if !reflect.DeepEqual(dc.posted, want) {
+		t.Errorf("posted %q; want %q", dc.posted, want)
+	}
+}
+
+func TestPostNewCommitsFirstCommitAbort(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	head := f.commit("a.txt", "second")
+
+	// A dashboard that already has a first commit for the package,
+	// though not one of these, refuses to bootstrap it again. The
+	// branch is then taken to be up to date.
+	dc := &fakeDashClient{postErr: errors.New("error: this package already has a first commit; aborting")}
+	r := f.newRepo(dc)
+	b := r.branches[master]
+	if err := r.postNewCommits(b); err != nil {
+		t.Fatalf("postNewCommits = %v; want the abort ignored", err)
+	}
+	if b.LastSeen != b.Head || b.Head.Hash != head {
+		t.Errorf("LastSeen = %v; want head %s", b.LastSeen, head)
+	}
+	if len(dc.posted) != 0 {
+		t.Errorf("posted %q; want none", dc.posted)
+	}
+
+	// Other errors are returned.
+	b.LastSeen = nil
+	dc.postErr = errors.New("error: datastore unavailable")
+	if err := r.postNewCommits(b); err == nil || !strings.Contains(err.Error(), "datastore unavailable") {
+		t.Errorf("postNewCommits = %v; want the dashboard's error", err)
+	}
+}
+
+// runWork stands in for r's Watch loop until the end of the test,
+// running the functions sent to it by Repo.do.
+func runWork(t *testing.T, r *Repo) {
+	stop := make(chan bool)
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case fn := <-r.work:
+				fn()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func TestServeRepost(t *testing.T) {
+	offline(t)
+	defer func(v string) { *httpToken = v }(*httpToken)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	lost := f.commit("a.txt", "second")
+	f.commit("a.txt", "third")
+	dc := new(fakeDashClient)
+	r := f.newRepo(dc)
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	runWork(t, r)
+	repost := func(method, hash string) (int, string) {
+		w := httptest.NewRecorder()
+		r.serveRepost(w, httptest.NewRequest(method, "/debug/watcher/"+r.name()+"/repost?hash="+hash, nil))
+		return w.Code, w.Body.String()
+	}
+
+	*httpToken = ""
+	if code, _ := repost("POST", lost); code != http.StatusForbidden {
+		t.Errorf("repost without -watcher.http.token: status %d; want 403", code)
+	}
+	*httpToken = "s3cret"
+	if code, _ := repost("GET", lost); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET repost: status %d; want 405", code)
+	}
+	if code, _ := repost("POST", lost[:7]); code != http.StatusBadRequest {
+		t.Errorf("repost of abbreviated hash: status %d; want 400", code)
+	}
+	if code, _ := repost("POST", strings.Repeat("0", 40)); code != http.StatusNotFound {
+		t.Errorf("repost of unknown commit: status %d; want 404", code)
+	}
+
+	// The dashboard already has it.
+	if code, body := repost("POST", lost); code != http.StatusBadGateway || !strings.Contains(body, "posted "+lost+" twice") {
+		t.Errorf("repost of known commit: %d %q; want 502 with the dashboard's error", code, body)
+	}
+
+	// The dashboard lost it.
+	delete(dc.seen, lost)
+	dc.posted = nil
+	if code, body := repost("POST", lost); code != 200 || !strings.HasPrefix(body, "reposted "+lost) {
+		t.Errorf("repost of lost commit: %d %q; want 200", code, body)
+	}
+	if want := []string{lost}; !reflect.DeepEqual(dc.posted, want) {
+		t.Errorf("posted %q; want %q", dc.posted, want)
+	}
+}
+
+func TestInitialCommitSeveralRoots(t *testing.T) {
+	offline(t)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	c1 := f.commit("a.txt", "first")
+	f.git("checkout", "-q", "--orphan", "imported")
+	f.git("rm", "-q", "-rf", ".")
+	other := f.commit("b.txt", "imported history")
+	f.git("checkout", "-q", master)
+	f.git("merge", "-q", "--allow-unrelated-histories", "-m", "merge imported history", "imported")
+	merge := f.git("rev-parse", "HEAD")
+	f.git("branch", "-q", "-D", "imported")
+
+	dc := new(fakeDashClient)
+	r := f.newRepo(dc)
+	var roots []string
+	for _, c := range r.roots {
+		roots = append(roots, c.Hash)
+	}
+	sort.Strings(roots)
+	want := []string{c1, other}
+	sort.Strings(want)
+	if !reflect.DeepEqual(roots, want) {
+		t.Errorf("roots = %q; want %q", roots, want)
+	}
+	if c, err := r.initialCommit(r.branches[master]); err != nil || c.Hash != c1 {
+		t.Errorf("initialCommit = %v, %v; want %s, master's first-parent root", c, err, c1)
+	}
+
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{c1, merge}; !reflect.DeepEqual(dc.posted, want) {
+		t.Errorf("posted %q; want %q", dc.posted, want)
+	}
+}
+
+func TestCommitFilter(t *testing.T) {
+	gopherbot := &Commit{Author: "Gopher Robot <gobot@golang.org>", Desc: "all: update vendored dependencies"}
+	human := &Commit{Author: "Gopher <gopher@golang.org>", Desc: "net/http: fix race\n\nFixes #1234"}
+	tests := []struct {
+		spec            string
+		gopherbot, user bool // whether each is allowed
+	}{
+		{"", true, true},
+		{"!author:gobot@golang.org", false, true},
+		{"author:gopher@", false, true},
+		{"desc:^net/http:", false, true},
+		{`desc:Fixes\s#\d+`, false, true},
+		{"desc:update desc:vendored", true, false},
+		{"!author:Robot author:golang.org", false, true},
+	}
+	for _, tt := range tests {
+		f, err := parseCommitFilter(tt.spec)
+		if err != nil {
+			t.Errorf("parseCommitFilter(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := f.allows(gopherbot); got != tt.gopherbot {
+			t.Errorf("%q allows gopherbot's commit = %v; want %v", tt.spec, got, tt.gopherbot)
+		}
+		if got := f.allows(human); got != tt.user {
+			t.Errorf("%q allows user's commit = %v; want %v", tt.spec, got, tt.user)
+		}
+	}
+	for _, bad := range []string{"author", "author:", "subject:x", "desc:(", "!"} {
+		if _, err := parseCommitFilter(bad); err == nil {
+			t.Errorf("parseCommitFilter(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestPostFilterReparents(t *testing.T) {
+	offline(t)
+	defer func(f commitFilter) { postFilter = f }(postFilter)
+	var err error
+	if postFilter, err = parseCommitFilter("!desc:^skip"); err != nil {
+		t.Fatal(err)
+	}
+	f := newGitFixture(t)
+	defer f.cleanup()
+	c1 := f.commit("a.txt", "first")
+	f.commit("a.txt", "skip me")
+	c3 := f.commit("a.txt", "third")
+	f.commit("a.txt", "skip the head too")
+
+	dc := new(fakeDashClient)
+	r := f.newRepo(dc)
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	// fakeDashClient checks that each commit's parent was posted,
+	// so c3 must have been posted with c1 as its parent.
+	if want := []string{c1, c3}; !reflect.DeepEqual(dc.posted, want) {
+		t.Errorf("posted %q; want %q", dc.posted, want)
+	}
+	if got := r.dashParent(r.commits[c3]); got != c1 {
+		t.Errorf("dashParent of %s = %s; want %s", c3, got, c1)
+	}
+	if b := r.branches[master]; b.LastSeen != b.Head {
+		t.Errorf("LastSeen = %v; want the (skipped) head %v", b.LastSeen, b.Head)
+	}
+}
+
+func TestGerritMetaErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, body string
+		status     int
+		want       string
+	}{
+		{"status", "", http.StatusServiceUnavailable, "status 503"},
+		{"empty", "", 200, "empty response"},
+		{"truncated", ")]}'", 200, "nothing after its )]}' line"},
+		{"no prefix", "{\"go\": {}}\n", 200, "doesn't start with Gerrit's )]}' line; got \"{\\\"go\\\": {}}\\n\""},
+		{"HTML", "<!DOCTYPE html><html><head><title>Sign in</title></head></html>\n", 200, "got \"<!DOCTYPE html><html><head><title>Sign i...\""},
+		{"bad JSON", ")]}'\n{\"go\": ", 200, "JSON decoding error"},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		meta, err := gerritMeta(ts.URL + "/?format=JSON")
+		ts.Close()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: gerritMeta = %v, %v; want error containing %q", tt.name, meta, err, tt.want)
+		}
+	}
+}
+
+func TestGerritPollWait(t *testing.T) {
+	defer func(d time.Duration) { *pollInterval = d }(*pollInterval)
+	*pollInterval = 10 * time.Second
+	for _, tt := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 20 * time.Second},
+		{3, 80 * time.Second},
+		{5, maxBackoff},
+		{100, maxBackoff},
+	} {
+		if got := gerritPollWait(tt.failures); got != tt.want {
+			t.Errorf("gerritPollWait(%d) = %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+	*pollInterval = time.Hour
+	if got := gerritPollWait(3); got != time.Hour {
+		t.Errorf("with -watcher.poll=1h, gerritPollWait(3) = %v; want 1h", got)
+	}
+}
+
+func TestGaugeMetric(t *testing.T) {
+	setMetric("watcher_gerrit_poll_consecutive_failures", "", 3)
+	defer setMetric("watcher_gerrit_poll_consecutive_failures", "", 0)
+	w := httptest.NewRecorder()
+	handleWatcherMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"# TYPE watcher_gerrit_poll_consecutive_failures gauge\n",
+		"watcher_gerrit_poll_consecutive_failures{repo=\"\"} 3\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics doesn't contain %q:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestGerritBaseFlags(t *testing.T) {
+	defer func(base, meta, prefix, repo string) {
+		*gerritBase, *metaFlag, *subrepoBase, *repoURL = base, meta, prefix, repo
+	}(*gerritBase, *metaFlag, *subrepoBase, *repoURL)
+
+	if got, want := gerritMetaURL([]string{master}), "https://go.googlesource.com/?format=JSON&b=master"; got != want {
+		t.Errorf("default gerritMetaURL = %q; want %q", got, want)
+	}
+	if got, want := mainRepoURL(), "https://go.googlesource.com/go"; got != want {
+		t.Errorf("default mainRepoURL = %q; want %q", got, want)
+	}
+	if got := subrepoName("golang.org/x/net"); got != "net" {
+		t.Errorf("default subrepoName = %q; want net", got)
+	}
+
+	*gerritBase = "https://gerrit.example.com/"
+	*subrepoBase = "example.com/go/"
+	if got, want := gerritMetaURL([]string{master}), "https://gerrit.example.com/?format=JSON&b=master"; got != want {
+		t.Errorf("gerritMetaURL = %q; want %q", got, want)
+	}
+	if got, want := mainRepoURL(), "https://gerrit.example.com/go"; got != want {
+		t.Errorf("mainRepoURL = %q; want %q", got, want)
+	}
+	if got := subrepoPath("tools"); got != "example.com/go/tools" {
+		t.Errorf("subrepoPath = %q; want example.com/go/tools", got)
+	}
+	if got := subrepoName("example.com/go/tools"); got != "tools" {
+		t.Errorf("subrepoName = %q; want tools", got)
+	}
+	*metaFlag = "https://meta.example.com/projects/?format=JSON&d"
+	if got, want := gerritMetaURL([]string{master}), *metaFlag+"&b=master"; got != want {
+		t.Errorf("with -watcher.metaurl, gerritMetaURL = %q; want %q", got, want)
+	}
+	*repoURL = "bundle:///tmp/go.bundle"
+	if got := mainRepoURL(); got != *repoURL {
+		t.Errorf("with -watcher.repo, mainRepoURL = %q; want %q", got, *repoURL)
+	}
+}
+
+func TestServeResync(t *testing.T) {
+	offline(t)
+	defer func(v string) { *httpToken = v }(*httpToken)
+	f := newGitFixture(t)
+	defer f.cleanup()
+	f.commit("a.txt", "first")
+	f.commit("a.txt", "second")
+	f.git("checkout", "-q", "-b", "dev")
+	f.commit("b.txt", "dev first")
+	f.git("checkout", "-q", master)
+	head := f.commit("a.txt", "third")
+	dc := new(fakeDashClient)
+	r := f.newRepo(dc)
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+
+	runWork(t, r)
+	resync := func(method string) (int, string) {
+		w := httptest.NewRecorder()
+		r.serveResync(w, httptest.NewRequest(method, "/debug/watcher/"+r.name()+"/resync", nil))
+		return w.Code, w.Body.String()
+	}
+
+	*httpToken = ""
+	if code, _ := resync("POST"); code != http.StatusForbidden {
+		t.Errorf("resync without -watcher.http.token: status %d; want 403", code)
+	}
+	*httpToken = "s3cret"
+	if code, _ := resync("GET"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET resync: status %d; want 405", code)
+	}
+
+	// Let the graph drift: forget a commit and a branch's LastSeen.
+	delete(r.commits, head)
+	delete(r.branches, "dev")
+	r.branches[master].LastSeen = nil
+	code, body := resync("POST")
+	if code != 200 {
+		t.Fatalf("resync: status %d: %s", code, body)
+	}
+	for _, want := range []string{
+		"resynced: 4 commits on 2 branches (was 3 commits on 1 branches)\n",
+		"branch " + master + ": head " + head + ", last seen " + head + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("resync response doesn't contain %q:\n%s", want, body)
+		}
+	}
+	if b := r.branches[master]; b.LastSeen == nil || b.LastSeen.Hash != head {
+		t.Errorf("after resync, LastSeen = %v; want %s", b.LastSeen, head)
+	}
+
+	// Nothing is posted again.
+	dc.posted = nil
+	if err := r.updateDashboard(); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.posted) != 0 {
+		t.Errorf("after resync, posted %q; want none", dc.posted)
+	}
+	if n := len(r.snapshot().Authors); n != 4 {
+		t.Errorf("after resync, snapshot has %d authors; want 4, one per commit", n)
+	}
+}